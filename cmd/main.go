@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"log"
 	"os"
 	"time"
 
@@ -11,11 +12,12 @@ import (
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/spf13/viper"
 )
 
 func main() {
 	if len(os.Args) < 2 {
-		fmt.Println("Usage: go run cmd/main.go [server|sync]")
+		fmt.Println("Usage: go run cmd/main.go [server|sync|smtpd|imapd|pop3d]")
 		os.Exit(1)
 	}
 
@@ -27,8 +29,14 @@ func main() {
 		runServer()
 	case "sync":
 		runSync()
+	case "smtpd":
+		runSMTPServer()
+	case "imapd":
+		runIMAPServer()
+	case "pop3d":
+		runPOP3Server()
 	default:
-		fmt.Println("Invalid command. Usage: go run cmd/main.go [server|sync]")
+		fmt.Println("Invalid command. Usage: go run cmd/main.go [server|sync|smtpd|imapd|pop3d]")
 		os.Exit(1)
 	}
 }
@@ -56,9 +64,50 @@ func runServer() {
 func runSync() {
 	fmt.Println("init sync emails")
 
+	// Turn stored raw emails into mailbox entries
+	workers := viper.GetInt("INCOMING_WORKERS")
+	if workers <= 0 {
+		workers = 4
+	}
+	email.StartIncomingEmailWorkers(workers)
+
+	// Fill in the search text of emails stored before full-text search
+	go func() {
+		if err := email.BackfillBodyText(); err != nil {
+			fmt.Println("Error backfilling body text:", err)
+		}
+	}()
+
+	// Deliver queued outbound emails
+	outboundWorkers := viper.GetInt("OUTBOUND_WORKERS")
+	if outboundWorkers <= 0 {
+		outboundWorkers = 2
+	}
+	email.StartOutboundEmailWorkers(outboundWorkers)
+
+	// Inbound objects arrive through S3 event notifications (SYNC_SOURCE=sqs
+	// here, or =sns through the server endpoint); the bucket listing then
+	// only runs every SYNC_RECONCILE_INTERVAL to catch missed events
+	listInterval := 4 * time.Second
+	switch viper.GetString("SYNC_SOURCE") {
+	case "sqs":
+		queueURL := viper.GetString("SQS_QUEUE_URL")
+		if queueURL == "" {
+			log.Fatal("SQS_QUEUE_URL is required when SYNC_SOURCE=sqs")
+		}
+		go email.RunSQSConsumer(queueURL)
+		listInterval = viper.GetDuration("SYNC_RECONCILE_INTERVAL")
+	case "sns":
+		listInterval = viper.GetDuration("SYNC_RECONCILE_INTERVAL")
+	}
+
 	// Start the periodic task in a separate goroutine
 	go func() {
-		ticker := time.NewTicker(4 * time.Second)
+		if listInterval <= 0 {
+			return
+		}
+
+		ticker := time.NewTicker(listInterval)
 		defer ticker.Stop()
 
 		for {
@@ -73,6 +122,86 @@ func runSync() {
 		}
 	}()
 
+	// Enforce mailbox retention policies
+	go func() {
+		interval := viper.GetDuration("RETENTION_INTERVAL")
+		if interval <= 0 {
+			interval = 10 * time.Minute
+		}
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			<-ticker.C
+			fmt.Println("enforce retention policies", time.Now())
+			err := email.EnforceRetentionPolicies()
+			if err != nil {
+				fmt.Println("Error enforcing retention policies:", err)
+			}
+
+			err = email.PurgeQuarantine()
+			if err != nil {
+				fmt.Println("Error purging quarantine:", err)
+			}
+		}
+	}()
+
+	// Hand scheduled emails to the outbound queue once they are due
+	go func() {
+		interval := viper.GetDuration("SCHEDULED_INTERVAL")
+		if interval <= 0 {
+			interval = 30 * time.Second
+		}
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			<-ticker.C
+			err := email.DispatchScheduledEmails()
+			if err != nil {
+				fmt.Println("Error dispatching scheduled emails:", err)
+			}
+		}
+	}()
+
 	// Block the main goroutine to keep the application running
 	select {}
 }
+
+func runSMTPServer() {
+	s, err := email.NewSMTPServer()
+	if err != nil {
+		log.Fatalf("Failed to configure SMTP server: %v", err)
+	}
+
+	fmt.Println("init smtp server on", s.Addr)
+	if err := s.ListenAndServe(); err != nil {
+		log.Fatalf("SMTP server stopped: %v", err)
+	}
+}
+
+func runIMAPServer() {
+	s, err := email.NewIMAPServer()
+	if err != nil {
+		log.Fatalf("Failed to configure IMAP server: %v", err)
+	}
+
+	fmt.Println("init imap server on", s.Addr)
+	if err := s.ListenAndServe(); err != nil {
+		log.Fatalf("IMAP server stopped: %v", err)
+	}
+}
+
+func runPOP3Server() {
+	s, err := email.NewPOP3Server()
+	if err != nil {
+		log.Fatalf("Failed to configure POP3 server: %v", err)
+	}
+
+	fmt.Println("init pop3 server on", s.Addr)
+	if err := s.ListenAndServe(); err != nil {
+		log.Fatalf("POP3 server stopped: %v", err)
+	}
+}
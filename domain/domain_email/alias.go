@@ -0,0 +1,414 @@
+package domain
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strings"
+
+	"github.com/Triaksa-Space/be-mail-platform/config"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// Aliases and catch-alls are resolved by the inbound routing of the email
+// package. A user address always wins over an alias, and an alias over the
+// catch-all of its domain. The local part of a plus-address (user+tag) is
+// matched without its tag.
+
+// ListDomainAliasesHandler lists the aliases of a domain with their targets.
+func ListDomainAliasesHandler(c echo.Context) error {
+	domain, err := getDomain(c.Param("id"))
+	if err != nil {
+		return domainErrorResponse(c, err)
+	}
+
+	var aliases []DomainAlias
+	err = config.DB.Select(&aliases, `
+		SELECT id, domain_id, local_part, created_at, updated_at
+		FROM domain_aliases
+		WHERE domain_id = ?
+		ORDER BY local_part`, domain.ID)
+	if err != nil {
+		fmt.Println("Failed to fetch aliases", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch aliases"})
+	}
+
+	aliasIDs := make([]int64, len(aliases))
+	for i := range aliases {
+		aliasIDs[i] = aliases[i].ID
+	}
+	targets, err := getAliasTargets(aliasIDs)
+	if err != nil {
+		fmt.Println("Failed to fetch alias targets", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch aliases"})
+	}
+
+	for i := range aliases {
+		aliases[i].Address = aliases[i].LocalPart + "@" + domain.Domain
+		aliases[i].Targets = targets[aliases[i].ID]
+	}
+
+	return c.JSON(http.StatusOK, aliases)
+}
+
+// CreateDomainAliasHandler creates an alias delivering to one or more users.
+func CreateDomainAliasHandler(c echo.Context) error {
+	domain, err := getDomain(c.Param("id"))
+	if err != nil {
+		return domainErrorResponse(c, err)
+	}
+
+	req, userIDs, err := bindAliasRequest(c, domain)
+	if err != nil {
+		return aliasErrorResponse(c, err)
+	}
+
+	tx, err := config.DB.Beginx()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create alias"})
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		INSERT INTO domain_aliases (domain_id, local_part, created_at, updated_at)
+		VALUES (?, ?, NOW(), NOW())`, domain.ID, req.LocalPart)
+	if isDuplicateKeyError(err) {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Alias already exists"})
+	}
+	if err != nil {
+		fmt.Println("Error inserting alias:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create alias"})
+	}
+	aliasID, err := result.LastInsertId()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create alias"})
+	}
+
+	if err := insertAliasTargets(tx, aliasID, userIDs); err != nil {
+		fmt.Println("Error inserting alias targets:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create alias"})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create alias"})
+	}
+
+	return c.JSON(http.StatusCreated, map[string]interface{}{"message": "Alias created successfully", "id": aliasID})
+}
+
+// UpdateDomainAliasHandler renames an alias and replaces its targets.
+func UpdateDomainAliasHandler(c echo.Context) error {
+	domain, err := getDomain(c.Param("id"))
+	if err != nil {
+		return domainErrorResponse(c, err)
+	}
+
+	req, userIDs, err := bindAliasRequest(c, domain)
+	if err != nil {
+		return aliasErrorResponse(c, err)
+	}
+
+	tx, err := config.DB.Beginx()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update alias"})
+	}
+	defer tx.Rollback()
+
+	var aliasID int64
+	err = tx.Get(&aliasID, "SELECT id FROM domain_aliases WHERE id = ? AND domain_id = ? FOR UPDATE", c.Param("alias_id"), domain.ID)
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Alias not found"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update alias"})
+	}
+
+	_, err = tx.Exec("UPDATE domain_aliases SET local_part = ?, updated_at = NOW() WHERE id = ?", req.LocalPart, aliasID)
+	if isDuplicateKeyError(err) {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Alias already exists"})
+	}
+	if err != nil {
+		fmt.Println("Error updating alias:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update alias"})
+	}
+
+	_, err = tx.Exec("DELETE FROM domain_alias_targets WHERE alias_id = ?", aliasID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update alias"})
+	}
+	if err := insertAliasTargets(tx, aliasID, userIDs); err != nil {
+		fmt.Println("Error inserting alias targets:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update alias"})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update alias"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Alias updated successfully"})
+}
+
+// DeleteDomainAliasHandler deletes an alias, its targets go with it.
+func DeleteDomainAliasHandler(c echo.Context) error {
+	domain, err := getDomain(c.Param("id"))
+	if err != nil {
+		return domainErrorResponse(c, err)
+	}
+
+	result, err := config.DB.Exec("DELETE FROM domain_aliases WHERE id = ? AND domain_id = ?", c.Param("alias_id"), domain.ID)
+	if err != nil {
+		fmt.Println("Error deleting alias:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete alias"})
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Alias not found"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Alias deleted successfully"})
+}
+
+// GetDomainCatchAllHandler returns the mailbox receiving mail for unknown
+// addresses of a domain.
+func GetDomainCatchAllHandler(c echo.Context) error {
+	domain, err := getDomain(c.Param("id"))
+	if err != nil {
+		return domainErrorResponse(c, err)
+	}
+
+	var catchAll DomainCatchAll
+	err = config.DB.Get(&catchAll, `
+		SELECT c.domain_id, u.email, c.updated_at
+		FROM domain_catch_alls c
+		JOIN users u ON u.id = c.user_id
+		WHERE c.domain_id = ?`, domain.ID)
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Domain has no catch-all"})
+	}
+	if err != nil {
+		fmt.Println("Failed to fetch catch-all", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch catch-all"})
+	}
+
+	return c.JSON(http.StatusOK, catchAll)
+}
+
+// UpdateDomainCatchAllHandler sets the catch-all mailbox of a domain.
+func UpdateDomainCatchAllHandler(c echo.Context) error {
+	domain, err := getDomain(c.Param("id"))
+	if err != nil {
+		return domainErrorResponse(c, err)
+	}
+
+	req := new(DomainCatchAllRequest)
+	if err := c.Bind(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+	}
+	if !isEmailAddress(req.Email) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid email"})
+	}
+
+	userIDs, err := getUserIDs([]string{req.Email})
+	if err != nil {
+		return aliasErrorResponse(c, err)
+	}
+
+	_, err = config.DB.Exec(`
+		INSERT INTO domain_catch_alls (domain_id, user_id, created_at, updated_at)
+		VALUES (?, ?, NOW(), NOW())
+		ON DUPLICATE KEY UPDATE user_id = VALUES(user_id), updated_at = NOW()`,
+		domain.ID, userIDs[0])
+	if err != nil {
+		fmt.Println("Error updating catch-all:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update catch-all"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Catch-all updated successfully"})
+}
+
+// DeleteDomainCatchAllHandler removes the catch-all of a domain.
+func DeleteDomainCatchAllHandler(c echo.Context) error {
+	domain, err := getDomain(c.Param("id"))
+	if err != nil {
+		return domainErrorResponse(c, err)
+	}
+
+	result, err := config.DB.Exec("DELETE FROM domain_catch_alls WHERE domain_id = ?", domain.ID)
+	if err != nil {
+		fmt.Println("Error deleting catch-all:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete catch-all"})
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Domain has no catch-all"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Catch-all deleted successfully"})
+}
+
+func getDomain(domainID string) (DomainEmail, error) {
+	var domain DomainEmail
+	err := config.DB.Get(&domain, "SELECT id, domain, created_at, updated_at FROM domains WHERE id = ?", domainID)
+	return domain, err
+}
+
+func domainErrorResponse(c echo.Context, err error) error {
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Domain not found"})
+	}
+	fmt.Println("Failed to fetch domain", err)
+	return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch domain"})
+}
+
+// requestError is a validation failure reported to the client as is.
+type requestError struct {
+	status  int
+	message string
+}
+
+func (e requestError) Error() string {
+	return e.message
+}
+
+func aliasErrorResponse(c echo.Context, err error) error {
+	if reqErr, ok := err.(requestError); ok {
+		return c.JSON(reqErr.status, map[string]string{"error": reqErr.message})
+	}
+	fmt.Println("Failed to check alias", err)
+	return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to check alias"})
+}
+
+// bindAliasRequest validates an alias request and resolves its targets.
+func bindAliasRequest(c echo.Context, domain DomainEmail) (*DomainAliasRequest, []int64, error) {
+	req := new(DomainAliasRequest)
+	if err := c.Bind(req); err != nil {
+		return nil, nil, requestError{http.StatusBadRequest, "Invalid request payload"}
+	}
+	if len(req.Targets) == 0 {
+		return nil, nil, requestError{http.StatusBadRequest, "At least one target is required"}
+	}
+	for _, target := range req.Targets {
+		if !isEmailAddress(target) {
+			return nil, nil, requestError{http.StatusBadRequest, fmt.Sprintf("Invalid target %s", target)}
+		}
+	}
+
+	req.LocalPart = strings.ToLower(strings.TrimSpace(req.LocalPart))
+	if req.LocalPart == "" || strings.ContainsAny(req.LocalPart, "@+ \t") || len(req.LocalPart) > 64 {
+		return nil, nil, requestError{http.StatusBadRequest, "Invalid alias local part"}
+	}
+
+	// A user with the same address would always win over the alias
+	var userExists bool
+	err := config.DB.Get(&userExists, "SELECT EXISTS(SELECT 1 FROM users WHERE email = ?)", req.LocalPart+"@"+domain.Domain)
+	if err != nil {
+		return nil, nil, err
+	}
+	if userExists {
+		return nil, nil, requestError{http.StatusConflict, "A user already has this address"}
+	}
+
+	userIDs, err := getUserIDs(req.Targets)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return req, userIDs, nil
+}
+
+// getUserIDs returns the IDs of the users with the given emails, failing if
+// any of them is unknown.
+func getUserIDs(targets []string) ([]int64, error) {
+	emails := make([]string, len(targets))
+	for i, email := range targets {
+		emails[i] = strings.ToLower(strings.TrimSpace(email))
+	}
+
+	query, args, err := sqlx.In("SELECT id, email FROM users WHERE email IN (?)", emails)
+	if err != nil {
+		return nil, err
+	}
+
+	var users []struct {
+		ID    int64  `db:"id"`
+		Email string `db:"email"`
+	}
+	if err := config.DB.Select(&users, config.DB.Rebind(query), args...); err != nil {
+		return nil, err
+	}
+
+	ids := map[string]int64{}
+	for _, u := range users {
+		ids[strings.ToLower(u.Email)] = u.ID
+	}
+
+	var userIDs []int64
+	for _, email := range emails {
+		id, ok := ids[email]
+		if !ok {
+			return nil, requestError{http.StatusBadRequest, fmt.Sprintf("User %s not found", email)}
+		}
+		userIDs = append(userIDs, id)
+	}
+	return userIDs, nil
+}
+
+// isDuplicateKeyError reports a unique key violation, here an alias taken
+// by another one of the domain.
+func isDuplicateKeyError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1062
+}
+
+func isEmailAddress(address string) bool {
+	parsed, err := mail.ParseAddress(address)
+	return err == nil && parsed.Address == strings.TrimSpace(address)
+}
+
+// getAliasTargets returns the emails of the users each alias delivers to,
+// keyed by alias ID.
+func getAliasTargets(aliasIDs []int64) (map[int64][]string, error) {
+	targets := map[int64][]string{}
+	if len(aliasIDs) == 0 {
+		return targets, nil
+	}
+
+	query, args, err := sqlx.In(`
+		SELECT t.alias_id, u.email
+		FROM domain_alias_targets t
+		JOIN users u ON u.id = t.user_id
+		WHERE t.alias_id IN (?)
+		ORDER BY u.email`, aliasIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []struct {
+		AliasID int64  `db:"alias_id"`
+		Email   string `db:"email"`
+	}
+	if err := config.DB.Select(&rows, config.DB.Rebind(query), args...); err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		targets[row.AliasID] = append(targets[row.AliasID], row.Email)
+	}
+	return targets, nil
+}
+
+func insertAliasTargets(tx *sqlx.Tx, aliasID int64, userIDs []int64) error {
+	for _, userID := range userIDs {
+		_, err := tx.Exec("INSERT IGNORE INTO domain_alias_targets (alias_id, user_id) VALUES (?, ?)", aliasID, userID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
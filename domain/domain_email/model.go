@@ -12,3 +12,39 @@ type DomainEmail struct {
 type CreateDomainRequest struct {
 	Domain string `json:"domain" validate:"required"`
 }
+
+type DomainAlias struct {
+	ID        int64     `db:"id" json:"id"`
+	DomainID  int64     `db:"domain_id" json:"domain_id"`
+	LocalPart string    `db:"local_part" json:"local_part"`
+	Address   string    `db:"-" json:"address"`
+	Targets   []string  `db:"-" json:"targets"` // Emails of the users it delivers to
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt time.Time `db:"updated_at" json:"updated_at"`
+}
+
+type DomainAliasRequest struct {
+	LocalPart string   `json:"local_part"`
+	Targets   []string `json:"targets"`
+}
+
+type DomainCatchAll struct {
+	DomainID  int64     `db:"domain_id" json:"domain_id"`
+	Email     string    `db:"email" json:"email"`
+	UpdatedAt time.Time `db:"updated_at" json:"updated_at"`
+}
+
+type DomainCatchAllRequest struct {
+	Email string `json:"email"`
+}
+
+type DomainTransport struct {
+	DomainID  int64  `db:"domain_id" json:"domain_id"`
+	Domain    string `db:"domain" json:"domain"`
+	Transport string `db:"transport" json:"transport"` // Empty when the default is used
+	Effective string `db:"-" json:"effective"`         // Transport mail is sent with
+}
+
+type DomainTransportRequest struct {
+	Transport string `json:"transport"`
+}
@@ -0,0 +1,79 @@
+package domain
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Triaksa-Space/be-mail-platform/config"
+	"github.com/Triaksa-Space/be-mail-platform/pkg"
+	"github.com/labstack/echo/v4"
+)
+
+// GetDomainTransportHandler returns the outbound transport of a domain.
+func GetDomainTransportHandler(c echo.Context) error {
+	domain, err := getDomain(c.Param("id"))
+	if err != nil {
+		return domainErrorResponse(c, err)
+	}
+
+	transport := DomainTransport{DomainID: domain.ID, Domain: domain.Domain}
+	err = config.DB.Get(&transport.Transport, "SELECT COALESCE(transport, '') FROM domains WHERE id = ?", domain.ID)
+	if err != nil {
+		return domainErrorResponse(c, err)
+	}
+
+	transport.Effective = transport.Transport
+	if transport.Effective == "" {
+		transport.Effective = pkg.DefaultTransport()
+	}
+
+	return c.JSON(http.StatusOK, transport)
+}
+
+// UpdateDomainTransportHandler sets the transport mail from a domain is sent
+// with: ses, smtp, haraka or file.
+func UpdateDomainTransportHandler(c echo.Context) error {
+	domain, err := getDomain(c.Param("id"))
+	if err != nil {
+		return domainErrorResponse(c, err)
+	}
+
+	req := new(DomainTransportRequest)
+	if err := c.Bind(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+	}
+	transport := strings.ToLower(strings.TrimSpace(req.Transport))
+	if !pkg.IsTransport(transport) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid transport"})
+	}
+
+	_, err = config.DB.Exec("UPDATE domains SET transport = ?, updated_at = NOW() WHERE id = ?", transport, domain.ID)
+	if err != nil {
+		fmt.Println("Error updating transport:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update transport"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Transport updated successfully"})
+}
+
+// DeleteDomainTransportHandler puts a domain back on the default transport.
+func DeleteDomainTransportHandler(c echo.Context) error {
+	domain, err := getDomain(c.Param("id"))
+	if err != nil {
+		return domainErrorResponse(c, err)
+	}
+
+	result, err := config.DB.Exec("UPDATE domains SET transport = NULL, updated_at = NOW() WHERE id = ? AND transport IS NOT NULL", domain.ID)
+	if err != nil {
+		fmt.Println("Error deleting transport:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete transport"})
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Domain has no transport"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Transport deleted successfully"})
+}
@@ -0,0 +1,85 @@
+package email
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jhillyerd/enmime"
+	"github.com/jmoiron/sqlx"
+)
+
+// errDuplicateEmail reports that a recipient already has a message, so the
+// delivery is skipped rather than failed.
+var errDuplicateEmail = errors.New("email already delivered")
+
+// emailFingerprint identifies an inbound message independently of the
+// source it came from: the Message-ID header, which survives re-encoding,
+// and the SHA-256 of the raw bytes for messages without one.
+type emailFingerprint struct {
+	HeaderMessageID string
+	ContentHash     string
+}
+
+func fingerprintEmail(env *enmime.Envelope, emailContent []byte) emailFingerprint {
+	sum := sha256.Sum256(emailContent)
+	return emailFingerprint{
+		HeaderMessageID: normalizeMessageID(env.GetHeader("Message-ID")),
+		ContentHash:     hex.EncodeToString(sum[:]),
+	}
+}
+
+// normalizeMessageID strips the angle brackets and surrounding space of a
+// Message-ID header value.
+func normalizeMessageID(messageID string) string {
+	messageID = strings.TrimSpace(messageID)
+	messageID = strings.TrimPrefix(messageID, "<")
+	messageID = strings.TrimSuffix(messageID, ">")
+	if len(messageID) > 255 {
+		messageID = messageID[:255]
+	}
+	return messageID
+}
+
+// headerMessageID returns the Message-ID as a query argument, NULL when the
+// message has none so that it never matches another message.
+func (f emailFingerprint) headerMessageID() interface{} {
+	if f.HeaderMessageID == "" {
+		return nil
+	}
+	return f.HeaderMessageID
+}
+
+// alreadyDelivered reports whether the inbox of the user holds the message.
+func alreadyDelivered(q sqlx.Queryer, userID int64, fp emailFingerprint) (bool, error) {
+	var exists bool
+	err := sqlx.Get(q, &exists, `
+		SELECT EXISTS(
+			SELECT 1 FROM emails
+			WHERE user_id = ? AND email_type = 'inbox'
+				AND (content_hash = ? OR header_message_id = ?)
+		)`, userID, fp.ContentHash, fp.headerMessageID())
+	return exists, err
+}
+
+// alreadyQueued reports whether the message waits in incoming_emails for
+// the address. Dead letters do not count, a new copy may well succeed.
+func alreadyQueued(q sqlx.Queryer, address string, fp emailFingerprint) (bool, error) {
+	var exists bool
+	err := sqlx.Get(q, &exists, `
+		SELECT EXISTS(
+			SELECT 1 FROM incoming_emails
+			WHERE email_send_to = ? AND status <> ?
+				AND (content_hash = ? OR header_message_id = ?)
+		)`, address, IncomingStatusDead, fp.ContentHash, fp.headerMessageID())
+	return exists, err
+}
+
+// isDuplicateKeyError reports a unique key violation, which the unique
+// (user_id, content_hash) key of emails raises for concurrent deliveries.
+func isDuplicateKeyError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1062
+}
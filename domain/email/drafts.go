@@ -0,0 +1,333 @@
+package email
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strings"
+
+	"github.com/Triaksa-Space/be-mail-platform/config"
+	"github.com/Triaksa-Space/be-mail-platform/pkg"
+	"github.com/Triaksa-Space/be-mail-platform/utils"
+	"github.com/labstack/echo/v4"
+)
+
+var errDraftNotFound = errors.New("Draft not found")
+
+// draftAddresses joins the recipients of a draft into an address column.
+// Entries that parse are rewritten with their display names quoted, so the
+// column parses back as one address list even when a name holds a comma;
+// anything else, like a half typed address, is kept as typed.
+func draftAddresses(list AddressList) string {
+	var addresses []string
+	for _, entry := range list {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parsed, err := mail.ParseAddressList(entry)
+		if err != nil {
+			addresses = append(addresses, entry)
+			continue
+		}
+		for _, addr := range parsed {
+			addresses = append(addresses, draftAddress(addr))
+		}
+	}
+	return strings.Join(addresses, ", ")
+}
+
+// draftAddress formats an address like mail.Address.String, leaving
+// non-ASCII names readable instead of encoding them.
+func draftAddress(addr *mail.Address) string {
+	if addr.Name == "" {
+		return addr.Address
+	}
+	name := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(addr.Name)
+	return fmt.Sprintf(`"%s" <%s>`, name, addr.Address)
+}
+
+// ListDraftsHandler lists the drafts of the current user, the last edited
+// first.
+func ListDraftsHandler(c echo.Context) error {
+	userID := c.Get("user_id").(int64)
+
+	var drafts []DraftEmail
+	err := config.DB.Select(&drafts, `
+		SELECT id,
+			COALESCE(to_addresses, '') AS to_addresses,
+			COALESCE(cc_addresses, '') AS cc_addresses,
+			COALESCE(bcc_addresses, '') AS bcc_addresses,
+			COALESCE(subject, '') AS subject,
+			COALESCE(preview, '') AS preview,
+			COALESCE(body, '') AS body,
+			COALESCE(attachments, '') AS attachments,
+			updated_at
+		FROM emails
+		WHERE user_id = ? AND email_type = "draft"
+		ORDER BY updated_at DESC, id DESC`, userID)
+	if err != nil {
+		fmt.Println("Failed to fetch drafts", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch drafts"})
+	}
+
+	for i := range drafts {
+		drafts[i].EmailEncodeID = utils.EncodeID(int(drafts[i].ID))
+		drafts[i].ListAttachments = getAttachmentURLs(drafts[i].Attachments)
+	}
+
+	return c.JSON(http.StatusOK, drafts)
+}
+
+// CreateDraftHandler saves a new draft.
+func CreateDraftHandler(c echo.Context) error {
+	userID := c.Get("user_id").(int64)
+
+	emailUser, err := getUserEmail(userID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch user email"})
+	}
+
+	var req DraftEmailRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+	}
+	if err := checkAttachmentURLs(req.Attachments); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	attachmentsJSON, _ := json.Marshal(req.Attachments)
+	result, err := config.DB.Exec(`
+		INSERT INTO emails (
+			user_id,
+			email_type,
+			preview,
+			sender_email,
+			sender_name,
+			to_addresses,
+			cc_addresses,
+			bcc_addresses,
+			subject,
+			body,
+			attachments,
+			timestamp,
+			created_at,
+			updated_at,
+			created_by,
+			updated_by
+		)
+		VALUES (?, "draft", ?, ?, ?, ?, ?, ?, ?, ?, ?, NOW(), NOW(), NOW(), ?, ?)`,
+		userID, generatePreview("", req.Body), emailUser, strings.Split(emailUser, "@")[0],
+		draftAddresses(req.To), draftAddresses(req.Cc), draftAddresses(req.Bcc),
+		req.Subject, req.Body, attachmentsJSON, userID, userID)
+	if err != nil {
+		fmt.Println("Failed to save draft", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to save draft"})
+	}
+
+	draftID, _ := result.LastInsertId()
+	return c.JSON(http.StatusCreated, map[string]string{
+		"message":  "Draft saved successfully",
+		"email_id": utils.EncodeID(int(draftID)),
+	})
+}
+
+// UpdateDraftHandler replaces a draft with the current state of the editor,
+// it is called on every autosave.
+func UpdateDraftHandler(c echo.Context) error {
+	userID := c.Get("user_id").(int64)
+
+	draftID, err := utils.DecodeID(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid email ID"})
+	}
+
+	var req DraftEmailRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+	}
+	if err := checkAttachmentURLs(req.Attachments); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	attachmentsJSON, _ := json.Marshal(req.Attachments)
+	result, err := config.DB.Exec(`
+		UPDATE emails
+		SET to_addresses = ?, cc_addresses = ?, bcc_addresses = ?,
+			subject = ?, body = ?, preview = ?, attachments = ?,
+			timestamp = NOW(), updated_at = NOW(), updated_by = ?
+		WHERE id = ? AND user_id = ? AND email_type = "draft"`,
+		draftAddresses(req.To), draftAddresses(req.Cc), draftAddresses(req.Bcc),
+		req.Subject, req.Body, generatePreview("", req.Body), attachmentsJSON,
+		userID, draftID, userID)
+	if err != nil {
+		fmt.Println("Failed to save draft", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to save draft"})
+	}
+
+	// An unchanged draft also affects no rows, so look before answering 404
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		var exists bool
+		err = config.DB.Get(&exists, `
+			SELECT EXISTS(SELECT 1 FROM emails WHERE id = ? AND user_id = ? AND email_type = "draft")`,
+			draftID, userID)
+		if err != nil || !exists {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": errDraftNotFound.Error()})
+		}
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Draft saved successfully"})
+}
+
+// DeleteDraftHandler discards a draft. Its uploaded attachments are left to
+// DeleteUrlAttachmentHandler.
+func DeleteDraftHandler(c echo.Context) error {
+	userID := c.Get("user_id").(int64)
+
+	draftID, err := utils.DecodeID(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid email ID"})
+	}
+
+	result, err := config.DB.Exec(`
+		DELETE FROM emails
+		WHERE id = ? AND user_id = ? AND email_type = "draft"`, draftID, userID)
+	if err != nil {
+		fmt.Println("Failed to delete draft", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete draft"})
+	}
+
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": errDraftNotFound.Error()})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Draft deleted successfully"})
+}
+
+// SendDraftHandler sends a draft. The draft row itself becomes the sent
+// email, so it leaves the drafts as soon as it is queued.
+func SendDraftHandler(c echo.Context) error {
+	userID := c.Get("user_id").(int64)
+
+	draftID, err := utils.DecodeID(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid email ID"})
+	}
+
+	emailUser, err := getUserEmail(userID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch user email"})
+	}
+
+	var draft DraftEmail
+	err = config.DB.Get(&draft, `
+		SELECT id,
+			COALESCE(to_addresses, '') AS to_addresses,
+			COALESCE(cc_addresses, '') AS cc_addresses,
+			COALESCE(bcc_addresses, '') AS bcc_addresses,
+			COALESCE(subject, '') AS subject,
+			COALESCE(preview, '') AS preview,
+			COALESCE(body, '') AS body,
+			COALESCE(attachments, '') AS attachments,
+			updated_at
+		FROM emails
+		WHERE id = ? AND user_id = ? AND email_type = "draft"`, draftID, userID)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": errDraftNotFound.Error()})
+	}
+
+	// Every column is one address list, see draftAddresses
+	recipients, err := parseRecipients([]string{draft.To}, []string{draft.Cc}, []string{draft.Bcc})
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	if err := checkSuppressedRecipients(recipients); err != nil {
+		return suppressionResponse(c, err)
+	}
+
+	// Check email limit, every recipient counts
+	if err := CheckEmailLimit(userID, recipients.Count()); err != nil {
+		return emailLimitResponse(c, err)
+	}
+
+	var attachmentURLs []string
+	if draft.Attachments != "" {
+		if err := json.Unmarshal([]byte(draft.Attachments), &attachmentURLs); err != nil {
+			fmt.Println("Failed to read draft attachments", err)
+		}
+	}
+
+	payload := outboundPayload{
+		Message: pkg.Message{
+			From:        emailUser,
+			Recipients:  recipients,
+			Subject:     draft.Subject,
+			HTMLBody:    draft.Body,
+			Attachments: urlAttachments(attachmentURLs),
+		},
+		LinkAttachments: true,
+	}
+	_, err = enqueueDraft(userID, draft.ID, payload)
+	if err == errDraftNotFound {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+	}
+	if isSendQuotaError(err) {
+		return emailLimitResponse(c, err)
+	}
+	if err != nil {
+		fmt.Println("Failed to queue email", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to queue email"})
+	}
+	threadSentEmail(userID, draft.ID, payload.Message)
+
+	// Update last login
+	err = updateLastLogin(userID)
+	if err != nil {
+		fmt.Println("error updateLastLogin", err)
+	}
+
+	return queuedEmailResponse(c, draft.ID)
+}
+
+// enqueueDraft turns a draft into a queued sent email in one transaction,
+// like enqueueEmail does for a new row.
+func enqueueDraft(userID, draftID int64, payload outboundPayload) (string, error) {
+	msg := &payload.Message
+	msg.MessageID = pkg.GenerateMessageID(msg.From)
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		return "", fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	// The draft may have been sent or discarded from another tab meanwhile
+	result, err := tx.Exec(`
+		UPDATE emails
+		SET email_type = "sent", status = ?, sender_email = ?, sender_name = ?,
+			to_addresses = ?, cc_addresses = ?, bcc_addresses = ?,
+			header_message_id = ?, timestamp = NOW(), updated_at = NOW(), updated_by = ?
+		WHERE id = ? AND user_id = ? AND email_type = "draft"`,
+		OutboundStatusQueued, msg.From, strings.Split(msg.From, "@")[0],
+		strings.Join(msg.Recipients.To, ","), strings.Join(msg.Recipients.Cc, ","), strings.Join(msg.Recipients.Bcc, ","),
+		msg.MessageID, userID, draftID, userID)
+	if err != nil {
+		return "", fmt.Errorf("failed to save email: %v", err)
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return "", errDraftNotFound
+	}
+
+	if err := queueOutboundEmail(tx, draftID, userID, payload, nil); err != nil {
+		return "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return msg.MessageID, nil
+}
@@ -0,0 +1,46 @@
+package email
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDraftAddresses(t *testing.T) {
+	tests := []struct {
+		name   string
+		list   AddressList
+		want   string
+		wantTo []string // what parseRecipients reads back, nil when it fails
+	}{
+		{name: "empty", list: AddressList{" ", ""}, want: "", wantTo: nil},
+		{name: "plain", list: AddressList{"a@example.com", " b@example.com "}, want: "a@example.com, b@example.com", wantTo: []string{"a@example.com", "b@example.com"}},
+		{name: "comma separated entry", list: AddressList{"a@example.com,b@example.com"}, want: "a@example.com, b@example.com", wantTo: []string{"a@example.com", "b@example.com"}},
+		{name: "name with comma", list: AddressList{`"Doe, John" <j@example.com>`, "b@example.com"}, want: `"Doe, John" <j@example.com>, b@example.com`, wantTo: []string{"j@example.com", "b@example.com"}},
+		{name: "name with quote", list: AddressList{`"Jo \"JJ\" Doe" <j@example.com>`}, want: `"Jo \"JJ\" Doe" <j@example.com>`, wantTo: []string{"j@example.com"}},
+		{name: "non-ASCII name", list: AddressList{"José <j@example.com>"}, want: `"José" <j@example.com>`, wantTo: []string{"j@example.com"}},
+		{name: "half typed", list: AddressList{"a@example.com", "bob@"}, want: "a@example.com, bob@", wantTo: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := draftAddresses(tt.list)
+			if got != tt.want {
+				t.Errorf("draftAddresses(%q) = %q, want %q", tt.list, got, tt.want)
+			}
+
+			recipients, err := parseRecipients([]string{got}, nil, nil)
+			if tt.wantTo == nil {
+				if err == nil {
+					t.Errorf("parseRecipients(%q) returned no error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseRecipients(%q) returned %v", got, err)
+			}
+			if !reflect.DeepEqual(recipients.To, tt.wantTo) {
+				t.Errorf("parseRecipients(%q).To = %q, want %q", got, recipients.To, tt.wantTo)
+			}
+		})
+	}
+}
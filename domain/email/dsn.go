@@ -0,0 +1,202 @@
+package email
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strings"
+
+	"github.com/Triaksa-Space/be-mail-platform/config"
+	"github.com/Triaksa-Space/be-mail-platform/utils"
+	"github.com/jhillyerd/enmime"
+	"github.com/jhillyerd/enmime/dsn"
+	"github.com/labstack/echo/v4"
+)
+
+// dsnReport is what an RFC 3464 bounce message says about the email it
+// bounces.
+type dsnReport struct {
+	// Message-ID of the original email, from the copy the report returns
+	OriginalMessageID string
+	Failures          []DeliveryFailure
+}
+
+// parseDSN reads the delivery status of a multipart/report bounce message.
+// It returns nil when the email is no DSN or reports no failed recipient,
+// delayed and relayed notices only say the email is on its way.
+func parseDSN(env *enmime.Envelope) (*dsnReport, error) {
+	if env.Root == nil {
+		return nil, nil
+	}
+	reportPart := env.Root.BreadthMatchFirst(func(p *enmime.Part) bool {
+		return p.ContentType == "multipart/report"
+	})
+	if reportPart == nil {
+		return nil, nil
+	}
+
+	report, err := dsn.ParseReport(reportPart)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse delivery status: %v", err)
+	}
+
+	var result dsnReport
+	for _, fields := range report.DeliveryStatus.RecipientDSNs {
+		if !dsn.IsFailed(fields) {
+			continue
+		}
+
+		// Some MTAs comment the code, e.g. "5.0.0 (permanent failure)"
+		status := fields.Get("Status")
+		if parts := strings.Fields(status); len(parts) > 0 {
+			status = parts[0]
+		}
+
+		recipient := dsnFieldValue(fields.Get("Final-Recipient"))
+		if recipient == "" {
+			recipient = dsnFieldValue(fields.Get("Original-Recipient"))
+		}
+		result.Failures = append(result.Failures, DeliveryFailure{
+			Recipient:  strings.ToLower(strings.Trim(recipient, "<>")),
+			Status:     status,
+			Diagnostic: dsnFieldValue(fields.Get("Diagnostic-Code")),
+			Source:     DeliveryFailureSourceDSN,
+		})
+	}
+	if len(result.Failures) == 0 {
+		return nil, nil
+	}
+
+	// The original comes back whole or as text/rfc822-headers
+	original := report.OriginalMessage
+	if original == nil {
+		headersPart := reportPart.BreadthMatchFirst(func(p *enmime.Part) bool {
+			return p.ContentType == "text/rfc822-headers"
+		})
+		if headersPart != nil {
+			original = headersPart.Content
+		}
+	}
+	if original != nil {
+		// A blank line ends headers that come without a body
+		content := append(append([]byte{}, original...), "\r\n\r\n"...)
+		if msg, err := mail.ReadMessage(bytes.NewReader(content)); err == nil {
+			if ids := parseMessageIDs(msg.Header.Get("Message-Id")); len(ids) > 0 {
+				result.OriginalMessageID = ids[0]
+			}
+		}
+	}
+
+	return &result, nil
+}
+
+// dsnFieldValue drops the type of a typed DSN field, e.g. "rfc822;" or
+// "smtp;".
+func dsnFieldValue(value string) string {
+	if i := strings.Index(value, ";"); i >= 0 {
+		value = value[i+1:]
+	}
+	return strings.TrimSpace(value)
+}
+
+// recordBounceMessage marks the sent email a DSN bounce message received by
+// userID is about as bounced. The bounce itself stays in the inbox; failing
+// to link it only costs the delivery state, so errors are logged. Anyone can
+// send a DSN, so only recipients of the matched email are recorded and
+// nothing is suppressed, that is left to the feedback of the transport.
+func recordBounceMessage(userID int64, env *enmime.Envelope) {
+	report, err := parseDSN(env)
+	if err != nil {
+		fmt.Println("Failed to read bounce message", err)
+		return
+	}
+	if report == nil {
+		return
+	}
+
+	emailID, err := findSentEmailByMessageID(userID, report.OriginalMessageID)
+	if err != nil {
+		fmt.Println("Failed to find bounced email", err)
+		return
+	}
+	if emailID == 0 {
+		fmt.Println("No sent email for bounce message", env.GetHeader("Message-Id"))
+		return
+	}
+
+	recipients, err := sentEmailRecipients(emailID)
+	if err != nil {
+		fmt.Println("Failed to fetch recipients of bounced email", err)
+		return
+	}
+	var failures []DeliveryFailure
+	for _, failure := range report.Failures {
+		if !recipients[failure.Recipient] {
+			fmt.Println("Ignoring bounce of", failure.Recipient, "who is not a recipient of email", emailID)
+			continue
+		}
+		failures = append(failures, failure)
+	}
+	if len(failures) == 0 {
+		return
+	}
+
+	if err := recordDeliveryFailures(emailID, failures); err != nil {
+		fmt.Println("Failed to record delivery failures", err)
+	}
+
+	err = updateSentEmailFeedback(emailID, DeliveryStatusBounced, "Bounced: "+deliveryFailureSummary(failures))
+	if err != nil {
+		fmt.Println("Failed to mark email as bounced", err)
+	}
+}
+
+// findSentEmailByMessageID returns the sent email of userID with the given
+// Message-ID, 0 when there is none.
+func findSentEmailByMessageID(userID int64, messageID string) (int64, error) {
+	if messageID == "" {
+		return 0, nil
+	}
+
+	var emailID int64
+	err := config.DB.Get(&emailID, `
+		SELECT id FROM emails
+		WHERE user_id = ? AND email_type = "sent" AND header_message_id = ?
+		ORDER BY id DESC
+		LIMIT 1`, userID, messageID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to find sent email: %v", err)
+	}
+	return emailID, nil
+}
+
+// ListDeliveryFailuresHandler lists the recipients a sent email of the
+// current user bounced for.
+func ListDeliveryFailuresHandler(c echo.Context) error {
+	userID := c.Get("user_id").(int64)
+
+	emailID, err := utils.DecodeID(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid email ID"})
+	}
+
+	var failures []DeliveryFailure
+	err = config.DB.Select(&failures, `
+		SELECT f.recipient, COALESCE(f.status, '') AS status, COALESCE(f.diagnostic, '') AS diagnostic,
+			f.source, f.created_at
+		FROM delivery_failures f
+		JOIN emails e ON e.id = f.email_id
+		WHERE e.id = ? AND e.user_id = ? AND e.email_type = "sent"
+		ORDER BY f.id ASC`, emailID, userID)
+	if err != nil {
+		fmt.Println("Failed to fetch delivery failures", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch delivery failures"})
+	}
+
+	return c.JSON(http.StatusOK, failures)
+}
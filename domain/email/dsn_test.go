@@ -0,0 +1,200 @@
+package email
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// buildDSN returns a multipart/report bounce message. original is the
+// returned message/rfc822 or text/rfc822-headers part, with its headers.
+func buildDSN(perRecipient, original string, extraHeaders ...string) string {
+	lines := []string{
+		"From: Mail Delivery Subsystem <mailer-daemon@mx.example.net>",
+		"To: alice@example.com",
+		"Subject: Undelivered Mail Returned to Sender",
+		"Message-ID: <bounce-1@mx.example.net>",
+	}
+	lines = append(lines, extraHeaders...)
+	lines = append(lines,
+		"MIME-Version: 1.0",
+		`Content-Type: multipart/report; report-type=delivery-status; boundary="BOUNDARY"`,
+		"",
+		"--BOUNDARY",
+		"Content-Type: text/plain; charset=us-ascii",
+		"",
+		"Your message could not be delivered.",
+		"",
+		"--BOUNDARY",
+		"Content-Type: message/delivery-status",
+		"",
+		"Reporting-MTA: dns; mx.example.net",
+		"Arrival-Date: Mon, 2 Dec 2024 10:00:00 +0000",
+		"",
+		perRecipient,
+		"",
+		"--BOUNDARY",
+		original,
+		"",
+		"--BOUNDARY--",
+		"",
+	)
+	return strings.Join(lines, "\r\n")
+}
+
+const originalMessagePart = "Content-Type: message/rfc822\r\n" +
+	"\r\n" +
+	"From: alice@example.com\r\n" +
+	"To: bob@example.org\r\n" +
+	"Subject: Lunch\r\n" +
+	"Message-ID: <original-1@example.com>\r\n" +
+	"\r\n" +
+	"See you there"
+
+const originalHeadersPart = "Content-Type: text/rfc822-headers\r\n" +
+	"\r\n" +
+	"From: alice@example.com\r\n" +
+	"To: bob@example.org\r\n" +
+	"Subject: Lunch\r\n" +
+	"Message-ID: <original-2@example.com>"
+
+func TestParseDSN(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want *dsnReport
+	}{
+		{
+			name: "failed recipient with the original message",
+			raw: buildDSN(
+				"Final-Recipient: rfc822; Bob@Example.org\r\n"+
+					"Action: failed\r\n"+
+					"Status: 5.1.1\r\n"+
+					"Diagnostic-Code: smtp; 550 5.1.1 user unknown",
+				originalMessagePart),
+			want: &dsnReport{
+				OriginalMessageID: "original-1@example.com",
+				Failures: []DeliveryFailure{{
+					Recipient:  "bob@example.org",
+					Status:     "5.1.1",
+					Diagnostic: "550 5.1.1 user unknown",
+					Source:     DeliveryFailureSourceDSN,
+				}},
+			},
+		},
+		{
+			name: "original headers only",
+			raw: buildDSN(
+				"Final-Recipient: rfc822; bob@example.org\r\n"+
+					"Action: failed\r\n"+
+					"Status: 5.2.2 (mailbox full)",
+				originalHeadersPart),
+			want: &dsnReport{
+				OriginalMessageID: "original-2@example.com",
+				Failures: []DeliveryFailure{{
+					Recipient: "bob@example.org",
+					Status:    "5.2.2",
+					Source:    DeliveryFailureSourceDSN,
+				}},
+			},
+		},
+		{
+			name: "references are not used to match the original",
+			raw: buildDSN(
+				"Original-Recipient: rfc822; <bob@example.org>\r\n"+
+					"Action: failed\r\n"+
+					"Status: 4.4.7",
+				"Content-Type: text/plain\r\n\r\nNo copy of the original",
+				"In-Reply-To: <other@example.com>", "References: <other@example.com>"),
+			want: &dsnReport{
+				Failures: []DeliveryFailure{{
+					Recipient: "bob@example.org",
+					Status:    "4.4.7",
+					Source:    DeliveryFailureSourceDSN,
+				}},
+			},
+		},
+		{
+			name: "several recipients, only failures kept",
+			raw: buildDSN(
+				"Final-Recipient: rfc822; bob@example.org\r\n"+
+					"Action: delivered\r\n"+
+					"Status: 2.0.0\r\n"+
+					"\r\n"+
+					"Final-Recipient: rfc822; carol@example.org\r\n"+
+					"Action: failed\r\n"+
+					"Status: 5.7.1\r\n"+
+					"Diagnostic-Code: smtp; 550 5.7.1 rejected",
+				originalMessagePart),
+			want: &dsnReport{
+				OriginalMessageID: "original-1@example.com",
+				Failures: []DeliveryFailure{{
+					Recipient:  "carol@example.org",
+					Status:     "5.7.1",
+					Diagnostic: "550 5.7.1 rejected",
+					Source:     DeliveryFailureSourceDSN,
+				}},
+			},
+		},
+		{
+			name: "delayed only",
+			raw: buildDSN(
+				"Final-Recipient: rfc822; bob@example.org\r\n"+
+					"Action: delayed\r\n"+
+					"Status: 4.4.1",
+				originalMessagePart),
+			want: nil,
+		},
+		{
+			name: "not a report",
+			raw: "From: bob@example.org\r\n" +
+				"To: alice@example.com\r\n" +
+				"Subject: Re: Lunch\r\n" +
+				"References: <original-1@example.com>\r\n" +
+				"\r\n" +
+				"Sure\r\n",
+			want: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env, err := enmime.ReadEnvelope(strings.NewReader(tt.raw))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := parseDSN(env)
+			if err != nil {
+				t.Fatalf("parseDSN() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseDSN() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDSNFieldValue(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{value: "rfc822; bob@example.org", want: "bob@example.org"},
+		{value: "rfc822;bob@example.org", want: "bob@example.org"},
+		{value: "smtp; 550 5.1.1 user unknown", want: "550 5.1.1 user unknown"},
+		{value: "smtp; 550 5.7.1 blocked; see https://example.net", want: "550 5.7.1 blocked; see https://example.net"},
+		{value: "  bob@example.org  ", want: "bob@example.org"},
+		{value: "", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			if got := dsnFieldValue(tt.value); got != tt.want {
+				t.Errorf("dsnFieldValue(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
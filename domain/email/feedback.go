@@ -0,0 +1,227 @@
+package email
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/Triaksa-Space/be-mail-platform/config"
+	"github.com/Triaksa-Space/be-mail-platform/pkg"
+)
+
+// Delivery states SES reports once a sent email has left the outbound
+// queue. They are only kept on the emails row.
+const (
+	DeliveryStatusDelivered  = "delivered"
+	DeliveryStatusBounced    = "bounced"
+	DeliveryStatusComplained = "complained"
+)
+
+// Where a delivery failure was reported.
+const (
+	DeliveryFailureSourceSES = "ses"
+	DeliveryFailureSourceDSN = "dsn"
+)
+
+// handleSESFeedbackNotification records SES Bounce, Complaint and Delivery
+// notifications on the sent email they are about, and bounced recipients in
+// delivery_failures. Hard bounces and complaints put the recipients on the
+// suppression list. Only recipients of the matched email are taken into
+// account, a notification about anything else changes nothing.
+func handleSESFeedbackNotification(notification pkg.SESNotification) error {
+	emailID, err := findSentEmailBySESID(notification.Mail.MessageID)
+	if err != nil {
+		return err
+	}
+	if emailID == 0 {
+		// Mail sent before the feedback was wired up, or by another system on
+		// the same SES account
+		fmt.Println("No sent email for SES message", notification.Mail.MessageID)
+		return nil
+	}
+
+	recipients, err := sentEmailRecipients(emailID)
+	if err != nil {
+		return err
+	}
+
+	switch notification.Type() {
+	case "Bounce":
+		bounce := notification.Bounce
+		permanent := bounce.BounceType == "Permanent"
+
+		var failures []DeliveryFailure
+		for _, recipient := range bounce.BouncedRecipients {
+			if !recipients[strings.ToLower(strings.TrimSpace(recipient.EmailAddress))] {
+				fmt.Println("Ignoring bounce of", recipient.EmailAddress, "who is not a recipient of email", emailID)
+				continue
+			}
+			failures = append(failures, DeliveryFailure{
+				Recipient:  strings.ToLower(recipient.EmailAddress),
+				Status:     recipient.Status,
+				Diagnostic: dsnFieldValue(recipient.DiagnosticCode),
+				Source:     DeliveryFailureSourceSES,
+			})
+
+			// Transient bounces may go through next time
+			if permanent {
+				detail := recipient.DiagnosticCode
+				if detail == "" {
+					detail = recipient.Status
+				}
+				if err := suppressRecipient(recipient.EmailAddress, SuppressionReasonBounce, detail, emailID); err != nil {
+					return err
+				}
+			}
+		}
+
+		if len(failures) == 0 {
+			return nil
+		}
+		if err := recordDeliveryFailures(emailID, failures); err != nil {
+			return err
+		}
+
+		lastError := fmt.Sprintf("%s bounce (%s): %s", bounce.BounceType, bounce.BounceSubType, deliveryFailureSummary(failures))
+		return updateSentEmailFeedback(emailID, DeliveryStatusBounced, lastError)
+	case "Complaint":
+		complaint := notification.Complaint
+
+		var addresses []string
+		for _, recipient := range complaint.ComplainedRecipients {
+			if !recipients[strings.ToLower(strings.TrimSpace(recipient.EmailAddress))] {
+				fmt.Println("Ignoring complaint of", recipient.EmailAddress, "who is not a recipient of email", emailID)
+				continue
+			}
+			addresses = append(addresses, recipient.EmailAddress)
+			if err := suppressRecipient(recipient.EmailAddress, SuppressionReasonComplaint, complaint.ComplaintFeedbackType, emailID); err != nil {
+				return err
+			}
+		}
+		if len(addresses) == 0 {
+			return nil
+		}
+
+		lastError := "Marked as spam by " + strings.Join(addresses, ", ")
+		if complaint.ComplaintFeedbackType != "" {
+			lastError += " (" + complaint.ComplaintFeedbackType + ")"
+		}
+		return updateSentEmailFeedback(emailID, DeliveryStatusComplained, lastError)
+	case "Delivery":
+		return updateSentEmailFeedback(emailID, DeliveryStatusDelivered, "")
+	}
+	return nil
+}
+
+// recordDeliveryFailures keeps the failed recipients of a sent email. A
+// redelivered report updates the rows it wrote before.
+func recordDeliveryFailures(emailID int64, failures []DeliveryFailure) error {
+	if emailID == 0 {
+		return nil
+	}
+
+	for _, failure := range failures {
+		if failure.Recipient == "" {
+			continue
+		}
+		_, err := config.DB.Exec(`
+			INSERT INTO delivery_failures (email_id, recipient, status, diagnostic, source, created_at, updated_at)
+			VALUES (?, ?, ?, ?, ?, NOW(), NOW())
+			ON DUPLICATE KEY UPDATE status = VALUES(status), diagnostic = VALUES(diagnostic), updated_at = NOW()`,
+			emailID, failure.Recipient, failure.Status, failure.Diagnostic, failure.Source)
+		if err != nil {
+			return fmt.Errorf("failed to record delivery failure of email %d: %v", emailID, err)
+		}
+	}
+	return nil
+}
+
+// deliveryFailureSummary lists the failures for emails.last_error, e.g.
+// "bob@example.com: 550 5.1.1 user unknown".
+func deliveryFailureSummary(failures []DeliveryFailure) string {
+	var summary []string
+	for _, failure := range failures {
+		detail := failure.Diagnostic
+		if detail == "" {
+			detail = failure.Status
+		}
+		summary = append(summary, fmt.Sprintf("%s: %s", failure.Recipient, detail))
+	}
+	return strings.Join(summary, "; ")
+}
+
+// findSentEmailBySESID returns the sent email SES knows by messageID, 0 when
+// there is none.
+func findSentEmailBySESID(messageID string) (int64, error) {
+	if messageID == "" {
+		return 0, nil
+	}
+
+	var emailID int64
+	err := config.DB.Get(&emailID, `
+		SELECT id FROM emails
+		WHERE ses_message_id = ? AND email_type = "sent"
+		ORDER BY id DESC
+		LIMIT 1`, messageID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to find sent email for SES message %s: %v", messageID, err)
+	}
+	return emailID, nil
+}
+
+// sentEmailRecipients returns the lowercased To, Cc and Bcc addresses of a
+// sent email.
+func sentEmailRecipients(emailID int64) (map[string]bool, error) {
+	var email struct {
+		To  string `db:"to_addresses"`
+		Cc  string `db:"cc_addresses"`
+		Bcc string `db:"bcc_addresses"`
+	}
+	err := config.DB.Get(&email, `
+		SELECT COALESCE(to_addresses, '') AS to_addresses,
+			COALESCE(cc_addresses, '') AS cc_addresses,
+			COALESCE(bcc_addresses, '') AS bcc_addresses
+		FROM emails WHERE id = ?`, emailID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch recipients of email %d: %v", emailID, err)
+	}
+
+	recipients := map[string]bool{}
+	for _, addresses := range []string{email.To, email.Cc, email.Bcc} {
+		for _, address := range pkg.SplitAddresses(addresses) {
+			recipients[strings.ToLower(address)] = true
+		}
+	}
+	return recipients, nil
+}
+
+// updateSentEmailFeedback sets the delivery status SES reported. A delivery
+// to some recipients does not hide a bounce or complaint from another, and
+// nothing overrides a complaint.
+func updateSentEmailFeedback(emailID int64, status, lastError string) error {
+	if emailID == 0 {
+		return nil
+	}
+
+	query := "UPDATE emails SET status = ?, last_error = ? WHERE id = ?"
+	switch status {
+	case DeliveryStatusDelivered:
+		query += " AND (status IS NULL OR status NOT IN ('bounced', 'complained'))"
+	case DeliveryStatusBounced:
+		query += " AND (status IS NULL OR status <> 'complained')"
+	}
+
+	var errorValue interface{}
+	if lastError != "" {
+		errorValue = lastError
+	}
+
+	_, err := config.DB.Exec(query, status, errorValue, emailID)
+	if err != nil {
+		return fmt.Errorf("failed to update delivery status of email %d: %v", emailID, err)
+	}
+	return nil
+}
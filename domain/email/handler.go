@@ -2,20 +2,22 @@ package email
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"html"
 	"io"
-	"log"
+	"mime/multipart"
 	"net/http"
 	"net/url"
 	"path"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 	"unicode"
+	"unicode/utf8"
 
 	"github.com/Triaksa-Space/be-mail-platform/config"
 	"github.com/Triaksa-Space/be-mail-platform/domain/user"
@@ -36,46 +38,90 @@ type EmailService struct {
 }
 
 func DeductEmailLimit(userID int64) error {
-	// Increment counter
-	_, err := config.DB.Exec(`UPDATE users SET sent_emails = sent_emails - 1, last_login = NOW() WHERE id = ?`, userID)
+	_, err := config.DB.Exec(`
+		UPDATE user_send_usage
+		SET sent_count = GREATEST(sent_count - 1, 0)
+		WHERE user_id = ? AND usage_date = ?`, userID, time.Now().UTC().Format("2006-01-02"))
+	if err != nil {
+		return err
+	}
+
+	_, err = config.DB.Exec(`UPDATE users SET sent_emails = GREATEST(sent_emails - 1, 0), last_login = NOW() WHERE id = ?`, userID)
 	return err
 }
 
-func CheckEmailLimit(userID int64) error {
-	var user user.User
-	err := config.DB.Get(&user, `
-        SELECT sent_emails, last_email_time 
-        FROM users 
-        WHERE id = ?`, userID)
+// CheckEmailLimit checks the plan of the user before a message is sent to
+// the given number of recipients.
+func CheckEmailLimit(userID int64, recipients int) error {
+	emailUser, err := getUserEmail(userID)
 	if err != nil {
 		return err
 	}
 
-	if user.SentEmails >= 3 {
-		return errors.New("daily email limit exceeded (3 emails per 24 hours)")
+	quota, err := user.GetSendQuota(userID, emailUser)
+	if err != nil {
+		return err
 	}
 
-	if user.SentEmails == 0 {
-		// first time sent email
-		_, err := config.DB.Exec(`
-            UPDATE users 
-            SET sent_emails = 0, 
-                last_email_time = NOW() 
-            WHERE id = ?`, userID)
+	return quota.CheckSend(recipients)
+}
+
+func checkAttachmentLimit(userID int64, files []*multipart.FileHeader) error {
+	var totalBytes int64
+	for _, file := range files {
+		totalBytes += file.Size
+	}
+	return checkAttachmentBytes(userID, totalBytes)
+}
+
+// checkAttachmentBytes checks the total size of the attachments of a message
+// against the plan of the user.
+func checkAttachmentBytes(userID int64, totalBytes int64) error {
+	if totalBytes == 0 {
+		return nil
+	}
+
+	emailUser, err := getUserEmail(userID)
+	if err != nil {
 		return err
 	}
 
-	// Reset counter if 24h passed
-	if time.Since(*user.LastEmailTime) > 24*time.Hour {
-		_, err := config.DB.Exec(`
-            UPDATE users 
-            SET sent_emails = 0, 
-                last_email_time = NOW() 
-            WHERE id = ?`, userID)
+	quota, err := user.GetSendQuota(userID, emailUser)
+	if err != nil {
 		return err
 	}
 
-	return err
+	return quota.CheckAttachments(totalBytes)
+}
+
+// isSendQuotaError reports whether the daily or monthly limit stopped a
+// send, so that queueing answers 429 instead of 500.
+func isSendQuotaError(err error) bool {
+	return err == user.ErrDailyLimitExceeded || err == user.ErrMonthlyLimitExceeded
+}
+
+// emailLimitResponse answers 429 when the send quota is used up, 400 or 413
+// when the message itself is not allowed by the plan, and 500 otherwise.
+func emailLimitResponse(c echo.Context, err error) error {
+	switch err {
+	case user.ErrDailyLimitExceeded, user.ErrMonthlyLimitExceeded:
+		return c.JSON(http.StatusTooManyRequests, map[string]string{
+			"error": "Email limit exceeded",
+		})
+	case user.ErrTooManyRecipients:
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": err.Error(),
+		})
+	case user.ErrAttachmentLimitExceeded:
+		return c.JSON(http.StatusRequestEntityTooLarge, map[string]string{
+			"error": err.Error(),
+		})
+	}
+
+	fmt.Println("Failed to check email limit", err)
+	return c.JSON(http.StatusInternalServerError, map[string]string{
+		"error": "Failed to check email limit",
+	})
 }
 
 // DeleteUrlAttachmentHandler handles deleting an attachment from AWS S3 based on a provided URL
@@ -132,7 +178,8 @@ func DeleteUrlAttachmentHandler(c echo.Context) error {
 	})
 }
 
-// SendEmailUrlAttachmentHandler handles sending emails with attachment URLs
+// SendEmailUrlAttachmentHandler handles sending emails with attachment URLs.
+// It serves the JSON requests of /send, see SendEmailHandler.
 func SendEmailUrlAttachmentHandler(c echo.Context) error {
 	// Get user ID and email from context
 	userID := c.Get("user_id").(int64)
@@ -144,13 +191,6 @@ func SendEmailUrlAttachmentHandler(c echo.Context) error {
 		})
 	}
 
-	// Check email limit
-	if err := CheckEmailLimit(userID); err != nil {
-		return c.JSON(http.StatusTooManyRequests, map[string]string{
-			"error": "Email limit exceeded",
-		})
-	}
-
 	// Parse JSON payload
 	var req SendEmailRequestURLAttachment
 	if err := c.Bind(&req); err != nil {
@@ -159,77 +199,64 @@ func SendEmailUrlAttachmentHandler(c echo.Context) error {
 		})
 	}
 
-	// Prepare attachments
-	var attachments []pkg.Attachment
-	for _, url := range req.Attachments {
-		// Extract filename from URL
-		parts := strings.Split(url, "/")
-		filename := parts[len(parts)-1]
-
-		attachments = append(attachments, pkg.Attachment{
-			Filename:    filename,
-			ContentType: "application/octet-stream", // Default content type
-			Content:     nil,                        // Content is not needed for URL attachments
-			URL:         url,
+	recipients, err := parseRecipients(req.To, req.Cc, req.Bcc)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": err.Error(),
 		})
 	}
 
-	// Send email via pkg/aws
-	err = pkg.SendEmailWithAttachmentURL(req.To, emailUser, req.Subject, req.Body, attachments)
-	if err != nil {
-		fmt.Println("Failed to send email", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{
+	if err := checkAttachmentURLs(req.Attachments); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
 			"error": err.Error(),
 		})
 	}
 
-	// Save email to database
-	tx, err := config.DB.Begin()
+	if err := checkSuppressedRecipients(recipients); err != nil {
+		return suppressionResponse(c, err)
+	}
+
+	sendAt, err := parseSendAt(req.SendAt)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error": "Failed to start transaction",
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": err.Error(),
 		})
 	}
-	defer tx.Rollback()
 
+	// Check email limit, every recipient counts
+	if err := checkSendLimit(userID, recipients.Count(), sendAt != nil); err != nil {
+		return emailLimitResponse(c, err)
+	}
+
+	// Save the email and queue it for delivery
 	attachmentsJSON, _ := json.Marshal(req.Attachments)
 
-	var preview string
-	length := 25
-	if len(req.Body) > length {
-		preview = req.Body[:length]
+	preview := generatePreview(req.TextBody, req.Body)
+	payload := outboundPayload{
+		Message: pkg.Message{
+			From:        emailUser,
+			Recipients:  recipients,
+			Subject:     req.Subject,
+			HTMLBody:    req.Body,
+			TextBody:    req.TextBody,
+			Attachments: urlAttachments(req.Attachments),
+		},
+		LinkAttachments: true,
+	}
+	emailID, _, err := enqueueEmail(userID, payload, preview, attachmentsJSON, sendAt)
+	if isSendQuotaError(err) {
+		return emailLimitResponse(c, err)
 	}
-	originalUsername := strings.Split(emailUser, "@")[0]
-	_, err = tx.Exec(`
-        INSERT INTO emails (
-            user_id,
-            email_type,
-            preview,
-            sender_email,
-            sender_name,
-            subject,
-            body,
-            attachments,
-            timestamp,
-            created_at,
-            updated_at,
-            created_by,
-            updated_by
-        ) 
-        VALUES (?, "sent", ?, ?, ?, ?, ?, ?, NOW(), NOW(), NOW(), ?, ?)`,
-		userID, preview, emailUser, originalUsername, req.Subject, req.Body, attachmentsJSON, userID, userID)
 	if err != nil {
-		fmt.Println("Email sent but Failed to save into DB email", err)
+		fmt.Println("Failed to queue email", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error": "Email sent but Failed to save into DB email",
+			"error": "Failed to queue email",
 		})
 	}
-
-	if err := tx.Commit(); err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error": "Failed to commit transaction",
-		})
+	if sendAt != nil {
+		return scheduledEmailResponse(c, emailID, *sendAt)
 	}
+	threadSentEmail(userID, emailID, payload.Message)
 
 	// Update last login
 	err = updateLastLogin(userID)
@@ -237,160 +264,47 @@ func SendEmailUrlAttachmentHandler(c echo.Context) error {
 		fmt.Println("error updateLastLogin", err)
 	}
 
-	// Update limit if sent Email success
-	err = updateLimitSentEmails(userID)
-	if err != nil {
-		fmt.Println("error updateLimitSentEmails", err)
-	}
-
-	return c.JSON(http.StatusOK, map[string]string{
-		"message": "Email sent successfully",
-	})
+	return queuedEmailResponse(c, emailID)
 }
 
-// SendEmailHandler handles sending emails with attachments
-func SendEmailHandler(c echo.Context) error {
-	// Get user ID and email from context
-	userID := c.Get("user_id").(int64)
-
-	emailUser, err := getUserEmail(userID)
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error": "Failed to fetch user email",
-		})
-	}
-
-	// Check email limit
-	if err := CheckEmailLimit(userID); err != nil {
-		return c.JSON(http.StatusTooManyRequests, map[string]string{
-			"error": "Email limit exceeded",
-		})
+// checkAttachmentURLs rejects attachment URLs that do not point at a file
+// uploaded by UploadAttachmentHandler, as they are fetched with the
+// credentials of the service when the email is forwarded or opened over IMAP.
+func checkAttachmentURLs(urls []string) error {
+	for _, attachmentURL := range urls {
+		if _, err := pkg.AttachmentObjectKey(attachmentURL); err != nil {
+			return fmt.Errorf("Invalid attachment URL: %s", attachmentURL)
+		}
 	}
+	return nil
+}
 
-	// Parse form data
-	to := c.FormValue("to")
-	subject := c.FormValue("subject")
-	body := c.FormValue("body")
-
-	// Prepare attachments and upload to S3
+// urlAttachments turns uploaded attachment URLs into attachments that are
+// sent as download links.
+func urlAttachments(urls []string) []pkg.Attachment {
 	var attachments []pkg.Attachment
-	var attachmentURLs []string
-
-	form, err := c.MultipartForm()
-	if err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{
-			"error": "Invalid form data",
-		})
-	}
-
-	files := form.File["attachments"]
-	for _, file := range files {
-		src, err := file.Open()
-		if err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]string{
-				"error": "Failed to open attachment",
-			})
-		}
-		defer src.Close()
-
-		content, err := io.ReadAll(src)
-		if err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]string{
-				"error": "Failed to read attachment",
-			})
-		}
-
-		// Convert filename to lowercase and replace spaces with underscores
-		filename := strings.ToLower(file.Filename)
-		filename = strings.ReplaceAll(filename, " ", "_")
-
-		// Append the attachment URL to the list
-		attachmentURLs = append(attachmentURLs, filename)
+	for _, url := range urls {
+		// Extract filename from URL
+		parts := strings.Split(url, "/")
+		filename := parts[len(parts)-1]
 
-		// Prepare the attachment for sending email
 		attachments = append(attachments, pkg.Attachment{
 			Filename:    filename,
-			ContentType: file.Header.Get("Content-Type"),
-			Content:     content,
-		})
-	}
-
-	// Send email via pkg/aws
-	err = pkg.SendEmail(to, emailUser, subject, body, attachments)
-	if err != nil {
-		fmt.Println("Failed to send email", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error": err.Error(),
-		})
-	}
-
-	// Save email to database
-	tx, err := config.DB.Begin()
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error": "Failed to start transaction",
-		})
-	}
-	defer tx.Rollback()
-
-	attachmentsJSON, _ := json.Marshal(attachmentURLs)
-
-	var preview string
-	length := 25
-	if len(body) > length {
-		preview = body[:length]
-	}
-	originalUsername := strings.Split(emailUser, "@")[0]
-	_, err = tx.Exec(`
-        INSERT INTO emails (
-            user_id,
-            email_type,
-            preview,
-            sender_email,
-            sender_name,
-            subject,
-            body,
-            attachments,
-            timestamp,
-            created_at,
-            updated_at,
-            created_by,
-            updated_by
-        ) 
-        VALUES (?, "sent", ?, ?, ?, ?, ?, ?, NOW(), NOW(), NOW(), ?, ?)`,
-		userID, preview, emailUser, originalUsername, subject, body, attachmentsJSON, userID, userID)
-	if err != nil {
-		fmt.Println("Email sent but Failed to save into DB email", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error": "Email sent but Failed to save into DB email",
-		})
-	}
-
-	if err := tx.Commit(); err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error": "Failed to commit transaction",
+			ContentType: "application/octet-stream", // Default content type
+			Content:     nil,                        // Content is not needed for URL attachments
+			URL:         url,
 		})
 	}
+	return attachments
+}
 
-	// Update last login
-	err = updateLastLogin(userID)
-	if err != nil {
-		fmt.Println("error updateLastLogin", err)
-	}
-
-	// Update limit if sent Email success
-	err = updateLimitSentEmails(userID)
-	if err != nil {
-		fmt.Println("error updateLimitSentEmails", err)
+// SendEmailHandler handles sending emails with attachments through the
+// configured transport. JSON requests carry attachment URLs instead of files.
+func SendEmailHandler(c echo.Context) error {
+	if strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEApplicationJSON) {
+		return SendEmailUrlAttachmentHandler(c)
 	}
 
-	return c.JSON(http.StatusOK, map[string]string{
-		"message": "Email sent successfully",
-	})
-}
-
-func SendEmailSMTPHHandler(c echo.Context) error {
-	fmt.Println("TEST HARAKA")
 	// Get user ID and email from context
 	userID := c.Get("user_id").(int64)
 
@@ -401,159 +315,33 @@ func SendEmailSMTPHHandler(c echo.Context) error {
 		})
 	}
 
-	// Check email limit
-	if err := CheckEmailLimit(userID); err != nil {
-		return c.JSON(http.StatusTooManyRequests, map[string]string{
-			"error": "Email limit exceeded",
-		})
-	}
-
 	// Parse form data
-	to := c.FormValue("to")
 	subject := c.FormValue("subject")
 	body := c.FormValue("body")
 
-	// Prepare attachments and upload to S3
-	var attachments []pkg.Attachment
-	var attachmentURLs []string
-
-	form, err := c.MultipartForm()
+	recipients, err := formRecipients(c)
 	if err != nil {
 		return c.JSON(http.StatusBadRequest, map[string]string{
-			"error": "Invalid form data",
-		})
-	}
-
-	files := form.File["attachments"]
-	for _, file := range files {
-		src, err := file.Open()
-		if err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]string{
-				"error": "Failed to open attachment",
-			})
-		}
-		defer src.Close()
-
-		content, err := io.ReadAll(src)
-		if err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]string{
-				"error": "Failed to read attachment",
-			})
-		}
-
-		// Convert filename to lowercase and replace spaces with underscores
-		filename := strings.ToLower(file.Filename)
-		filename = strings.ReplaceAll(filename, " ", "_")
-
-		// Append the attachment URL to the list
-		attachmentURLs = append(attachmentURLs, filename)
-
-		// Prepare the attachment for sending email
-		attachments = append(attachments, pkg.Attachment{
-			Filename:    filename,
-			ContentType: file.Header.Get("Content-Type"),
-			Content:     content,
-		})
-	}
-
-	// Send email via pkg/aws
-	err = pkg.SendEmailSMTP(emailUser, to, subject, body, attachments)
-	if err != nil {
-		fmt.Println("Failed to send email", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{
 			"error": err.Error(),
 		})
 	}
 
-	// Save email to database
-	tx, err := config.DB.Begin()
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error": "Failed to start transaction",
-		})
+	if err := checkSuppressedRecipients(recipients); err != nil {
+		return suppressionResponse(c, err)
 	}
-	defer tx.Rollback()
 
-	attachmentsJSON, _ := json.Marshal(attachmentURLs)
-
-	var preview string
-	length := 25
-	if len(body) > length {
-		preview = body[:length]
-	}
-	originalUsername := strings.Split(emailUser, "@")[0]
-	_, err = tx.Exec(`
-        INSERT INTO emails (
-            user_id,
-            email_type,
-            preview,
-            sender_email,
-            sender_name,
-            subject,
-            body,
-            attachments,
-            timestamp,
-            created_at,
-            updated_at,
-            created_by,
-            updated_by
-        ) 
-        VALUES (?, "sent", ?, ?, ?, ?, ?, ?, NOW(), NOW(), NOW(), ?, ?)`,
-		userID, preview, emailUser, originalUsername, subject, body, attachmentsJSON, userID, userID)
-	if err != nil {
-		fmt.Println("Email sent but Failed to save into DB email", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error": "Email sent but Failed to save into DB email",
-		})
-	}
-
-	if err := tx.Commit(); err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error": "Failed to commit transaction",
-		})
-	}
-
-	// Update last login
-	err = updateLastLogin(userID)
+	sendAt, err := parseSendAt(c.FormValue("send_at"))
 	if err != nil {
-		fmt.Println("error updateLastLogin", err)
-	}
-
-	// Update limit if sent Email success
-	err = updateLimitSentEmails(userID)
-	if err != nil {
-		fmt.Println("error updateLimitSentEmails", err)
-	}
-
-	return c.JSON(http.StatusOK, map[string]string{
-		"message": "Email sent successfully",
-	})
-}
-
-// SendEmailHandler handles sending emails with attachments
-func SendEmailSMTPHandler(c echo.Context) error {
-	// Get user ID and email from context
-	userID := c.Get("user_id").(int64)
-
-	emailUser, err := getUserEmail(userID)
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error": "Failed to fetch user email",
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": err.Error(),
 		})
 	}
 
-	// Check email limit
-	if err := CheckEmailLimit(userID); err != nil {
-		return c.JSON(http.StatusTooManyRequests, map[string]string{
-			"error": "Email limit exceeded",
-		})
+	// Check email limit, every recipient counts
+	if err := checkSendLimit(userID, recipients.Count(), sendAt != nil); err != nil {
+		return emailLimitResponse(c, err)
 	}
 
-	// Parse form data
-	to := c.FormValue("to")
-	subject := c.FormValue("subject")
-	body := c.FormValue("body")
-
 	// Prepare attachments and upload to S3
 	var attachments []pkg.Attachment
 	var attachmentURLs []string
@@ -566,6 +354,10 @@ func SendEmailSMTPHandler(c echo.Context) error {
 	}
 
 	files := form.File["attachments"]
+	if err := checkAttachmentLimit(userID, files); err != nil {
+		return emailLimitResponse(c, err)
+	}
+
 	for _, file := range files {
 		src, err := file.Open()
 		if err != nil {
@@ -597,62 +389,34 @@ func SendEmailSMTPHandler(c echo.Context) error {
 		})
 	}
 
-	// Send email via pkg/aws
-	err = pkg.SendEmailWithHARAKA(to, emailUser, subject, body, attachments)
-	if err != nil {
-		fmt.Println("Failed to send email", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error": err.Error(),
-		})
-	}
-
-	// Save email to database
-	tx, err := config.DB.Begin()
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error": "Failed to start transaction",
-		})
-	}
-	defer tx.Rollback()
-
+	// Save the email and queue it for delivery
 	attachmentsJSON, _ := json.Marshal(attachmentURLs)
 
-	var preview string
-	length := 25
-	if len(body) > length {
-		preview = body[:length]
+	preview := generatePreview(c.FormValue("text_body"), body)
+	payload := outboundPayload{
+		Message: pkg.Message{
+			From:        emailUser,
+			Recipients:  recipients,
+			Subject:     subject,
+			HTMLBody:    body,
+			TextBody:    c.FormValue("text_body"),
+			Attachments: attachments,
+		},
+	}
+	emailID, _, err := enqueueEmail(userID, payload, preview, attachmentsJSON, sendAt)
+	if isSendQuotaError(err) {
+		return emailLimitResponse(c, err)
 	}
-	originalUsername := strings.Split(emailUser, "@")[0]
-	_, err = tx.Exec(`
-        INSERT INTO emails (
-            user_id,
-            email_type,
-            preview,
-            sender_email,
-            sender_name,
-            subject,
-            body,
-            attachments,
-            timestamp,
-            created_at,
-            updated_at,
-            created_by,
-            updated_by
-        ) 
-        VALUES (?, "sent", ?, ?, ?, ?, ?, ?, NOW(), NOW(), NOW(), ?, ?)`,
-		userID, preview, emailUser, originalUsername, subject, body, attachmentsJSON, userID, userID)
 	if err != nil {
-		fmt.Println("Email sent but Failed to save into DB email", err)
+		fmt.Println("Failed to queue email", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error": "Email sent but Failed to save into DB email",
+			"error": "Failed to queue email",
 		})
 	}
-
-	if err := tx.Commit(); err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error": "Failed to commit transaction",
-		})
+	if sendAt != nil {
+		return scheduledEmailResponse(c, emailID, *sendAt)
 	}
+	threadSentEmail(userID, emailID, payload.Message)
 
 	// Update last login
 	err = updateLastLogin(userID)
@@ -660,14 +424,15 @@ func SendEmailSMTPHandler(c echo.Context) error {
 		fmt.Println("error updateLastLogin", err)
 	}
 
-	// Update limit if sent Email success
-	err = updateLimitSentEmails(userID)
-	if err != nil {
-		fmt.Println("error updateLimitSentEmails", err)
-	}
+	return queuedEmailResponse(c, emailID)
+}
 
-	return c.JSON(http.StatusOK, map[string]string{
-		"message": "Email sent successfully",
+// queuedEmailResponse answers 202 with the IDs of a queued email, its
+// delivery status is on the sent row.
+func queuedEmailResponse(c echo.Context, emailID int64) error {
+	return c.JSON(http.StatusAccepted, map[string]string{
+		"message":  "Email queued for delivery",
+		"email_id": utils.EncodeID(int(emailID)),
 	})
 }
 
@@ -825,6 +590,7 @@ func GetEmailHandler(c echo.Context) error {
 			preview,
 			message_id,
 			attachments,
+			COALESCE(label, '') AS label,
             timestamp, 
             created_at, 
             updated_at  FROM emails WHERE id = ? and user_id = ? and email_type = "inbox"`, emailID, user.ID)
@@ -840,6 +606,7 @@ func GetEmailHandler(c echo.Context) error {
 			preview,
 			message_id,
 			attachments,
+			COALESCE(label, '') AS label,
             timestamp, 
             created_at, 
             updated_at  FROM emails WHERE id = ? and email_type = "inbox"`, emailID)
@@ -874,10 +641,49 @@ func GetEmailHandler(c echo.Context) error {
 	return c.JSON(http.StatusOK, emailResp)
 }
 
+// GetRawEmailHandler returns the original MIME source of an inbound email
+func GetRawEmailHandler(c echo.Context) error {
+	userID := c.Get("user_id").(int64)
+	roleID := c.Get("role_id").(int64)
+	emailID := c.Param("id")
+
+	emailIDDecode, err := utils.DecodeID(emailID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid email ID"})
+	}
+
+	// The source is either kept on the row or shared with the other
+	// recipients in raw_emails
+	query := `
+		SELECT COALESCE(e.body_eml, r.email_data)
+		FROM emails e
+		LEFT JOIN raw_emails r ON r.id = e.raw_email_id
+		WHERE e.id = ? AND COALESCE(e.body_eml, r.email_data) IS NOT NULL`
+	args := []interface{}{emailIDDecode}
+	if roleID == 1 {
+		query += " AND e.user_id = ?"
+		args = append(args, userID)
+	}
+
+	var bodyEml []byte
+	err = config.DB.Get(&bodyEml, query, args...)
+	if err != nil {
+		fmt.Println("Failed to fetch raw email", err)
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Email not found"})
+	}
+
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%s.eml", emailID))
+	return c.Blob(http.StatusOK, "message/rfc822", bodyEml)
+}
+
 func ListEmailsHandler(c echo.Context) error {
+	page, err := parseEmailPage(c, 0)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid cursor"})
+	}
+
 	// Fetch all emails
-	var emails []Email
-	err := config.DB.Select(&emails, `SELECT id, 
+	query := `SELECT id, 
 			is_read,
             user_id, 
             sender_email, sender_name, 
@@ -886,11 +692,17 @@ func ListEmailsHandler(c echo.Context) error {
 			preview,
             timestamp, 
             created_at, 
-            updated_at FROM emails and email_type = "inbox" ORDER BY timestamp DESC`)
+            updated_at FROM emails WHERE email_type = "inbox"`
+	query, args := page.apply(query, nil)
+
+	var emails []Email
+	err = config.DB.Select(&emails, query, args...)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch emails"})
 	}
 
+	emails, nextCursor, hasMore := page.trim(emails)
+
 	var encodedEmails []Email
 	for _, email := range emails {
 		email.EmailEncodeID = utils.EncodeID(int(email.ID))
@@ -898,7 +710,23 @@ func ListEmailsHandler(c echo.Context) error {
 		encodedEmails = append(encodedEmails, email)
 	}
 
-	return c.JSON(http.StatusOK, encodedEmails)
+	if !page.requested {
+		return c.JSON(http.StatusOK, encodedEmails)
+	}
+
+	response := make([]EmailResponse, len(encodedEmails))
+	for i, email := range encodedEmails {
+		response[i] = EmailResponse{
+			Email:        email,
+			RelativeTime: formatRelativeTime(email.Timestamp),
+		}
+	}
+
+	return c.JSON(http.StatusOK, PaginatedEmails{
+		Emails:     response,
+		NextCursor: nextCursor,
+		HasMore:    hasMore,
+	})
 }
 
 func SentEmailByIDHandler(c echo.Context) error {
@@ -916,36 +744,209 @@ func SentEmailByIDHandler(c echo.Context) error {
 	return c.JSON(http.StatusOK, user)
 }
 
+// ListSentEmailsHandler lists the sent emails of the current user with their
+// delivery status, optionally only those with the status query parameter.
+func ListSentEmailsHandler(c echo.Context) error {
+	userID := c.Get("user_id").(int64)
+
+	page, err := parseEmailPage(c, 10)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid cursor"})
+	}
+
+	query := `SELECT id,
+			is_read,
+			user_id,
+			sender_email, sender_name,
+			COALESCE(to_addresses, '') AS to_addresses,
+			COALESCE(cc_addresses, '') AS cc_addresses,
+			COALESCE(bcc_addresses, '') AS bcc_addresses,
+			COALESCE(subject, '') AS subject,
+			COALESCE(preview, '') AS preview,
+			body,
+			COALESCE(status, '') AS status,
+			COALESCE(last_error, '') AS last_error,
+			attachments,
+			timestamp,
+			created_at,
+			updated_at FROM emails WHERE user_id = ? and email_type = "sent"`
+	args := []interface{}{userID}
+
+	if status := c.QueryParam("status"); status != "" {
+		query += " AND status = ?"
+		args = append(args, status)
+	}
+
+	query, args = page.apply(query, args)
+
+	var emails []Email
+	err = config.DB.Select(&emails, query, args...)
+	if err != nil {
+		fmt.Println("Failed to fetch sent emails", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch emails"})
+	}
+
+	emails, nextCursor, hasMore := page.trim(emails)
+
+	response := make([]EmailResponse, len(emails))
+	for i, email := range emails {
+		email.EmailEncodeID = utils.EncodeID(int(email.ID))
+		email.UserEncodeID = utils.EncodeID(int(email.UserID))
+		response[i] = EmailResponse{
+			Email:           email,
+			ListAttachments: getAttachmentURLs(email.Attachments),
+			RelativeTime:    formatRelativeTime(email.Timestamp),
+		}
+	}
+
+	return c.JSON(http.StatusOK, PaginatedEmails{
+		Emails:     response,
+		NextCursor: nextCursor,
+		HasMore:    hasMore,
+	})
+}
+
 func ListEmailByTokenHandler(c echo.Context) error {
 	userID := c.Get("user_id").(int64)
 
-	emailUser, err := getUserEmail(userID)
+	_, err := getUserEmail(userID)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{
 			"error": "Failed to fetch user email",
 		})
 	}
 
-	err = processIncomingEmails(userID, emailUser)
+	page, err := parseEmailPage(c, 10)
 	if err != nil {
-		fmt.Println("Failed to process incoming emails", err)
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid cursor"})
+	}
+
+	query := `SELECT id, 
+			is_read,
+            user_id, 
+            sender_email, sender_name, 
+            subject, 
+            preview,
+            body,
+			COALESCE(label, '') AS label,
+            timestamp, 
+            created_at, 
+            updated_at FROM emails WHERE user_id = ? and email_type = "inbox"`
+	args := []interface{}{userID}
+
+	// Only the emails delivered to a plus-address with this tag
+	if label := c.QueryParam("label"); label != "" {
+		query += " AND label = ?"
+		args = append(args, strings.ToLower(label))
 	}
-	fmt.Println("Finish refresh internal mailbox")
+
+	query, args = page.apply(query, args)
 
 	var emails []Email
-	err = config.DB.Select(&emails, `SELECT id, 
+	err = config.DB.Select(&emails, query, args...)
+	if err != nil {
+		fmt.Println("Failed to fetch emails", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch emails"})
+	}
+
+	emails, nextCursor, hasMore := page.trim(emails)
+
+	response := make([]EmailResponse, len(emails))
+	for i, email := range emails {
+		email.EmailEncodeID = utils.EncodeID(int(email.ID))
+		email.UserEncodeID = utils.EncodeID(int(email.UserID))
+		response[i] = EmailResponse{
+			Email:        email,
+			RelativeTime: formatRelativeTime(email.Timestamp),
+		}
+	}
+
+	// Update last login
+	err = updateLastLogin(userID)
+	if err != nil {
+		fmt.Println("error updateLastLogin", err)
+	}
+
+	if !page.requested {
+		return c.JSON(http.StatusOK, response)
+	}
+
+	return c.JSON(http.StatusOK, PaginatedEmails{
+		Emails:     response,
+		NextCursor: nextCursor,
+		HasMore:    hasMore,
+	})
+}
+
+// SearchEmailHandler searches the inbox of the current user
+func SearchEmailHandler(c echo.Context) error {
+	userID := c.Get("user_id").(int64)
+
+	q := strings.TrimSpace(c.QueryParam("q"))
+	if q == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Search query is required"})
+	}
+
+	limit, err := strconv.Atoi(c.QueryParam("limit"))
+	if err != nil || limit < 1 || limit > 100 {
+		limit = 50
+	}
+
+	search, err := parseSearchQuery(q)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	query := `SELECT id, 
 			is_read,
             user_id, 
             sender_email, sender_name, 
             subject, 
             preview,
             body,
+            COALESCE(body_text, '') AS body_text,
+            attachments,
             timestamp, 
             created_at, 
-            updated_at FROM emails WHERE user_id = ? and email_type = "inbox" ORDER BY timestamp DESC LIMIT 10`, userID)
+            updated_at FROM emails WHERE user_id = ? and email_type = "inbox"`
+	args := []interface{}{userID}
+
+	if len(search.Terms) > 0 {
+		var booleanTerms []string
+		for _, term := range search.Terms {
+			booleanTerms = append(booleanTerms, fmt.Sprintf(`+"%s"`, term))
+		}
+		query += " AND MATCH(subject, sender_email, sender_name, body_text, attachments) AGAINST (? IN BOOLEAN MODE)"
+		args = append(args, strings.Join(booleanTerms, " "))
+	}
+	for _, from := range search.From {
+		query += " AND (sender_email LIKE ? OR sender_name LIKE ?)"
+		pattern := "%" + escapeLike(from) + "%"
+		args = append(args, pattern, pattern)
+	}
+	if search.HasAttachment {
+		query += " AND attachments IS NOT NULL AND attachments NOT IN ('', '[]', 'null')"
+	}
+	if search.Before != nil {
+		query += " AND timestamp < ?"
+		args = append(args, *search.Before)
+	}
+	if search.After != nil {
+		query += " AND timestamp >= ?"
+		args = append(args, *search.After)
+	}
+	if search.IsUnread != nil {
+		query += " AND is_read = ?"
+		args = append(args, !*search.IsUnread)
+	}
+	query += " ORDER BY timestamp DESC LIMIT ?"
+	args = append(args, limit)
+
+	var emails []Email
+	err = config.DB.Select(&emails, query, args...)
 	if err != nil {
-		fmt.Println("Failed to fetch emails", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch emails"})
+		fmt.Println("Failed to search emails", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to search emails"})
 	}
 
 	response := make([]EmailResponse, len(emails))
@@ -953,9 +954,16 @@ func ListEmailByTokenHandler(c echo.Context) error {
 		email.EmailEncodeID = utils.EncodeID(int(email.ID))
 		email.UserEncodeID = utils.EncodeID(int(email.UserID))
 		response[i] = EmailResponse{
-			Email:        email,
-			RelativeTime: formatRelativeTime(email.Timestamp),
+			Email:           email,
+			RelativeTime:    formatRelativeTime(email.Timestamp),
+			ListAttachments: getAttachmentURLs(email.Attachments),
+		}
+
+		snippet := generateSnippet(email.Subject, search.Terms)
+		if bodySnippet := generateSnippet(email.BodyText, search.Terms); bodySnippet != "" {
+			snippet = bodySnippet
 		}
+		response[i].Snippet = snippet
 	}
 
 	// Update last login
@@ -967,6 +975,90 @@ func ListEmailByTokenHandler(c echo.Context) error {
 	return c.JSON(http.StatusOK, response)
 }
 
+// parseSearchQuery splits q into free-text terms and operators.
+// Double quotes keep a phrase together, e.g. from:"John Doe".
+func parseSearchQuery(q string) (SearchQuery, error) {
+	var search SearchQuery
+
+	var tokens []string
+	var current strings.Builder
+	inQuotes := false
+	for _, r := range q {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+		case unicode.IsSpace(r) && !inQuotes:
+			if current.Len() > 0 {
+				tokens = append(tokens, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if current.Len() > 0 {
+		tokens = append(tokens, current.String())
+	}
+
+	for _, token := range tokens {
+		key, value, found := strings.Cut(token, ":")
+		if !found || value == "" {
+			key, value = "", token
+		}
+
+		switch strings.ToLower(key) {
+		case "from":
+			search.From = append(search.From, value)
+		case "has":
+			if strings.ToLower(value) != "attachment" {
+				return search, fmt.Errorf("unsupported operator has:%s", value)
+			}
+			search.HasAttachment = true
+		case "before", "after":
+			date, err := time.Parse("2006-01-02", value)
+			if err != nil {
+				return search, fmt.Errorf("invalid date %s, expected YYYY-MM-DD", value)
+			}
+			if strings.ToLower(key) == "before" {
+				search.Before = &date
+			} else {
+				search.After = &date
+			}
+		case "is":
+			var unread bool
+			switch strings.ToLower(value) {
+			case "unread":
+				unread = true
+			case "read":
+				unread = false
+			default:
+				return search, fmt.Errorf("unsupported operator is:%s", value)
+			}
+			search.IsUnread = &unread
+		default:
+			// Strip characters that have a meaning in MySQL boolean mode
+			term := strings.Map(func(r rune) rune {
+				if strings.ContainsRune(`+-<>()~*"@`, r) {
+					return ' '
+				}
+				return r
+			}, token)
+			term = strings.Join(strings.Fields(term), " ")
+			if term != "" {
+				search.Terms = append(search.Terms, term)
+			}
+		}
+	}
+
+	return search, nil
+}
+
+// escapeLike escapes the LIKE wildcards in s, so that it only matches
+// literally.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
 func ListEmailByIDHandler(c echo.Context) error {
 	userIDStr := c.Param("id")
 
@@ -982,21 +1074,19 @@ func ListEmailByIDHandler(c echo.Context) error {
 		})
 	}
 
-	emailUser, err := getUserEmail(userID)
+	_, err = getUserEmail(userID)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{
 			"error": "Failed to fetch user email",
 		})
 	}
 
-	err = processIncomingEmails(userID, emailUser)
+	page, err := parseEmailPage(c, 0)
 	if err != nil {
-		fmt.Println("Failed to process incoming emails", err)
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid cursor"})
 	}
-	fmt.Println("Finish refresh internal mailbox")
 
-	var emails []Email
-	err = config.DB.Select(&emails, `SELECT id, 
+	query, args := page.apply(`SELECT id, 
 			is_read,
             user_id, 
             sender_email, 
@@ -1008,12 +1098,17 @@ func ListEmailByIDHandler(c echo.Context) error {
 			message_id,
 			attachments, 
             created_at, 
-            updated_at FROM emails WHERE user_id = ? and email_type = "inbox" ORDER BY timestamp DESC`, userID)
+            updated_at FROM emails WHERE user_id = ? and email_type = "inbox"`, []interface{}{userID})
+
+	var emails []Email
+	err = config.DB.Select(&emails, query, args...)
 	if err != nil {
 		fmt.Println("Failed to fetch emails", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch emails"})
 	}
 
+	emails, nextCursor, hasMore := page.trim(emails)
+
 	response := make([]EmailResponse, len(emails))
 	for i, email := range emails {
 		email.EmailEncodeID = utils.EncodeID(int(email.ID))
@@ -1026,7 +1121,112 @@ func ListEmailByIDHandler(c echo.Context) error {
 		response[i].ListAttachments = getAttachmentURLs(email.Attachments)
 	}
 
-	return c.JSON(http.StatusOK, response)
+	if !page.requested {
+		return c.JSON(http.StatusOK, response)
+	}
+
+	return c.JSON(http.StatusOK, PaginatedEmails{
+		Emails:     response,
+		NextCursor: nextCursor,
+		HasMore:    hasMore,
+	})
+}
+
+// emailPage holds the cursor pagination parameters of a mailbox listing.
+// Pages are ordered by (timestamp, id) descending, so new mail arriving
+// during a sync never shifts the following pages.
+type emailPage struct {
+	requested bool // cursor or limit was passed, respond with PaginatedEmails
+	limit     int  // 0 means no limit
+	timestamp time.Time
+	id        int64
+	hasCursor bool
+}
+
+// parseEmailPage reads ?cursor=&limit=. Without either parameter the legacy
+// array response and defaultLimit are kept for existing clients.
+func parseEmailPage(c echo.Context, defaultLimit int) (emailPage, error) {
+	page := emailPage{limit: defaultLimit}
+
+	cursor := c.QueryParam("cursor")
+	limitParam := c.QueryParam("limit")
+	if cursor == "" && limitParam == "" {
+		return page, nil
+	}
+
+	page.requested = true
+	page.limit = 20
+	if limit, err := strconv.Atoi(limitParam); err == nil && limit > 0 {
+		page.limit = limit
+	}
+	if page.limit > 100 {
+		page.limit = 100
+	}
+
+	if cursor != "" {
+		timestamp, id, err := decodeEmailCursor(cursor)
+		if err != nil {
+			return page, err
+		}
+		page.timestamp = timestamp
+		page.id = id
+		page.hasCursor = true
+	}
+
+	return page, nil
+}
+
+// apply appends the cursor condition, ordering and limit to query. One extra
+// row is fetched so trim can tell whether there is a next page.
+func (p emailPage) apply(query string, args []interface{}) (string, []interface{}) {
+	if p.hasCursor {
+		query += " AND (timestamp < ? OR (timestamp = ? AND id < ?))"
+		args = append(args, p.timestamp, p.timestamp, p.id)
+	}
+	query += " ORDER BY timestamp DESC, id DESC"
+	if p.limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, p.limit+1)
+	}
+	return query, args
+}
+
+func (p emailPage) trim(emails []Email) ([]Email, string, bool) {
+	if p.limit == 0 || len(emails) <= p.limit {
+		return emails, "", false
+	}
+
+	emails = emails[:p.limit]
+	last := emails[len(emails)-1]
+	return emails, encodeEmailCursor(last.Timestamp, last.ID), true
+}
+
+func encodeEmailCursor(timestamp time.Time, id int64) string {
+	data := fmt.Sprintf("%d:%d", timestamp.Unix(), id)
+	return base64.RawURLEncoding.EncodeToString([]byte(data))
+}
+
+func decodeEmailCursor(cursor string) (time.Time, int64, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("failed to decode cursor: %w", err)
+	}
+
+	parts := strings.Split(string(decoded), ":")
+	if len(parts) != 2 {
+		return time.Time{}, 0, fmt.Errorf("invalid cursor format")
+	}
+
+	seconds, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("invalid cursor timestamp: %w", err)
+	}
+	id, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("invalid cursor id: %w", err)
+	}
+
+	return time.Unix(seconds, 0).UTC(), id, nil
 }
 
 func getAttachmentURLs(attachmentsJSON string) []Attachment {
@@ -1055,6 +1255,12 @@ func getAttachmentURLs(attachmentsJSON string) []Attachment {
 func DeleteEmailHandler(c echo.Context) error {
 	emailID := c.Param("id")
 
+	var email Email
+	err := config.DB.Get(&email, "SELECT id, user_id FROM emails WHERE id = ?", emailID)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Email not found"})
+	}
+
 	// Delete email by ID
 	result, err := config.DB.Exec("DELETE FROM emails WHERE id = ?", emailID)
 	if err != nil {
@@ -1066,6 +1272,8 @@ func DeleteEmailHandler(c echo.Context) error {
 		return c.JSON(http.StatusNotFound, map[string]string{"error": "Email not found"})
 	}
 
+	publishEmailEvent(email.UserID, EventEmailDeleted, email.ID)
+
 	return c.JSON(http.StatusOK, map[string]string{"message": "Email deleted successfully"})
 }
 
@@ -1114,6 +1322,10 @@ func UploadAttachmentHandler(c echo.Context) error {
 	}
 
 	file := files[0]
+	if err := checkAttachmentLimit(c.Get("user_id").(int64), files); err != nil {
+		return emailLimitResponse(c, err)
+	}
+
 	src, err := file.Open()
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{
@@ -1388,6 +1600,8 @@ func SyncEmails() error {
 	// Create S3 client
 	s3Client := s3.New(sess)
 
+	stats := SyncStats{}
+
 	// List objects in S3 bucket
 	err = s3Client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
 		Bucket: aws.String(bucketName),
@@ -1395,48 +1609,21 @@ func SyncEmails() error {
 	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
 		fmt.Println("Processing ", len(page.Contents))
 		for _, obj := range page.Contents {
+			stats.TotalEmails++
 			messageID := *obj.Key
 			if messageID == "" {
+				stats.SkippedEmails++
 				continue
 			}
 			fmt.Println("messageID", messageID)
 
-			// Get the email object
-			output, err := s3Client.GetObject(&s3.GetObjectInput{
-				Bucket: aws.String(bucketName),
-				Key:    aws.String(messageID),
-			})
-			if err != nil {
-				fmt.Printf("Failed to get object %s: %v\n", messageID, err)
-				continue
-			}
-			defer output.Body.Close()
-
-			// Read the email content
-			buf := new(bytes.Buffer)
-			buf.ReadFrom(output.Body)
-			emailContent := buf.Bytes()
-
-			if emailContent == nil {
-				fmt.Println("emailContent is empty")
-				continue
-			}
-			// Store the raw email in the database
-			err = storeRawEmail(s3Client, messageID, emailContent)
-			if err != nil {
-				fmt.Printf("Failed to store raw email %s: %v\n", messageID, err)
-				continue
-			}
-
-			// Delete the email object from S3 after storing
-			_, err = s3Client.DeleteObject(&s3.DeleteObjectInput{
-				Bucket: aws.String(bucketName),
-				Key:    aws.String(messageID),
-			})
+			objectStats, err := ingestS3Object(s3Client, bucketName, messageID, nil)
 			if err != nil {
-				fmt.Printf("Failed to delete object %s: %v\n", messageID, err)
+				fmt.Printf("Failed to ingest object %s: %v\n", messageID, err)
+				stats.FailedEmails++
 				continue
 			}
+			stats.add(objectStats)
 		}
 		return !lastPage
 	})
@@ -1445,77 +1632,51 @@ func SyncEmails() error {
 		return fmt.Errorf("failed to list objects: %v", err)
 	}
 
-	fmt.Println("Sync completed.", time.Now())
+	fmt.Printf("Sync completed. %+v %v\n", stats, time.Now())
 	return nil
 }
 
-func storeRawEmail(s3Client *s3.S3, messageID string, emailContent []byte) error {
-	// Extract recipient email to associate with user
-	// fmt.Println("start extract", time.Now())
-	sendEmailTo, dateEmail, err := extractRecipientEmail(emailContent)
-	if err != nil {
-		return err
-	}
-	// fmt.Println("finish extract", time.Now())
-	fmt.Println("sendEmailTo", sendEmailTo)
-	fmt.Println("dateEmail", dateEmail)
-
-	// if sendEmailTo not found delete
-	// Get the user ID from the email address
-	var userID int64
-	err = config.DB.Get(&userID, `
-		SELECT id 
-		FROM users 
-		WHERE email = ?`, sendEmailTo)
-	fmt.Println("userID storeRawEmail", userID)
+// ingestS3Object stores one raw email object from the inbound bucket in
+// incoming_emails and removes it from S3. It is shared by the bucket listing
+// and the SNS/SQS event sources.
+func ingestS3Object(s3Client *s3.S3, bucketName, messageID string, envelopeRecipients []string) (SyncStats, error) {
+	// Get the email object
+	output, err := s3Client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(messageID),
+	})
 	if err != nil {
-		fmt.Printf("Failed to get user ID for email %s: %v\n", sendEmailTo, err)
-		fmt.Println("User not registered in our Database")
-		bucketName := viper.GetString("S3_BUCKET_NAME")
-		// Delete the email object from S3 after storing
-		err := pkg.DeleteS3ByMessageID(s3Client, bucketName, messageID)
-		if err != nil {
-			fmt.Printf("Failed to delete object %s: %v\n", messageID, err)
-			return err
-		}
+		return SyncStats{}, fmt.Errorf("failed to get object: %v", err)
 	}
+	defer output.Body.Close()
 
-	fmt.Println("start insert", time.Now())
-	// Insert raw email into the raw_emails table
-	_, err = config.DB.Exec(`
-	    INSERT INTO incoming_emails (
-			email_send_to,
-	        message_id,
-	        email_data,
-	        created_at,
-	        processed,
-			email_date
-	    ) VALUES (?, ?, ?, NOW(), false, ?)
-	`, sendEmailTo, messageID, emailContent, dateEmail)
-	if err != nil {
-		return fmt.Errorf("failed to insert raw email: %v", err)
+	// Read the email content
+	buf := new(bytes.Buffer)
+	if _, err := buf.ReadFrom(output.Body); err != nil {
+		return SyncStats{}, fmt.Errorf("failed to read object: %v", err)
 	}
-	// err = processIncomingEmails(sendEmailTo)
-	// fmt.Println("Err Process Incoming Emails", err)
-	fmt.Println("finish insert", time.Now())
+	emailContent := buf.Bytes()
 
-	return nil
-}
+	if len(emailContent) == 0 {
+		return SyncStats{}, fmt.Errorf("emailContent is empty")
+	}
 
-func extractRecipientEmail(emailContent []byte) (string, time.Time, error) {
-	env, err := enmime.ReadEnvelope(bytes.NewReader(emailContent))
+	// Store the raw email in the database
+	stats, err := storeRawEmail(messageID, emailContent, envelopeRecipients)
 	if err != nil {
-		return "", time.Time{}, fmt.Errorf("failed to parse email: %v", err)
+		return SyncStats{}, fmt.Errorf("failed to store raw email: %v", err)
 	}
 
-	dateT, _ := env.Date()
-
-	toAddresses := parseAddresses(env.GetHeader("To"))
-	if len(toAddresses) == 0 {
-		return "", time.Time{}, fmt.Errorf("failed to parse recipient addresses")
+	// Delete the email object from S3 after storing
+	_, err = s3Client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(messageID),
+	})
+	if err != nil {
+		return stats, fmt.Errorf("failed to delete object: %v", err)
 	}
 
-	return toAddresses[0].Address, dateT, nil
+	return stats, nil
 }
 
 func SyncBucketInboxHandler(c echo.Context) error {
@@ -1534,8 +1695,6 @@ func SyncBucketInboxHandler(c echo.Context) error {
 
 	stats := SyncStats{}
 
-	emails := []PEmail{}
-
 	// List objects in S3 bucket
 	err = s3Client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
 		Bucket: aws.String(bucketName),
@@ -1558,12 +1717,15 @@ func SyncBucketInboxHandler(c echo.Context) error {
 				stats.FailedEmails++
 				continue
 			}
-			defer output.Body.Close()
 
 			// Read the email content
-			buf := new(bytes.Buffer)
-			buf.ReadFrom(output.Body)
-			emailContent := buf.Bytes()
+			emailContent, err := io.ReadAll(output.Body)
+			output.Body.Close()
+			if err != nil {
+				fmt.Printf("Failed to read object %s: %v\n", messageID, err)
+				stats.FailedEmails++
+				continue
+			}
 
 			// Parse the email
 			env, err := enmime.ReadEnvelope(bytes.NewReader(emailContent))
@@ -1573,99 +1735,48 @@ func SyncBucketInboxHandler(c echo.Context) error {
 				continue
 			}
 
-			dateT, _ := env.Date()
-
-			// Extract email information
-			email := &PEmail{
-				ID:       messageID,
-				From:     parseAddresses(env.GetHeader("From")),
-				To:       parseAddresses(env.GetHeader("To")),
-				Cc:       parseAddresses(env.GetHeader("Cc")),
-				Bcc:      parseAddresses(env.GetHeader("Bcc")),
-				Subject:  env.GetHeader("Subject"),
-				Date:     dateT,
-				TextBody: env.Text,
-				HTMLBody: env.HTML,
+			candidates := candidateRecipients(env)
+			recipients, err := resolveLocalRecipients(candidates)
+			if err != nil {
+				fmt.Printf("Failed to resolve recipients of %s: %v\n", messageID, err)
+				stats.FailedEmails++
+				continue
 			}
-
-			var attachmentURLs []string
-			// Handle attachments
-			for _, att := range env.Attachments {
-				attachmentKey := fmt.Sprintf("attachments/%s/%s", email.ID, att.FileName)
-				attachmentURL, err := pkg.UploadAttachment(att.Content, attachmentKey, att.ContentType)
+			if len(recipients) == 0 {
+				// No user of ours, keep it for a superadmin to assign
+				err = quarantineEmail(messageID, emailContent, env, candidates, nil)
+				if err == errDuplicateEmail {
+					stats.SkippedEmails++
+					continue
+				}
 				if err != nil {
-					log.Printf("Failed to upload attachment: %v", err)
+					fmt.Printf("Failed to quarantine email %s: %v\n", messageID, err)
+					stats.FailedEmails++
 					continue
 				}
-
-				attachmentURLs = append(attachmentURLs, attachmentURL)
-			}
-
-			emails = append(emails, *email)
-			attachmentsJSON, _ := json.Marshal(attachmentURLs)
-
-			var preview string
-			var bodyEmail string
-			if email.HTMLBody != "" {
-				bodyEmail = email.HTMLBody
-			} else {
-				bodyEmail = email.TextBody
+				stats.QuarantinedEmails++
+				continue
 			}
 
-			// Get a 25-character preview of the body content
-			preview = generatePreview(email.TextBody, email.HTMLBody)
-
-			if email.ID == "" {
-				email.ID = "NOTVALID"
+			// Keep the source once for all recipients, and across syncs
+			rawEmailID, err := insertRawEmail(config.DB, messageID, emailContent, fingerprintEmail(env, emailContent))
+			if err != nil {
+				fmt.Printf("Failed to store email %s: %v\n", messageID, err)
+				stats.FailedEmails++
+				continue
 			}
 
-			sendEmailTo := email.To[0].Address
-
-			for _, emailFrom := range email.From {
-				var userID int64
-				err = config.DB.Get(&userID, `
-				SELECT id 
-				FROM users 
-				WHERE email = ?`, sendEmailTo)
-				if err != nil {
-					fmt.Println("Failed to get user ID", err)
-					// TODO: berarti tidak ditemukan user nya dikita, mau diapakan? diterima oleh support kalo ada email masuk ke user yg tidak terdaftar kah?
+			for _, recipient := range recipients {
+				_, err := deliverToMailbox(recipient, messageID, env, emailContent, &rawEmailID, nil)
+				if err == errDuplicateEmail {
+					stats.SkippedEmails++
+					continue
 				}
-
-				// Insert into emails table
-				_, err = config.DB.Exec(`
-					INSERT INTO emails (
-						user_id,
-						sender_email,
-						sender_name,
-						subject,
-						preview,
-						body,
-						email_type,
-						attachments,
-						message_id,
-						timestamp,
-						created_at,
-						updated_at
-					) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NOW(), NOW())
-					`,
-					userID,
-					emailFrom.Address,
-					emailFrom.Name,
-					email.Subject,
-					preview,
-					bodyEmail,
-					"inbox", // Set email_type as needed
-					string(attachmentsJSON),
-					email.ID,
-					email.Date,
-				)
 				if err != nil {
-					fmt.Printf("Failed to insert email %s into DB: %v\n", messageID, err)
+					fmt.Printf("Failed to deliver email %s to %s: %v\n", messageID, recipient.Email, err)
 					stats.FailedEmails++
 					continue
 				}
-
 				stats.NewEmails++
 			}
 		}
@@ -1704,14 +1815,7 @@ func parseAddresses(addresses string) []EmailAddress {
 }
 
 func generatePreview(plainText string, htmlBody string) string {
-	var text string
-	// fmt.Println("plainText", plainText)
-	if plainText != "" {
-		text = html2text(plainText)
-	} else {
-		// Convert HTML to plain text
-		text = html2text(htmlBody)
-	}
+	text := generateBodyText(plainText, htmlBody)
 	// Generate a short preview
 	if len(text) > 200 {
 		return text[:200] + "..."
@@ -1719,6 +1823,117 @@ func generatePreview(plainText string, htmlBody string) string {
 	return text
 }
 
+// generateBodyText returns the full plain text of the body, used for search
+func generateBodyText(plainText string, htmlBody string) string {
+	// fmt.Println("plainText", plainText)
+	if plainText != "" {
+		return html2text(plainText)
+	}
+	// Convert HTML to plain text
+	return html2text(htmlBody)
+}
+
+// BackfillBodyText fills in the search text of inbox emails stored before
+// body_text existed, a batch at a time.
+func BackfillBodyText() error {
+	var lastID int64
+	for {
+		var emails []struct {
+			ID   int64  `db:"id"`
+			Body string `db:"body"`
+		}
+		err := config.DB.Select(&emails, `
+			SELECT id, COALESCE(body, '') AS body
+			FROM emails
+			WHERE body_text IS NULL AND email_type = "inbox" AND id > ?
+			ORDER BY id ASC
+			LIMIT 500`, lastID)
+		if err != nil {
+			return fmt.Errorf("failed to fetch emails without body text: %v", err)
+		}
+		if len(emails) == 0 {
+			return nil
+		}
+
+		for _, email := range emails {
+			_, err := config.DB.Exec("UPDATE emails SET body_text = ? WHERE id = ?", generateBodyText("", email.Body), email.ID)
+			if err != nil {
+				return fmt.Errorf("failed to backfill body text of email %d: %v", email.ID, err)
+			}
+			lastID = email.ID
+		}
+	}
+}
+
+// generateSnippet returns a short excerpt around the first matching term,
+// with every match wrapped in <mark> for highlighting
+func generateSnippet(text string, terms []string) string {
+	pattern := searchTermsPattern(terms)
+	if pattern == nil {
+		return ""
+	}
+
+	first := pattern.FindStringIndex(text)
+	if first == nil {
+		return ""
+	}
+
+	// Take a window of about 200 characters around the first match
+	from := first[0] - 60
+	if from < 0 {
+		from = 0
+	}
+	to := from + 200
+	if to > len(text) {
+		to = len(text)
+	}
+	for from > 0 && !utf8.RuneStart(text[from]) {
+		from--
+	}
+	for to < len(text) && !utf8.RuneStart(text[to]) {
+		to++
+	}
+
+	// Matches are found on the raw text and every segment is escaped on its
+	// own, so terms never match inside entities or earlier <mark> tags
+	window := text[from:to]
+	var snippet strings.Builder
+	if from > 0 {
+		snippet.WriteString("...")
+	}
+	last := 0
+	for _, match := range pattern.FindAllStringIndex(window, -1) {
+		snippet.WriteString(html.EscapeString(window[last:match[0]]))
+		snippet.WriteString("<mark>" + html.EscapeString(window[match[0]:match[1]]) + "</mark>")
+		last = match[1]
+	}
+	snippet.WriteString(html.EscapeString(window[last:]))
+	if to < len(text) {
+		snippet.WriteString("...")
+	}
+	return snippet.String()
+}
+
+// searchTermsPattern matches any of terms case-insensitively, preferring the
+// longest one where several start at the same place. It returns nil without
+// terms.
+func searchTermsPattern(terms []string) *regexp.Regexp {
+	var alternatives []string
+	for _, term := range terms {
+		if term != "" {
+			alternatives = append(alternatives, regexp.QuoteMeta(term))
+		}
+	}
+	if len(alternatives) == 0 {
+		return nil
+	}
+
+	sort.SliceStable(alternatives, func(i, j int) bool {
+		return len(alternatives[i]) > len(alternatives[j])
+	})
+	return regexp.MustCompile("(?i)" + strings.Join(alternatives, "|"))
+}
+
 // // Simple HTML to text converter (you might want to use a proper library)
 func html2text(contentHTML string) string {
 	text := contentHTML
@@ -1758,22 +1973,8 @@ func removeNonPrintable(s string) string {
 	return buf.String()
 }
 
-func updateLimitSentEmails(userID int64) error {
-	// Increment counter
-	_, err := config.DB.Exec(`
-        UPDATE users 
-        SET sent_emails = sent_emails + 1,
-		last_login = NOW()
-        WHERE id = ?`, userID)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
 func updateIsRead(emailID string) error {
-	_, err := config.DB.Exec(`
+	result, err := config.DB.Exec(`
 		UPDATE emails 
 		SET is_read = TRUE
 		WHERE id = ?`, emailID)
@@ -1781,6 +1982,14 @@ func updateIsRead(emailID string) error {
 		return err
 	}
 
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected > 0 {
+		var email Email
+		err = config.DB.Get(&email, "SELECT id, user_id FROM emails WHERE id = ?", emailID)
+		if err == nil {
+			publishEmailEvent(email.UserID, EventEmailRead, email.ID)
+		}
+	}
+
 	return nil
 }
 
@@ -1794,181 +2003,6 @@ func updateLastLogin(userID int64) error {
 	return nil
 }
 
-func processIncomingEmails(userID int64, emailSendTo string) error {
-	fmt.Println("START processIncomingEmails", time.Now())
-
-	// Check the number of emails for the user
-	var emailCount int
-	err := config.DB.Get(&emailCount, `
-		SELECT COUNT(*) 
-		FROM emails 
-		WHERE user_id = ? and email_type = 'inbox'
-	`, userID)
-	if err != nil {
-		fmt.Printf("Failed to count emails for user %d: %v\n", userID, err)
-		return err
-	}
-
-	// Delete the oldest email if the user has 10 emails
-	if emailCount > 10 {
-		fmt.Println("Deleting oldest email for user", userID)
-		// Select the ID of the oldest email for the user
-		var oldestEmailID int64
-		err = config.DB.Get(&oldestEmailID, `
-			SELECT id 
-			FROM emails 
-			WHERE user_id = ? and email_type = 'inbox'
-			ORDER BY created_at ASC 
-			LIMIT 1
-		`, userID)
-		if err != nil {
-			fmt.Printf("Failed to select oldest email for user %d: %v\n", userID, err)
-			return err
-		}
-
-		// Delete the oldest email
-		_, err = config.DB.Exec(`
-		DELETE FROM emails 
-		WHERE id = ?
-		`, oldestEmailID)
-		if err != nil {
-			fmt.Printf("Failed to delete oldest email for user %d: %v\n", userID, err)
-			return err
-		}
-	}
-
-	// Fetch unprocessed emails for the user from incoming_emails table
-	var rawEmails []struct {
-		ID        int64     `db:"id"`
-		MessageID string    `db:"message_id"`
-		EmailData []byte    `db:"email_data"`
-		CreatedAt time.Time `db:"created_at"`
-	}
-	err = config.DB.Select(&rawEmails, `
-        SELECT id, message_id, email_data, created_at
-        FROM incoming_emails
-        WHERE email_send_to = ? AND processed = FALSE
-    `, emailSendTo)
-	if err != nil {
-		return fmt.Errorf("failed to fetch raw emails: %v", err)
-	}
-
-	fmt.Println("Start processIncomingEmails", len(rawEmails))
-	for _, rawEmail := range rawEmails {
-		// Parse the email content
-		env, err := enmime.ReadEnvelope(bytes.NewReader(rawEmail.EmailData))
-		if err != nil {
-			fmt.Printf("Failed to parse email %s: %v\n", rawEmail.MessageID, err)
-			continue
-		}
-
-		dateT, _ := env.Date()
-
-		// Extract email information
-		email := &PEmail{
-			ID:       rawEmail.MessageID,
-			From:     parseAddresses(env.GetHeader("From")),
-			To:       parseAddresses(env.GetHeader("To")),
-			Cc:       parseAddresses(env.GetHeader("Cc")),
-			Bcc:      parseAddresses(env.GetHeader("Bcc")),
-			Subject:  env.GetHeader("Subject"),
-			Date:     dateT,
-			TextBody: env.Text,
-			HTMLBody: env.HTML,
-		}
-
-		// Handle attachments
-		var attachmentURLs []string
-		for _, att := range env.Attachments {
-			attachmentKey := fmt.Sprintf("attachments/%s/%s", email.ID, att.FileName)
-			attachmentURL, err := pkg.UploadAttachment(att.Content, attachmentKey, att.ContentType)
-			if err != nil {
-				log.Printf("Failed to upload attachment: %v", err)
-				continue
-			}
-			attachmentURLs = append(attachmentURLs, attachmentURL)
-		}
-		attachmentsJSON, _ := json.Marshal(attachmentURLs)
-
-		// Select the email body and generate a preview
-		var bodyEmail string
-		if email.HTMLBody != "" {
-			bodyEmail = email.HTMLBody
-		} else {
-			bodyEmail = email.TextBody
-		}
-		preview := generatePreview(email.TextBody, email.HTMLBody)
-		fmt.Println("preview", preview)
-
-		// Get the user ID from the email address
-		var userID int64
-		err = config.DB.Get(&userID, `
-            SELECT id 
-            FROM users 
-            WHERE email = ?`, emailSendTo)
-		if err != nil {
-			fmt.Printf("Failed to get user ID for email %s: %v\n", emailSendTo, err)
-			continue
-		}
-
-		// Insert the processed email into the emails table
-		_, err = config.DB.Exec(`
-            INSERT INTO emails (
-                user_id,
-                sender_email,
-                sender_name,
-                subject,
-                preview,
-                body,
-                email_type,
-                attachments,
-                message_id,
-                timestamp,
-                created_at,
-                updated_at
-            ) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NOW(), NOW())
-        `,
-			userID,
-			email.From[0].Address,
-			email.From[0].Name,
-			email.Subject,
-			preview,
-			bodyEmail,
-			"inbox", // Set email_type as needed
-			string(attachmentsJSON),
-			email.ID,
-			email.Date,
-		)
-		if err != nil {
-			fmt.Printf("Failed to insert email %s into DB: %v\n", email.ID, err)
-			continue
-		}
-
-		// // Mark the raw email as processed
-		// _, err = config.DB.Exec(`
-		//     UPDATE incoming_emails
-		//     SET processed = TRUE, processed_at = NOW()
-		//     WHERE id = ?
-		// `, rawEmail.ID)
-		// if err != nil {
-		// 	fmt.Printf("Failed to update raw email %s: %v\n", rawEmail.MessageID, err)
-		// 	continue
-		// }
-		// Delete the raw email after successful processing
-		_, err = config.DB.Exec(`
-		DELETE FROM incoming_emails
-		WHERE id = ?
-		`, rawEmail.ID)
-		if err != nil {
-			fmt.Printf("Failed to delete raw email %s: %v\n", rawEmail.MessageID, err)
-			continue
-		}
-	}
-	fmt.Println("Finish processIncomingEmails", time.Now())
-
-	return nil
-}
-
 func getUserEmail(userID int64) (string, error) {
 	var emailUser string
 	err := config.DB.Get(&emailUser, `
@@ -0,0 +1,140 @@
+package email
+
+import (
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	date := func(value string) *time.Time {
+		d, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &d
+	}
+	unread, read := true, false
+
+	tests := []struct {
+		name    string
+		q       string
+		want    SearchQuery
+		wantErr bool
+	}{
+		{name: "terms", q: "lunch  tomorrow", want: SearchQuery{Terms: []string{"lunch", "tomorrow"}}},
+		{name: "phrase", q: `"lunch tomorrow" menu`, want: SearchQuery{Terms: []string{"lunch tomorrow", "menu"}}},
+		{name: "from", q: "from:alice from:\"John Doe\"", want: SearchQuery{From: []string{"alice", "John Doe"}}},
+		{name: "has attachment", q: "has:Attachment", want: SearchQuery{HasAttachment: true}},
+		{name: "unsupported has", q: "has:star", wantErr: true},
+		{name: "dates", q: "after:2024-01-01 before:2024-02-01", want: SearchQuery{After: date("2024-01-01"), Before: date("2024-02-01")}},
+		{name: "invalid date", q: "before:yesterday", wantErr: true},
+		{name: "unread", q: "is:unread", want: SearchQuery{IsUnread: &unread}},
+		{name: "read", q: "is:read", want: SearchQuery{IsUnread: &read}},
+		{name: "unsupported is", q: "is:starred", wantErr: true},
+		{name: "boolean operators stripped", q: "+foo -bar (baz)* user@example", want: SearchQuery{Terms: []string{"foo", "bar", "baz", "user example"}}},
+		{name: "only operators", q: "+ - *", want: SearchQuery{}},
+		{name: "empty operator value", q: "from:", want: SearchQuery{Terms: []string{"from:"}}},
+		{name: "unknown operator is a term", q: "subject:lunch", want: SearchQuery{Terms: []string{"subject:lunch"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSearchQuery(tt.q)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parseSearchQuery(%q) returned no error", tt.q)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseSearchQuery(%q) returned %v", tt.q, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseSearchQuery(%q) = %+v, want %+v", tt.q, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGenerateSnippet(t *testing.T) {
+	long := strings.Repeat("x", 100) + " lunch " + strings.Repeat("y", 200)
+
+	tests := []struct {
+		name  string
+		text  string
+		terms []string
+		want  string
+	}{
+		{name: "no terms", text: "lunch", terms: nil, want: ""},
+		{name: "no match", text: "dinner", terms: []string{"lunch"}, want: ""},
+		{name: "case insensitive", text: "Lunch at noon", terms: []string{"lunch"}, want: "<mark>Lunch</mark> at noon"},
+		{name: "every match", text: "lunch and noon lunch", terms: []string{"lunch", "noon"}, want: "<mark>lunch</mark> and <mark>noon</mark> <mark>lunch</mark>"},
+		{name: "term inside earlier mark", text: "mark my lunch", terms: []string{"lunch", "mark"}, want: "<mark>mark</mark> my <mark>lunch</mark>"},
+		{name: "term inside entity", text: "fish & chips < 5", terms: []string{"amp", "lt", "chips"}, want: "fish &amp; <mark>chips</mark> &lt; 5"},
+		{name: "escaped match", text: "a <b> c", terms: []string{"<b>"}, want: "a <mark>&lt;b&gt;</mark> c"},
+		{name: "longest first", text: "lunchbox", terms: []string{"lunch", "lunchbox"}, want: "<mark>lunchbox</mark>"},
+		{name: "window", text: long, terms: []string{"lunch"}, want: "..." + strings.Repeat("x", 59) + " <mark>lunch</mark> " + strings.Repeat("y", 134) + "..."},
+		{name: "multi-byte window", text: strings.Repeat("é", 40) + " lunch", terms: []string{"lunch"}, want: "..." + strings.Repeat("é", 30) + " <mark>lunch</mark>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := generateSnippet(tt.text, tt.terms); got != tt.want {
+				t.Errorf("generateSnippet(%q, %q) = %q, want %q", tt.text, tt.terms, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEscapeLike(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{value: "alice", want: "alice"},
+		{value: "100%", want: `100\%`},
+		{value: "a_b", want: `a\_b`},
+		{value: `a\b`, want: `a\\b`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			if got := escapeLike(tt.value); got != tt.want {
+				t.Errorf("escapeLike(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEmailCursor(t *testing.T) {
+	timestamp := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	gotTimestamp, gotID, err := decodeEmailCursor(encodeEmailCursor(timestamp, 42))
+	if err != nil {
+		t.Fatalf("decodeEmailCursor returned %v", err)
+	}
+	if !gotTimestamp.Equal(timestamp) || gotID != 42 {
+		t.Errorf("decoded cursor = (%v, %d), want (%v, 42)", gotTimestamp, gotID, timestamp)
+	}
+
+	encode := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+	invalid := []struct {
+		name   string
+		cursor string
+	}{
+		{name: "not base64", cursor: "!!!"},
+		{name: "no separator", cursor: encode("1709296200")},
+		{name: "too many parts", cursor: encode("1:2:3")},
+		{name: "bad timestamp", cursor: encode("now:42")},
+		{name: "bad id", cursor: encode("1709296200:x")},
+	}
+	for _, tt := range invalid {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := decodeEmailCursor(tt.cursor); err == nil {
+				t.Errorf("decodeEmailCursor(%q) returned no error", tt.cursor)
+			}
+		})
+	}
+}
@@ -0,0 +1,579 @@
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Triaksa-Space/be-mail-platform/config"
+	"github.com/Triaksa-Space/be-mail-platform/domain/user"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-imap/server"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	"github.com/spf13/viper"
+)
+
+var errIMAPReadOnly = errors.New("Mailboxes cannot be modified")
+
+// imapMailboxes maps IMAP mailbox names to emails.email_type.
+var imapMailboxes = []struct {
+	Name      string
+	EmailType string
+	Attribute string
+}{
+	{Name: "INBOX", EmailType: "inbox"},
+	{Name: "Sent", EmailType: "sent", Attribute: imap.SentAttr},
+}
+
+// imapBackend serves the emails table over IMAP4rev1 so that web and
+// desktop clients see the same mailbox.
+type imapBackend struct{}
+
+func (b *imapBackend) Login(connInfo *imap.ConnInfo, username, password string) (backend.User, error) {
+	u, err := user.Authenticate(strings.ToLower(username), password)
+	if err != nil {
+		if !errors.Is(err, user.ErrInvalidCredentials) && !errors.Is(err, user.ErrAccountLocked) {
+			fmt.Println("Failed to authenticate IMAP user", username, err)
+		}
+		return nil, backend.ErrInvalidCredentials
+	}
+
+	return &imapUser{id: u.ID, email: u.Email}, nil
+}
+
+type imapUser struct {
+	id    int64
+	email string
+}
+
+func (u *imapUser) Username() string {
+	return u.email
+}
+
+func (u *imapUser) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
+	var mailboxes []backend.Mailbox
+	for _, m := range imapMailboxes {
+		mailboxes = append(mailboxes, u.newMailbox(m.Name, m.EmailType, m.Attribute))
+	}
+	return mailboxes, nil
+}
+
+func (u *imapUser) GetMailbox(name string) (backend.Mailbox, error) {
+	for _, m := range imapMailboxes {
+		if strings.EqualFold(m.Name, name) {
+			return u.newMailbox(m.Name, m.EmailType, m.Attribute), nil
+		}
+	}
+	return nil, backend.ErrNoSuchMailbox
+}
+
+func (u *imapUser) CreateMailbox(name string) error {
+	return errIMAPReadOnly
+}
+
+func (u *imapUser) DeleteMailbox(name string) error {
+	return errIMAPReadOnly
+}
+
+func (u *imapUser) RenameMailbox(existingName, newName string) error {
+	return errIMAPReadOnly
+}
+
+func (u *imapUser) Logout() error {
+	return nil
+}
+
+func (u *imapUser) newMailbox(name, emailType, attribute string) *imapMailbox {
+	return &imapMailbox{
+		user:      u,
+		name:      name,
+		emailType: emailType,
+		attribute: attribute,
+		deleted:   map[int64]bool{},
+		cache:     map[int64][]byte{},
+		sizes:     map[int64]int{},
+	}
+}
+
+// imapMailbox is created per SELECT, so \Deleted flags, built messages and
+// their sizes live only for the duration of the session.
+type imapMailbox struct {
+	user      *imapUser
+	name      string
+	emailType string
+	attribute string
+	deleted   map[int64]bool
+	cache     map[int64][]byte
+	sizes     map[int64]int
+	loaded    *Email // Last email loaded by loadEmail
+}
+
+func (m *imapMailbox) Name() string {
+	return m.name
+}
+
+func (m *imapMailbox) Info() (*imap.MailboxInfo, error) {
+	info := &imap.MailboxInfo{
+		Delimiter: "/",
+		Name:      m.name,
+	}
+	if m.attribute != "" {
+		info.Attributes = []string{m.attribute}
+	}
+	return info, nil
+}
+
+func (m *imapMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	emails, err := m.listEmails()
+	if err != nil {
+		return nil, err
+	}
+
+	status := imap.NewMailboxStatus(m.name, items)
+	status.Flags = []string{imap.SeenFlag, imap.DeletedFlag}
+	status.PermanentFlags = []string{imap.SeenFlag, imap.DeletedFlag}
+
+	var unseen uint32
+	for i, email := range emails {
+		if !email.IsRead {
+			unseen++
+			if status.UnseenSeqNum == 0 {
+				status.UnseenSeqNum = uint32(i + 1)
+			}
+		}
+	}
+
+	for _, name := range items {
+		switch name {
+		case imap.StatusMessages:
+			status.Messages = uint32(len(emails))
+		case imap.StatusUidNext:
+			status.UidNext = 1
+			if len(emails) > 0 {
+				status.UidNext = uint32(emails[len(emails)-1].ID) + 1
+			}
+		case imap.StatusUidValidity:
+			// emails.id is never reused, so the UID validity never changes
+			status.UidValidity = 1
+		case imap.StatusRecent:
+			status.Recent = 0
+		case imap.StatusUnseen:
+			status.Unseen = unseen
+		}
+	}
+
+	return status, nil
+}
+
+func (m *imapMailbox) SetSubscribed(subscribed bool) error {
+	return nil
+}
+
+func (m *imapMailbox) Check() error {
+	return nil
+}
+
+func (m *imapMailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	defer close(ch)
+
+	emails, err := m.listEmails()
+	if err != nil {
+		return err
+	}
+
+	for i, email := range emails {
+		seqNum := uint32(i + 1)
+
+		id := seqNum
+		if uid {
+			id = uint32(email.ID)
+		}
+		if !seqSet.Contains(id) {
+			continue
+		}
+
+		fetched, err := m.fetchMessage(seqNum, email, items)
+		if err != nil {
+			fmt.Printf("Failed to fetch IMAP message %d: %v\n", email.ID, err)
+			continue
+		}
+
+		ch <- fetched
+	}
+
+	return nil
+}
+
+func (m *imapMailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	emails, err := m.listEmails()
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []uint32
+	for i, email := range emails {
+		seqNum := uint32(i + 1)
+
+		// Header criteria are matched without building the whole message
+		var raw []byte
+		if searchNeedsBody(criteria) {
+			raw, err = m.rawMessage(email)
+		} else {
+			raw, err = m.rawHeader(email)
+		}
+		if err != nil {
+			continue
+		}
+		entity, err := message.Read(bytes.NewReader(raw))
+		if err != nil {
+			continue
+		}
+
+		ok, err := backendutil.Match(entity, seqNum, uint32(email.ID), email.Timestamp, m.flags(email), criteria)
+		if err != nil || !ok {
+			continue
+		}
+
+		if uid {
+			ids = append(ids, uint32(email.ID))
+		} else {
+			ids = append(ids, seqNum)
+		}
+	}
+
+	return ids, nil
+}
+
+func (m *imapMailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	return errors.New("APPEND is not supported, messages are sent through the web application")
+}
+
+func (m *imapMailbox) UpdateMessagesFlags(uid bool, seqSet *imap.SeqSet, operation imap.FlagsOp, flags []string) error {
+	emails, err := m.listEmails()
+	if err != nil {
+		return err
+	}
+
+	for i, email := range emails {
+		id := uint32(i + 1)
+		if uid {
+			id = uint32(email.ID)
+		}
+		if !seqSet.Contains(id) {
+			continue
+		}
+
+		current := m.flags(email)
+		updated := backendutil.UpdateFlags(current, operation, flags)
+
+		isRead := hasFlag(updated, imap.SeenFlag)
+		if isRead != email.IsRead {
+			_, err := config.DB.Exec(`
+				UPDATE emails
+				SET is_read = ?
+				WHERE id = ? AND user_id = ?`, isRead, email.ID, m.user.id)
+			if err != nil {
+				return err
+			}
+			publishEmailEvent(m.user.id, EventEmailRead, email.ID)
+		}
+
+		m.deleted[email.ID] = hasFlag(updated, imap.DeletedFlag)
+	}
+
+	return nil
+}
+
+func (m *imapMailbox) CopyMessages(uid bool, seqSet *imap.SeqSet, dest string) error {
+	return errIMAPReadOnly
+}
+
+func (m *imapMailbox) Expunge() error {
+	for emailID, deleted := range m.deleted {
+		if !deleted {
+			continue
+		}
+
+		_, err := config.DB.Exec(`
+			DELETE FROM emails
+			WHERE id = ? AND user_id = ? AND email_type = ?`, emailID, m.user.id, m.emailType)
+		if err != nil {
+			return err
+		}
+		publishEmailEvent(m.user.id, EventEmailDeleted, emailID)
+
+		delete(m.deleted, emailID)
+		delete(m.cache, emailID)
+		delete(m.sizes, emailID)
+		if m.loaded != nil && m.loaded.ID == emailID {
+			m.loaded = nil
+		}
+	}
+
+	return nil
+}
+
+// listEmails returns the metadata of the emails in the mailbox. Clients poll
+// STATUS and FLAGS constantly, so the header fields and sources are only
+// loaded by loadEmail for the messages a command reads.
+func (m *imapMailbox) listEmails() ([]Email, error) {
+	var emails []Email
+	err := config.DB.Select(&emails, `SELECT id,
+			is_read,
+			email_type,
+			attachments,
+			timestamp
+		FROM emails
+		WHERE user_id = ? AND email_type = ?
+		ORDER BY id ASC`, m.user.id, m.emailType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch emails: %v", err)
+	}
+	return emails, nil
+}
+
+// loadEmail returns a listed email with its header fields, body and source.
+// The last one is kept, as a FETCH usually reads several items of the same
+// message.
+func (m *imapMailbox) loadEmail(email Email) (Email, error) {
+	if m.loaded != nil && m.loaded.ID == email.ID {
+		loaded := *m.loaded
+		loaded.IsRead = email.IsRead
+		return loaded, nil
+	}
+
+	var loaded Email
+	err := config.DB.Get(&loaded, `SELECT e.id,
+			e.is_read,
+			e.user_id,
+			e.sender_email,
+			e.sender_name,
+			e.subject,
+			e.body,
+			COALESCE(e.body_eml, r.email_data, '') AS body_eml,
+			e.email_type,
+			e.attachments,
+			COALESCE(e.message_id, '') AS message_id,
+			e.timestamp
+		FROM emails e
+		LEFT JOIN raw_emails r ON r.id = e.raw_email_id
+		WHERE e.id = ? AND e.user_id = ?`, email.ID, m.user.id)
+	if err != nil {
+		return Email{}, fmt.Errorf("failed to fetch email %d: %v", email.ID, err)
+	}
+
+	m.loaded = &loaded
+	loaded.IsRead = email.IsRead
+	return loaded, nil
+}
+
+func (m *imapMailbox) flags(email Email) []string {
+	var flags []string
+	if email.IsRead {
+		flags = append(flags, imap.SeenFlag)
+	}
+	if m.deleted[email.ID] {
+		flags = append(flags, imap.DeletedFlag)
+	}
+	return flags
+}
+
+func (m *imapMailbox) rawMessage(email Email) ([]byte, error) {
+	if raw, ok := m.cache[email.ID]; ok {
+		return raw, nil
+	}
+
+	email, err := m.loadEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := buildRawMessage(email, m.user.email)
+	if err != nil {
+		return nil, err
+	}
+	m.cache[email.ID] = raw
+	return raw, nil
+}
+
+// rawSize returns the RFC822.SIZE of an email, building it only when it is
+// already cached.
+func (m *imapMailbox) rawSize(email Email) (int, error) {
+	if raw, ok := m.cache[email.ID]; ok {
+		return len(raw), nil
+	}
+	if size, ok := m.sizes[email.ID]; ok {
+		return size, nil
+	}
+
+	email, err := m.loadEmail(email)
+	if err != nil {
+		return 0, err
+	}
+	size, err := rawMessageSize(email, m.user.email)
+	if err != nil {
+		return 0, err
+	}
+	m.sizes[email.ID] = size
+	return size, nil
+}
+
+// rawHeader returns the header block of an email, see rawMessageHeader.
+func (m *imapMailbox) rawHeader(email Email) ([]byte, error) {
+	email, err := m.loadEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	return rawMessageHeader(email, m.user.email), nil
+}
+
+// searchNeedsBody reports whether criteria look past the header, at the
+// text or the size of the message.
+func searchNeedsBody(criteria *imap.SearchCriteria) bool {
+	if len(criteria.Body) > 0 || len(criteria.Text) > 0 || criteria.Larger > 0 || criteria.Smaller > 0 {
+		return true
+	}
+	for _, not := range criteria.Not {
+		if searchNeedsBody(not) {
+			return true
+		}
+	}
+	for _, or := range criteria.Or {
+		if searchNeedsBody(or[0]) || searchNeedsBody(or[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *imapMailbox) fetchMessage(seqNum uint32, email Email, items []imap.FetchItem) (*imap.Message, error) {
+	fetched := imap.NewMessage(seqNum, items)
+
+	for _, item := range items {
+		switch item {
+		case imap.FetchFlags:
+			fetched.Flags = m.flags(email)
+		case imap.FetchInternalDate:
+			fetched.InternalDate = email.Timestamp
+		case imap.FetchUid:
+			fetched.Uid = uint32(email.ID)
+		case imap.FetchRFC822Size:
+			size, err := m.rawSize(email)
+			if err != nil {
+				return nil, err
+			}
+			fetched.Size = uint32(size)
+		case imap.FetchEnvelope:
+			raw, err := m.rawHeader(email)
+			if err != nil {
+				return nil, err
+			}
+			header, _, err := readHeaderAndBody(raw)
+			if err != nil {
+				return nil, err
+			}
+			fetched.Envelope, _ = backendutil.FetchEnvelope(header)
+		case imap.FetchBody, imap.FetchBodyStructure:
+			raw, err := m.rawMessage(email)
+			if err != nil {
+				return nil, err
+			}
+			header, body, err := readHeaderAndBody(raw)
+			if err != nil {
+				return nil, err
+			}
+			fetched.BodyStructure, _ = backendutil.FetchBodyStructure(header, body, item == imap.FetchBodyStructure)
+		default:
+			section, err := imap.ParseBodySectionName(item)
+			if err != nil {
+				break
+			}
+
+			// Message lists only ask for header fields
+			var raw []byte
+			if section.Specifier == imap.HeaderSpecifier && len(section.Path) == 0 {
+				raw, err = m.rawHeader(email)
+			} else {
+				raw, err = m.rawMessage(email)
+			}
+			if err != nil {
+				return nil, err
+			}
+			header, body, err := readHeaderAndBody(raw)
+			if err != nil {
+				return nil, err
+			}
+
+			literal, _ := backendutil.FetchBodySection(header, body, section)
+			fetched.Body[section] = literal
+
+			// Reading the body without PEEK marks the message as seen
+			if !section.Peek && !email.IsRead {
+				err = updateIsRead(fmt.Sprint(email.ID))
+				if err != nil {
+					fmt.Println("error updateIsRead", err)
+				}
+				email.IsRead = true
+				for _, fetchItem := range items {
+					if fetchItem == imap.FetchFlags {
+						fetched.Flags = m.flags(email)
+					}
+				}
+			}
+		}
+	}
+
+	return fetched, nil
+}
+
+func readHeaderAndBody(raw []byte) (textproto.Header, *bufio.Reader, error) {
+	body := bufio.NewReader(bytes.NewReader(raw))
+	header, err := textproto.ReadHeader(body)
+	return header, body, err
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// NewIMAPServer builds the IMAP server from configuration. STARTTLS is
+// advertised when IMAPD_TLS_CERT and IMAPD_TLS_KEY are set; without TLS the
+// server refuses to start unless IMAPD_ALLOW_INSECURE_AUTH is set, which
+// accepts plaintext LOGIN and is only meant for local development.
+func NewIMAPServer() (*server.Server, error) {
+	addr := viper.GetString("IMAPD_ADDR")
+	if addr == "" {
+		addr = ":1143"
+	}
+
+	s := server.New(&imapBackend{})
+	s.Addr = addr
+
+	certFile := viper.GetString("IMAPD_TLS_CERT")
+	keyFile := viper.GetString("IMAPD_TLS_KEY")
+	if certFile != "" && keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load IMAP TLS certificate: %v", err)
+		}
+		s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	} else if viper.GetBool("IMAPD_ALLOW_INSECURE_AUTH") {
+		fmt.Println("IMAPD_ALLOW_INSECURE_AUTH is set, passwords are accepted in plaintext")
+		s.AllowInsecureAuth = true
+	} else {
+		return nil, fmt.Errorf("IMAPD_TLS_CERT and IMAPD_TLS_KEY are required unless IMAPD_ALLOW_INSECURE_AUTH is set")
+	}
+
+	return s, nil
+}
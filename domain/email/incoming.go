@@ -0,0 +1,338 @@
+package email
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Triaksa-Space/be-mail-platform/config"
+	"github.com/Triaksa-Space/be-mail-platform/pkg"
+	"github.com/Triaksa-Space/be-mail-platform/utils"
+	"github.com/google/uuid"
+	"github.com/jhillyerd/enmime"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/spf13/viper"
+)
+
+const (
+	IncomingStatusPending    = "pending"
+	IncomingStatusProcessing = "processing"
+	IncomingStatusProcessed  = "processed"
+	IncomingStatusDead       = "dead"
+)
+
+const incomingBatchSize = 10
+
+// StartIncomingEmailWorkers starts the pool that turns incoming_emails rows
+// into emails rows. Every worker claims its own batch, so several sync
+// processes can run side by side.
+func StartIncomingEmailWorkers(workers int) {
+	for i := 0; i < workers; i++ {
+		go runIncomingEmailWorker(i + 1)
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for {
+			<-ticker.C
+			requeueStaleIncomingEmails()
+		}
+	}()
+}
+
+func runIncomingEmailWorker(workerID int) {
+	for {
+		claimed, err := processIncomingEmails(workerID)
+		if err != nil {
+			fmt.Printf("Incoming email worker %d: %v\n", workerID, err)
+		}
+		if claimed == 0 {
+			time.Sleep(2 * time.Second)
+		}
+	}
+}
+
+// processIncomingEmails claims a batch of pending rows and processes them,
+// returning how many rows were claimed.
+func processIncomingEmails(workerID int) (int, error) {
+	claim := uuid.New().String()
+
+	result, err := config.DB.Exec(`
+		UPDATE incoming_emails
+		SET status = ?, claimed_by = ?, claimed_at = NOW()
+		WHERE processed = FALSE
+			AND status = ?
+			AND (next_attempt_at IS NULL OR next_attempt_at <= NOW())
+		ORDER BY id ASC
+		LIMIT ?`,
+		IncomingStatusProcessing, claim, IncomingStatusPending, incomingBatchSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to claim incoming emails: %v", err)
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return 0, nil
+	}
+
+	var rawEmails []IncomingEmail
+	err = config.DB.Select(&rawEmails, `
+		SELECT i.id, i.message_id, i.email_send_to, i.raw_email_id,
+			COALESCE(i.email_data, r.email_data) AS email_data, i.attempts, i.claimed_by
+		FROM incoming_emails i
+		LEFT JOIN raw_emails r ON r.id = i.raw_email_id
+		WHERE i.claimed_by = ? AND i.status = ?`, claim, IncomingStatusProcessing)
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch claimed incoming emails: %v", err)
+	}
+
+	fmt.Printf("Incoming email worker %d claimed %d emails\n", workerID, len(rawEmails))
+	for _, rawEmail := range rawEmails {
+		processClaimedIncomingEmail(rawEmail)
+	}
+
+	return len(rawEmails), nil
+}
+
+// processClaimedIncomingEmail processes one claimed row and records the
+// outcome on it. A panic marks the row dead instead of leaving it claimed
+// until the stale claim is requeued and crashes the next worker.
+func processClaimedIncomingEmail(rawEmail IncomingEmail) {
+	// The batch was claimed at once, renew the claim before processing so
+	// the stale sweep cannot hand this row to another worker mid-batch
+	result, err := config.DB.Exec(`
+		UPDATE incoming_emails
+		SET claimed_at = NOW()
+		WHERE id = ? AND status = ? AND claimed_by = ?`,
+		rawEmail.ID, IncomingStatusProcessing, rawEmail.ClaimedBy)
+	if err != nil {
+		fmt.Printf("Failed to renew claim of incoming email %s: %v\n", rawEmail.MessageID, err)
+		return
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		fmt.Printf("Skipping incoming email %s, its claim was released\n", rawEmail.MessageID)
+		return
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Printf("Panic while processing incoming email %s: %v\n", rawEmail.MessageID, r)
+			markIncomingEmailFailed(rawEmail, pkg.PermanentError{Err: fmt.Errorf("panic: %v", r)})
+		}
+	}()
+
+	err = processIncomingEmail(rawEmail)
+	if errors.Is(err, errIncomingClaimReleased) {
+		fmt.Printf("Dropped incoming email %s, its claim was released\n", rawEmail.MessageID)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Failed to process incoming email %s: %v\n", rawEmail.MessageID, err)
+		markIncomingEmailFailed(rawEmail, err)
+		return
+	}
+
+	// Delivered rows are already marked in the delivery transaction, this
+	// covers quarantined and duplicate messages
+	if err := markIncomingEmailProcessed(config.DB, rawEmail); err != nil {
+		fmt.Printf("Failed to mark incoming email %s as processed: %v\n", rawEmail.MessageID, err)
+	}
+}
+
+// errIncomingClaimReleased reports that another worker took over a row, the
+// delivery transaction is rolled back rather than storing the email twice.
+var errIncomingClaimReleased = errors.New("claim of incoming email was released")
+
+// markIncomingEmailProcessed marks a row as done while the claim is held.
+func markIncomingEmailProcessed(db sqlx.Execer, rawEmail IncomingEmail) error {
+	result, err := db.Exec(`
+		UPDATE incoming_emails
+		SET processed = TRUE, processed_at = NOW(), status = ?, last_error = NULL, claimed_by = NULL
+		WHERE id = ? AND status = ? AND claimed_by = ?`,
+		IncomingStatusProcessed, rawEmail.ID, IncomingStatusProcessing, rawEmail.ClaimedBy)
+	if err != nil {
+		return err
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return errIncomingClaimReleased
+	}
+	return nil
+}
+
+// processIncomingEmail parses one raw message and stores it in the inbox of
+// the recipient.
+func processIncomingEmail(rawEmail IncomingEmail) error {
+	env, err := enmime.ReadEnvelope(bytes.NewReader(rawEmail.EmailData))
+	if err != nil {
+		return fmt.Errorf("failed to parse email: %v", err)
+	}
+
+	// Rows are queued per user under its delivery address, which resolves
+	// back to that user and the label of the plus-address
+	recipients, err := resolveLocalRecipients([]string{rawEmail.EmailSendTo})
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %v", rawEmail.EmailSendTo, err)
+	}
+	if len(recipients) == 0 {
+		// The mailbox went away since the message was queued
+		err = quarantineEmail(rawEmail.MessageID, rawEmail.EmailData, env, []string{rawEmail.EmailSendTo}, rawEmail.RawEmailID)
+		if err != nil {
+			return fmt.Errorf("no user for %s: %v", rawEmail.EmailSendTo, err)
+		}
+		return nil
+	}
+
+	// The row is marked processed together with the email, a crash after
+	// the insert cannot deliver the message a second time
+	_, err = deliverToMailbox(recipients[0], rawEmail.MessageID, env, rawEmail.EmailData, rawEmail.RawEmailID, func(tx *sqlx.Tx) error {
+		return markIncomingEmailProcessed(tx, rawEmail)
+	})
+	if err == errDuplicateEmail {
+		fmt.Println("Skipping duplicate email", rawEmail.MessageID, "for", rawEmail.EmailSendTo)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Bounce messages also mark the sent email they are about
+	recordBounceMessage(recipients[0].UserID, env)
+	return nil
+}
+
+// markIncomingEmailFailed schedules a retry with exponential backoff, or
+// moves the row to the dead-letter state once INCOMING_MAX_ATTEMPTS is hit.
+// Nothing is recorded once the claim of the row was released.
+func markIncomingEmailFailed(rawEmail IncomingEmail, cause error) {
+	maxAttempts := viper.GetInt("INCOMING_MAX_ATTEMPTS")
+	if maxAttempts <= 0 {
+		maxAttempts = 5
+	}
+
+	attempts := rawEmail.Attempts + 1
+	status := IncomingStatusPending
+	var permanent pkg.PermanentError
+	if attempts >= maxAttempts || errors.As(cause, &permanent) {
+		status = IncomingStatusDead
+	}
+
+	// 30s, 1m, 2m, 4m ... capped at one hour
+	backoff := 30 * time.Second << (attempts - 1)
+	if backoff > time.Hour || backoff <= 0 {
+		backoff = time.Hour
+	}
+
+	_, err := config.DB.Exec(`
+		UPDATE incoming_emails
+		SET status = ?,
+			attempts = ?,
+			last_error = ?,
+			next_attempt_at = NOW() + INTERVAL ? SECOND,
+			claimed_by = NULL
+		WHERE id = ? AND status = ? AND claimed_by = ?`,
+		status, attempts, cause.Error(), int(backoff.Seconds()),
+		rawEmail.ID, IncomingStatusProcessing, rawEmail.ClaimedBy)
+	if err != nil {
+		fmt.Printf("Failed to record failure of incoming email %s: %v\n", rawEmail.MessageID, err)
+	}
+}
+
+// requeueStaleIncomingEmails counts a claim held by a worker that died
+// mid-batch as a failed attempt, so that a message crashing or hanging every
+// worker ends up dead, and purges rows processed more than a week ago and the
+// raw sources no longer referenced.
+func requeueStaleIncomingEmails() {
+	// Stale rows are claimed over first, so a worker finishing one at the
+	// same time is not overwritten
+	claim := uuid.New().String()
+	_, err := config.DB.Exec(`
+		UPDATE incoming_emails
+		SET claimed_by = ?
+		WHERE status = ? AND claimed_at < NOW() - INTERVAL 10 MINUTE`, claim, IncomingStatusProcessing)
+	if err != nil {
+		fmt.Println("Failed to claim stale incoming emails:", err)
+	}
+
+	var stale []IncomingEmail
+	err = config.DB.Select(&stale, `
+		SELECT id, message_id, attempts, claimed_by
+		FROM incoming_emails
+		WHERE claimed_by = ? AND status = ?`, claim, IncomingStatusProcessing)
+	if err != nil {
+		fmt.Println("Failed to fetch stale incoming emails:", err)
+	}
+	for _, rawEmail := range stale {
+		markIncomingEmailFailed(rawEmail, errors.New("worker stopped while processing"))
+	}
+
+	_, err = config.DB.Exec(`
+		DELETE FROM incoming_emails
+		WHERE processed = TRUE AND processed_at < NOW() - INTERVAL 7 DAY`)
+	if err != nil {
+		fmt.Println("Failed to purge processed incoming emails:", err)
+	}
+
+	// Sources are shared by recipients, drop them once nothing points at them
+	_, err = config.DB.Exec(`
+		DELETE r FROM raw_emails r
+		WHERE r.created_at < NOW() - INTERVAL 1 DAY
+			AND NOT EXISTS (SELECT 1 FROM incoming_emails i WHERE i.raw_email_id = r.id)
+			AND NOT EXISTS (SELECT 1 FROM emails e WHERE e.raw_email_id = r.id)
+			AND NOT EXISTS (SELECT 1 FROM quarantined_emails q WHERE q.raw_email_id = r.id)`)
+	if err != nil {
+		fmt.Println("Failed to purge unreferenced raw emails:", err)
+	}
+}
+
+// ListIncomingEmailsHandler lists incoming_emails rows by status, the dead
+// letters by default.
+func ListIncomingEmailsHandler(c echo.Context) error {
+	status := c.QueryParam("status")
+	if status == "" {
+		status = IncomingStatusDead
+	}
+
+	var rawEmails []IncomingEmail
+	err := config.DB.Select(&rawEmails, `
+		SELECT id, message_id, email_send_to, email_date, created_at, status, attempts,
+			COALESCE(last_error, '') AS last_error, next_attempt_at, processed_at
+		FROM incoming_emails
+		WHERE status = ?
+		ORDER BY id DESC
+		LIMIT 100`, status)
+	if err != nil {
+		fmt.Println("Failed to fetch incoming emails", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch incoming emails"})
+	}
+	for i := range rawEmails {
+		rawEmails[i].IncomingEncodeID = utils.EncodeID(int(rawEmails[i].ID))
+	}
+
+	return c.JSON(http.StatusOK, rawEmails)
+}
+
+// RetryIncomingEmailHandler puts a dead letter back in the queue.
+func RetryIncomingEmailHandler(c echo.Context) error {
+	id, err := utils.DecodeID(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid incoming email ID"})
+	}
+
+	result, err := config.DB.Exec(`
+		UPDATE incoming_emails
+		SET status = ?, attempts = 0, next_attempt_at = NULL
+		WHERE id = ? AND status = ?`, IncomingStatusPending, id, IncomingStatusDead)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to retry incoming email"})
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Dead incoming email not found"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Incoming email queued for retry"})
+}
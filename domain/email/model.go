@@ -10,11 +10,18 @@ type Email struct {
 	UserID        int64     `db:"user_id"`
 	SenderEmail   string    `db:"sender_email"`
 	SenderName    string    `db:"sender_name"`
+	ToAddresses   string    `db:"to_addresses"`  // Comma separated, sent emails only
+	CcAddresses   string    `db:"cc_addresses"`  // Comma separated, sent emails only
+	BccAddresses  string    `db:"bcc_addresses"` // Comma separated, sent emails only
 	Subject       string    `db:"subject"`
 	Preview       string    `db:"preview"`
 	Body          string    `db:"body"`
 	BodyEml       string    `db:"body_eml"`
+	BodyText      string    `db:"body_text" json:"-"` // Plain text of the body, used for search
 	EmailType     string    `db:"email_type"`
+	Status        string    `db:"status"`      // Delivery status, sent emails only
+	LastError     string    `db:"last_error"`  // Last delivery error, sent emails only
+	Label         string    `db:"label"`       // Tag of the plus-address it was delivered to
 	Attachments   string    `db:"attachments"` // JSON format
 	MessageID     string    `db:"message_id"`  // Message ID from email provider
 	Timestamp     time.Time `db:"timestamp"`
@@ -41,7 +48,9 @@ type PEmail struct {
 
 type SendEmailRequest struct {
 	UserID      int          `json:"user_id"`
-	To          string       `json:"to" validate:"required,email"`
+	To          AddressList  `json:"to"`
+	Cc          AddressList  `json:"cc"`
+	Bcc         AddressList  `json:"bcc"`
 	Subject     string       `json:"subject"`
 	Body        string       `json:"body"`
 	Attachments []Attachment `json:"attachments"`
@@ -52,10 +61,14 @@ type DeleteAttachmentParam struct {
 }
 
 type SendEmailRequestURLAttachment struct {
-	To          string   `json:"to"`
-	Subject     string   `json:"subject"`
-	Body        string   `json:"body"`
-	Attachments []string `json:"attachments"` // URLs of the attachments
+	To          AddressList `json:"to"`
+	Cc          AddressList `json:"cc"`
+	Bcc         AddressList `json:"bcc"`
+	Subject     string      `json:"subject"`
+	Body        string      `json:"body"`
+	TextBody    string      `json:"text_body"`   // Generated from the body when empty
+	Attachments []string    `json:"attachments"` // URLs of the attachments
+	SendAt      string      `json:"send_at"`     // RFC 3339, sends right away when empty
 }
 
 // Convert timestamps to relative time
@@ -64,6 +77,24 @@ type EmailResponse struct {
 	From            string       `json:"From"`
 	ListAttachments []Attachment `json:"ListAttachments"`
 	RelativeTime    string       `json:"RelativeTime"`
+	Snippet         string       `json:"Snippet,omitempty"` // Highlighted search match
+}
+
+type PaginatedEmails struct {
+	Emails     []EmailResponse `json:"emails"`
+	NextCursor string          `json:"next_cursor"`
+	HasMore    bool            `json:"has_more"`
+}
+
+// SearchQuery is the parsed form of the q parameter of the search endpoint,
+// e.g. `invoice from:billing@acme.com has:attachment after:2024-12-01 is:unread`
+type SearchQuery struct {
+	Terms         []string
+	From          []string
+	HasAttachment bool
+	Before        *time.Time
+	After         *time.Time
+	IsUnread      *bool
 }
 
 type Attachment struct {
@@ -85,13 +116,203 @@ type ParsedEmail struct {
 }
 
 type SyncStats struct {
-	TotalEmails   int `json:"total_emails"`
-	NewEmails     int `json:"new_emails"`
-	SkippedEmails int `json:"skipped_emails"`
-	FailedEmails  int `json:"failed_emails"`
+	TotalEmails       int `json:"total_emails"`
+	NewEmails         int `json:"new_emails"`
+	SkippedEmails     int `json:"skipped_emails"`
+	FailedEmails      int `json:"failed_emails"`
+	QuarantinedEmails int `json:"quarantined_emails"`
+}
+
+func (s *SyncStats) add(o SyncStats) {
+	s.TotalEmails += o.TotalEmails
+	s.NewEmails += o.NewEmails
+	s.SkippedEmails += o.SkippedEmails
+	s.FailedEmails += o.FailedEmails
+	s.QuarantinedEmails += o.QuarantinedEmails
 }
 
 type EmailAddress struct {
 	Name    string `json:"name,omitempty"`
 	Address string `json:"address"`
 }
+
+// EmailEvent is a mailbox change pushed to clients by StreamEmailHandler.
+// The email fields are empty once the email has been deleted.
+type EmailEvent struct {
+	ID            int64     `db:"id" json:"id"`
+	UserID        int64     `db:"user_id" json:"-"`
+	EventType     string    `db:"event_type" json:"type"`
+	EmailID       int64     `db:"email_id" json:"-"`
+	EmailEncodeID string    `json:"email_encode_id"`
+	EmailType     string    `db:"email_type" json:"email_type,omitempty"`
+	IsRead        bool      `db:"is_read" json:"is_read"`
+	SenderEmail   string    `db:"sender_email" json:"sender_email,omitempty"`
+	SenderName    string    `db:"sender_name" json:"sender_name,omitempty"`
+	Subject       string    `db:"subject" json:"subject,omitempty"`
+	Preview       string    `db:"preview" json:"preview,omitempty"`
+	CreatedAt     time.Time `db:"created_at" json:"created_at"`
+}
+
+// IncomingEmail is a raw inbound message waiting in incoming_emails.
+type IncomingEmail struct {
+	IncomingEncodeID string     `db:"-" json:"incoming_encode_id"`
+	ID               int64      `db:"id" json:"-"`
+	MessageID        string     `db:"message_id" json:"message_id"`
+	EmailSendTo      string     `db:"email_send_to" json:"email_send_to"`
+	EmailData        []byte     `db:"email_data" json:"-"`
+	RawEmailID       *int64     `db:"raw_email_id" json:"-"`
+	EmailDate        time.Time  `db:"email_date" json:"email_date"`
+	Status           string     `db:"status" json:"status"`
+	Attempts         int        `db:"attempts" json:"attempts"`
+	LastError        string     `db:"last_error" json:"last_error"`
+	NextAttemptAt    *time.Time `db:"next_attempt_at" json:"next_attempt_at"`
+	ProcessedAt      *time.Time `db:"processed_at" json:"processed_at"`
+	CreatedAt        time.Time  `db:"created_at" json:"created_at"`
+	ClaimedBy        string     `db:"claimed_by" json:"-"`
+}
+
+// QuarantinedEmail is an inbound message no local mailbox accepted.
+type QuarantinedEmail struct {
+	QuarantineEncodeID string     `db:"-" json:"quarantine_encode_id"`
+	ID                 int64      `db:"id" json:"-"`
+	RawEmailID         int64      `db:"raw_email_id" json:"-"`
+	MessageID          string     `db:"message_id" json:"message_id"`
+	Recipients         string     `db:"recipients" json:"recipients"` // Comma separated
+	SenderEmail        string     `db:"sender_email" json:"sender_email"`
+	Subject            string     `db:"subject" json:"subject"`
+	EmailDate          *time.Time `db:"email_date" json:"email_date"`
+	CreatedAt          time.Time  `db:"created_at" json:"created_at"`
+}
+
+type QuarantinedEmailPreview struct {
+	QuarantinedEmail
+	From        []EmailAddress `json:"from"`
+	To          []EmailAddress `json:"to"`
+	Cc          []EmailAddress `json:"cc,omitempty"`
+	TextBody    string         `json:"text_body,omitempty"`
+	HTMLBody    string         `json:"html_body,omitempty"`
+	Attachments []string       `json:"attachments,omitempty"` // File names
+}
+
+type AssignQuarantinedEmailRequest struct {
+	UserID   string `json:"user_id"`  // Encoded ID of an existing user
+	Email    string `json:"email"`    // Existing user, or the user to create
+	Password string `json:"password"` // Required to create the user
+}
+
+type EmailThread struct {
+	ThreadEncodeID string    `json:"thread_encode_id"`
+	ThreadID       int64     `db:"thread_id" json:"-"`
+	MessageCount   int       `db:"message_count" json:"message_count"`
+	UnreadCount    int       `db:"unread_count" json:"unread_count"`
+	LastTimestamp  time.Time `db:"last_timestamp" json:"last_timestamp"`
+	LastEmailID    int64     `db:"last_email_id" json:"-"`
+	Subject        string    `json:"subject"`
+	SenderEmail    string    `json:"sender_email"`
+	SenderName     string    `json:"sender_name"`
+	Preview        string    `json:"preview"`
+	RelativeTime   string    `json:"relative_time"`
+}
+
+type PaginatedThreads struct {
+	Threads    []EmailThread `json:"threads"`
+	NextCursor string        `json:"next_cursor"`
+	HasMore    bool          `json:"has_more"`
+}
+
+type ThreadResponse struct {
+	ThreadEncodeID string          `json:"thread_encode_id"`
+	Subject        string          `json:"subject"`
+	MessageCount   int             `json:"message_count"`
+	UnreadCount    int             `json:"unread_count"`
+	Emails         []EmailResponse `json:"emails"`
+}
+
+type ReplyEmailRequest struct {
+	To   AddressList `json:"to"` // Forward only
+	Cc   AddressList `json:"cc"`
+	Bcc  AddressList `json:"bcc"`
+	Body string      `json:"body"`
+}
+
+type OutboundEmail struct {
+	ID        int64  `db:"id"`
+	EmailID   int64  `db:"email_id"`
+	UserID    int64  `db:"user_id"`
+	MessageID string `db:"message_id"`
+	Payload   []byte `db:"payload"`
+	Attempts  int    `db:"attempts"`
+	ClaimedBy string `db:"claimed_by"`
+}
+
+type ScheduledEmail struct {
+	EmailEncodeID string    `db:"-" json:"email_encode_id"`
+	ID            int64     `db:"id" json:"-"`
+	To            string    `db:"to_addresses" json:"to"`
+	Cc            string    `db:"cc_addresses" json:"cc"`
+	Bcc           string    `db:"bcc_addresses" json:"bcc"`
+	Subject       string    `db:"subject" json:"subject"`
+	Preview       string    `db:"preview" json:"preview"`
+	Body          string    `db:"body" json:"body"`
+	Attachments   string    `db:"attachments" json:"-"`
+	SendAt        time.Time `db:"send_at" json:"send_at"`
+	LastError     string    `db:"last_error" json:"last_error"` // Why the last dispatch was put off
+
+	ListAttachments []Attachment `db:"-" json:"attachments"`
+}
+
+// UpdateScheduledEmailRequest changes a scheduled email, fields left out are
+// kept.
+type UpdateScheduledEmailRequest struct {
+	To       *AddressList `json:"to"`
+	Cc       *AddressList `json:"cc"`
+	Bcc      *AddressList `json:"bcc"`
+	Subject  *string      `json:"subject"`
+	Body     *string      `json:"body"`
+	TextBody *string      `json:"text_body"`
+	SendAt   *string      `json:"send_at"`
+}
+
+type DraftEmail struct {
+	EmailEncodeID string    `db:"-" json:"email_encode_id"`
+	ID            int64     `db:"id" json:"-"`
+	To            string    `db:"to_addresses" json:"to"`
+	Cc            string    `db:"cc_addresses" json:"cc"`
+	Bcc           string    `db:"bcc_addresses" json:"bcc"`
+	Subject       string    `db:"subject" json:"subject"`
+	Preview       string    `db:"preview" json:"preview"`
+	Body          string    `db:"body" json:"body"`
+	Attachments   string    `db:"attachments" json:"-"`
+	UpdatedAt     time.Time `db:"updated_at" json:"updated_at"`
+
+	ListAttachments []Attachment `db:"-" json:"attachments"`
+}
+
+// DraftEmailRequest is the whole state of a draft, saved as is. Recipients
+// are only checked when the draft is sent.
+type DraftEmailRequest struct {
+	To          AddressList `json:"to"`
+	Cc          AddressList `json:"cc"`
+	Bcc         AddressList `json:"bcc"`
+	Subject     string      `json:"subject"`
+	Body        string      `json:"body"`
+	Attachments []string    `json:"attachments"` // URLs from UploadAttachmentHandler
+}
+
+type SuppressedRecipient struct {
+	SuppressionEncodeID string    `db:"-" json:"suppression_encode_id"`
+	ID                  int64     `db:"id" json:"-"`
+	Email               string    `db:"email" json:"email"`
+	Reason              string    `db:"reason" json:"reason"` // bounce or complaint
+	Detail              string    `db:"detail" json:"detail"` // Diagnostic code or feedback type
+	CreatedAt           time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt           time.Time `db:"updated_at" json:"updated_at"`
+}
+
+type DeliveryFailure struct {
+	Recipient  string    `db:"recipient" json:"recipient"`
+	Status     string    `db:"status" json:"status"` // Enhanced status code, e.g. 5.1.1
+	Diagnostic string    `db:"diagnostic" json:"diagnostic"`
+	Source     string    `db:"source" json:"source"` // ses or dsn
+	CreatedAt  time.Time `db:"created_at" json:"created_at"`
+}
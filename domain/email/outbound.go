@@ -0,0 +1,359 @@
+package email
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Triaksa-Space/be-mail-platform/config"
+	"github.com/Triaksa-Space/be-mail-platform/domain/user"
+	"github.com/Triaksa-Space/be-mail-platform/pkg"
+	"github.com/google/uuid"
+	"github.com/spf13/viper"
+)
+
+// Delivery states of sent emails, on both the emails row and its
+// outbound_emails entry.
+const (
+	OutboundStatusScheduled = "scheduled"
+	OutboundStatusQueued    = "queued"
+	OutboundStatusSending   = "sending"
+	OutboundStatusSent      = "sent"
+	OutboundStatusDeferred  = "deferred"
+	OutboundStatusFailed    = "failed"
+)
+
+const outboundBatchSize = 10
+
+// outboundPayload is what the queue keeps to build the message again on
+// every attempt.
+type outboundPayload struct {
+	Message pkg.Message
+	// Attachments are S3 URLs sent as download links, see pkg.WithAttachmentLinks
+	LinkAttachments bool `json:",omitempty"`
+}
+
+// enqueueEmail saves the sent row of a message and queues it for delivery in
+// one transaction, so nothing is sent without being recorded. With sendAt the
+// message waits as a scheduled email until DispatchScheduledEmails picks it
+// up. It returns the ID of the sent row and the Message-ID of the message.
+func enqueueEmail(userID int64, payload outboundPayload, preview string, attachmentsJSON []byte, sendAt *time.Time) (int64, string, error) {
+	// The Message-ID is fixed up front so that retries reuse it
+	if payload.Message.MessageID == "" {
+		payload.Message.MessageID = pkg.GenerateMessageID(payload.Message.From)
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	emailID, err := insertSentEmail(tx, userID, payload.Message, preview, attachmentsJSON)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to save email: %v", err)
+	}
+
+	if err := queueOutboundEmail(tx, emailID, userID, payload, sendAt); err != nil {
+		return 0, "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, "", fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return emailID, payload.Message.MessageID, nil
+}
+
+// queueOutboundEmail adds the outbound_emails entry of a saved sent row.
+// An email going out now takes its recipients from the send quota in the
+// same transaction, see user.ReserveSentEmails; a scheduled one is counted
+// when DispatchScheduledEmails queues it.
+func queueOutboundEmail(tx *sql.Tx, emailID, userID int64, payload outboundPayload, sendAt *time.Time) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode message: %v", err)
+	}
+
+	if sendAt == nil {
+		if err := user.ReserveSentEmails(tx, userID, payload.Message.From, payload.Message.Recipients.Count()); err != nil {
+			return err
+		}
+	}
+
+	status := OutboundStatusQueued
+	if sendAt != nil {
+		status = OutboundStatusScheduled
+		_, err = tx.Exec(`
+			UPDATE emails SET email_type = "scheduled", status = ?, timestamp = ? WHERE id = ?`,
+			status, sendAt.UTC(), emailID)
+		if err != nil {
+			return fmt.Errorf("failed to schedule email: %v", err)
+		}
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO outbound_emails (email_id, user_id, message_id, payload, status, next_attempt_at, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, NOW(), NOW())`,
+		emailID, userID, payload.Message.MessageID, data, status, sendAt)
+	if err != nil {
+		return fmt.Errorf("failed to queue email: %v", err)
+	}
+	return nil
+}
+
+// StartOutboundEmailWorkers starts the pool that delivers queued emails.
+// Rows are claimed like incoming_emails, so several sync processes can run
+// side by side.
+func StartOutboundEmailWorkers(workers int) {
+	for i := 0; i < workers; i++ {
+		go runOutboundEmailWorker(i + 1)
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for {
+			<-ticker.C
+			requeueStaleOutboundEmails()
+		}
+	}()
+}
+
+func runOutboundEmailWorker(workerID int) {
+	for {
+		claimed, err := processOutboundEmails(workerID)
+		if err != nil {
+			fmt.Printf("Outbound email worker %d: %v\n", workerID, err)
+		}
+		if claimed == 0 {
+			time.Sleep(2 * time.Second)
+		}
+	}
+}
+
+// processOutboundEmails claims a batch of due rows and delivers them,
+// returning how many rows were claimed.
+func processOutboundEmails(workerID int) (int, error) {
+	claim := uuid.New().String()
+
+	result, err := config.DB.Exec(`
+		UPDATE outbound_emails
+		SET status = ?, claimed_by = ?, claimed_at = NOW()
+		WHERE status IN (?, ?)
+			AND (next_attempt_at IS NULL OR next_attempt_at <= NOW())
+		ORDER BY id ASC
+		LIMIT ?`,
+		OutboundStatusSending, claim, OutboundStatusQueued, OutboundStatusDeferred, outboundBatchSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to claim outbound emails: %v", err)
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return 0, nil
+	}
+
+	var outboundEmails []OutboundEmail
+	err = config.DB.Select(&outboundEmails, `
+		SELECT id, email_id, user_id, message_id, payload, attempts, claimed_by
+		FROM outbound_emails
+		WHERE claimed_by = ? AND status = ?`, claim, OutboundStatusSending)
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch claimed outbound emails: %v", err)
+	}
+
+	fmt.Printf("Outbound email worker %d claimed %d emails\n", workerID, len(outboundEmails))
+	for _, outbound := range outboundEmails {
+		processClaimedOutboundEmail(outbound)
+	}
+
+	return len(outboundEmails), nil
+}
+
+// processClaimedOutboundEmail delivers one claimed row and records the
+// outcome. A panic fails the email instead of leaving it claimed until the
+// stale claim is requeued and crashes the next worker.
+func processClaimedOutboundEmail(outbound OutboundEmail) {
+	// The batch was claimed at once, renew the claim before sending so the
+	// stale sweep cannot hand this row to another worker mid-batch
+	result, err := config.DB.Exec(`
+		UPDATE outbound_emails
+		SET claimed_at = NOW()
+		WHERE id = ? AND status = ? AND claimed_by = ?`,
+		outbound.ID, OutboundStatusSending, outbound.ClaimedBy)
+	if err != nil {
+		fmt.Printf("Failed to renew claim of outbound email %d: %v\n", outbound.ID, err)
+		return
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		fmt.Printf("Skipping outbound email %d, its claim was released\n", outbound.ID)
+		return
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Printf("Panic while sending outbound email %d: %v\n", outbound.ID, r)
+			markOutboundEmailFailed(outbound, pkg.PermanentError{Err: fmt.Errorf("panic: %v", r)})
+		}
+	}()
+
+	setEmailDeliveryStatus(outbound.EmailID, OutboundStatusSending, "")
+
+	messageID, err := deliverOutboundEmail(outbound)
+	if err != nil {
+		fmt.Printf("Failed to send outbound email %d: %v\n", outbound.ID, err)
+		markOutboundEmailFailed(outbound, err)
+		return
+	}
+
+	if err := markOutboundEmailSent(outbound, messageID); err != nil {
+		fmt.Printf("Failed to mark outbound email %d as sent: %v\n", outbound.ID, err)
+	}
+}
+
+// markOutboundEmailSent records a delivered message, the sent row is only
+// touched while this worker still holds the claim.
+func markOutboundEmailSent(outbound OutboundEmail, messageID string) error {
+	tx, err := config.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE outbound_emails
+		SET status = ?, message_id = ?, sent_at = NOW(), last_error = NULL, claimed_by = NULL
+		WHERE id = ? AND status = ? AND claimed_by = ?`,
+		OutboundStatusSent, messageID, outbound.ID, OutboundStatusSending, outbound.ClaimedBy)
+	if err != nil {
+		return err
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		fmt.Printf("Outbound email %d was sent after its claim was released\n", outbound.ID)
+		return nil
+	}
+
+	// SES hands out its own Message-ID, replies refer to that one and
+	// notifications to the ID it was made from
+	var sesMessageID interface{}
+	if id := pkg.SESMessageID(messageID); id != "" {
+		sesMessageID = id
+	}
+	_, err = tx.Exec(`
+		UPDATE emails
+		SET status = ?, last_error = NULL, header_message_id = ?, ses_message_id = ?
+		WHERE id = ?`, OutboundStatusSent, messageID, sesMessageID, outbound.EmailID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// deliverOutboundEmail sends one queued message and returns its final
+// Message-ID.
+func deliverOutboundEmail(outbound OutboundEmail) (string, error) {
+	var payload outboundPayload
+	if err := json.Unmarshal(outbound.Payload, &payload); err != nil {
+		return "", pkg.PermanentError{Err: fmt.Errorf("invalid payload: %v", err)}
+	}
+
+	msg := payload.Message
+	if payload.LinkAttachments {
+		msg = pkg.WithAttachmentLinks(msg)
+	}
+	return sendMessage(msg)
+}
+
+// markOutboundEmailFailed schedules a retry with exponential backoff, or
+// fails the email once OUTBOUND_MAX_ATTEMPTS is hit or the transport rejected
+// it for good. Nothing is recorded once the claim of the row was released.
+func markOutboundEmailFailed(outbound OutboundEmail, cause error) {
+	maxAttempts := viper.GetInt("OUTBOUND_MAX_ATTEMPTS")
+	if maxAttempts <= 0 {
+		maxAttempts = 5
+	}
+
+	attempts := outbound.Attempts + 1
+	status := OutboundStatusDeferred
+	var permanent pkg.PermanentError
+	if attempts >= maxAttempts || errors.As(cause, &permanent) {
+		status = OutboundStatusFailed
+	}
+
+	// 30s, 1m, 2m, 4m ... capped at one hour
+	backoff := 30 * time.Second << (attempts - 1)
+	if backoff > time.Hour || backoff <= 0 {
+		backoff = time.Hour
+	}
+
+	result, err := config.DB.Exec(`
+		UPDATE outbound_emails
+		SET status = ?,
+			attempts = ?,
+			last_error = ?,
+			next_attempt_at = NOW() + INTERVAL ? SECOND,
+			claimed_by = NULL
+		WHERE id = ? AND status = ? AND claimed_by = ?`,
+		status, attempts, cause.Error(), int(backoff.Seconds()),
+		outbound.ID, OutboundStatusSending, outbound.ClaimedBy)
+	if err != nil {
+		fmt.Printf("Failed to record failure of outbound email %d: %v\n", outbound.ID, err)
+		return
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return
+	}
+
+	setEmailDeliveryStatus(outbound.EmailID, status, cause.Error())
+}
+
+// setEmailDeliveryStatus updates the status the user sees on the sent row.
+func setEmailDeliveryStatus(emailID int64, status, lastError string) {
+	var errorValue interface{}
+	if lastError != "" {
+		errorValue = lastError
+	}
+
+	_, err := config.DB.Exec("UPDATE emails SET status = ?, last_error = ? WHERE id = ?", status, errorValue, emailID)
+	if err != nil {
+		fmt.Printf("Failed to update status of email %d: %v\n", emailID, err)
+	}
+}
+
+// requeueStaleOutboundEmails counts a claim held by a worker that died
+// mid-batch as a failed attempt, so that a message crashing every worker
+// ends up failed, and purges the payloads of emails sent more than a week
+// ago.
+func requeueStaleOutboundEmails() {
+	// Stale rows are claimed over first, a worker renewing its claim at the
+	// same time then either keeps the row or skips it
+	claim := uuid.New().String()
+	_, err := config.DB.Exec(`
+		UPDATE outbound_emails
+		SET claimed_by = ?
+		WHERE status = ? AND claimed_at < NOW() - INTERVAL 10 MINUTE`, claim, OutboundStatusSending)
+	if err != nil {
+		fmt.Println("Failed to claim stale outbound emails:", err)
+	}
+
+	var stale []OutboundEmail
+	err = config.DB.Select(&stale, `
+		SELECT id, email_id, user_id, message_id, attempts, claimed_by
+		FROM outbound_emails
+		WHERE claimed_by = ? AND status = ?`, claim, OutboundStatusSending)
+	if err != nil {
+		fmt.Println("Failed to fetch stale outbound emails:", err)
+	}
+	for _, outbound := range stale {
+		markOutboundEmailFailed(outbound, errors.New("worker stopped while sending"))
+	}
+
+	_, err = config.DB.Exec(`
+		DELETE FROM outbound_emails
+		WHERE status = ? AND sent_at < NOW() - INTERVAL 7 DAY`, OutboundStatusSent)
+	if err != nil {
+		fmt.Println("Failed to purge sent outbound emails:", err)
+	}
+}
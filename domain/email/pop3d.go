@@ -0,0 +1,489 @@
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Triaksa-Space/be-mail-platform/config"
+	"github.com/Triaksa-Space/be-mail-platform/domain/user"
+	"github.com/spf13/viper"
+)
+
+// POP3Server serves the inbox of every user over POP3 (RFC 1939).
+type POP3Server struct {
+	Addr      string
+	TLSConfig *tls.Config
+}
+
+// NewPOP3Server builds the POP3 server from configuration. STLS is
+// advertised when POP3D_TLS_CERT and POP3D_TLS_KEY are set; without TLS the
+// server refuses to start unless POP3D_ALLOW_INSECURE_AUTH is set, which
+// accepts plaintext passwords and is only meant for local development.
+func NewPOP3Server() (*POP3Server, error) {
+	addr := viper.GetString("POP3D_ADDR")
+	if addr == "" {
+		addr = ":1110"
+	}
+
+	s := &POP3Server{Addr: addr}
+
+	certFile := viper.GetString("POP3D_TLS_CERT")
+	keyFile := viper.GetString("POP3D_TLS_KEY")
+	if certFile != "" && keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load POP3 TLS certificate: %v", err)
+		}
+		s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	} else if viper.GetBool("POP3D_ALLOW_INSECURE_AUTH") {
+		fmt.Println("POP3D_ALLOW_INSECURE_AUTH is set, passwords are accepted in plaintext")
+	} else {
+		return nil, fmt.Errorf("POP3D_TLS_CERT and POP3D_TLS_KEY are required unless POP3D_ALLOW_INSECURE_AUTH is set")
+	}
+
+	return s, nil
+}
+
+func (s *POP3Server) ListenAndServe() error {
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// pop3Message is one entry of the maildrop locked at PASS time. Only the
+// metadata is loaded up front, the message itself is built on RETR.
+type pop3Message struct {
+	email   Email
+	raw     []byte
+	size    int
+	deleted bool
+}
+
+type pop3Session struct {
+	server   *POP3Server
+	conn     net.Conn
+	reader   *bufio.Reader
+	writer   *bufio.Writer
+	tls      bool
+	username string
+	user     *user.User
+	messages []*pop3Message
+}
+
+func (s *POP3Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	session := &pop3Session{
+		server: s,
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		writer: bufio.NewWriter(conn),
+	}
+
+	session.ok("POP3 server ready")
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(10 * time.Minute))
+		line, err := session.reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		fields := strings.Fields(strings.TrimSpace(line))
+		if len(fields) == 0 {
+			session.err("Empty command")
+			continue
+		}
+
+		command := strings.ToUpper(fields[0])
+		args := fields[1:]
+
+		if command == "QUIT" {
+			session.quit()
+			return
+		}
+
+		if session.user == nil {
+			session.handleAuthorization(command, args)
+		} else {
+			session.handleTransaction(command, args)
+		}
+	}
+}
+
+func (p *pop3Session) handleAuthorization(command string, args []string) {
+	switch command {
+	case "CAPA":
+		p.ok("Capability list follows")
+		p.line("USER")
+		p.line("UIDL")
+		if p.server.TLSConfig != nil && !p.tls {
+			p.line("STLS")
+		}
+		p.line(".")
+	case "STLS":
+		if p.server.TLSConfig == nil || p.tls {
+			p.err("STLS not available")
+			return
+		}
+		p.ok("Begin TLS negotiation")
+		tlsConn := tls.Server(p.conn, p.server.TLSConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			fmt.Println("POP3 TLS handshake failed:", err)
+			return
+		}
+		p.conn = tlsConn
+		p.reader = bufio.NewReader(tlsConn)
+		p.writer = bufio.NewWriter(tlsConn)
+		p.tls = true
+	case "USER":
+		if !p.authAllowed() {
+			p.err("Must issue STLS first")
+			return
+		}
+		if len(args) != 1 {
+			p.err("Usage: USER name")
+			return
+		}
+		p.username = strings.ToLower(args[0])
+		p.ok("Send PASS")
+	case "PASS":
+		if p.username == "" {
+			p.err("Send USER first")
+			return
+		}
+		password := strings.Join(args, " ")
+		u, err := user.Authenticate(p.username, password)
+		if err != nil {
+			p.username = ""
+			if errors.Is(err, user.ErrAccountLocked) {
+				p.err("[AUTH] Account temporarily locked")
+				return
+			}
+			if !errors.Is(err, user.ErrInvalidCredentials) {
+				fmt.Println("Failed to authenticate POP3 user", err)
+				p.err("[SYS/TEMP] Internal server error")
+				return
+			}
+			p.err("[AUTH] Invalid email or password")
+			return
+		}
+
+		messages, err := loadPOP3Maildrop(u.ID)
+		if err != nil {
+			fmt.Println("Failed to load POP3 maildrop", err)
+			p.err("[SYS/TEMP] Unable to open maildrop")
+			return
+		}
+
+		p.user = &u
+		p.messages = messages
+		p.ok(fmt.Sprintf("Maildrop has %d messages", len(messages)))
+	default:
+		p.err("Unknown command")
+	}
+}
+
+func (p *pop3Session) handleTransaction(command string, args []string) {
+	switch command {
+	case "CAPA":
+		p.ok("Capability list follows")
+		p.line("USER")
+		p.line("UIDL")
+		p.line(".")
+	case "NOOP":
+		p.ok("")
+	case "STAT":
+		count, size := 0, 0
+		for _, msg := range p.messages {
+			if msg.deleted {
+				continue
+			}
+			msgSize, err := p.size(msg)
+			if err != nil {
+				p.err("Failed to read message")
+				return
+			}
+			count++
+			size += msgSize
+		}
+		p.ok(fmt.Sprintf("%d %d", count, size))
+	case "LIST":
+		if len(args) > 0 {
+			num, msg := p.message(args[0])
+			if msg == nil {
+				return
+			}
+			size, err := p.size(msg)
+			if err != nil {
+				p.err("Failed to read message")
+				return
+			}
+			p.ok(fmt.Sprintf("%d %d", num, size))
+			return
+		}
+		p.ok("Scan listing follows")
+		for i, msg := range p.messages {
+			if msg.deleted {
+				continue
+			}
+			size, err := p.size(msg)
+			if err != nil {
+				continue
+			}
+			p.line(fmt.Sprintf("%d %d", i+1, size))
+		}
+		p.line(".")
+	case "UIDL":
+		if len(args) > 0 {
+			num, msg := p.message(args[0])
+			if msg == nil {
+				return
+			}
+			p.ok(fmt.Sprintf("%d %d", num, msg.email.ID))
+			return
+		}
+		p.ok("Unique-id listing follows")
+		for i, msg := range p.messages {
+			if msg.deleted {
+				continue
+			}
+			p.line(fmt.Sprintf("%d %d", i+1, msg.email.ID))
+		}
+		p.line(".")
+	case "RETR":
+		if len(args) != 1 {
+			p.err("Usage: RETR msg")
+			return
+		}
+		_, msg := p.message(args[0])
+		if msg == nil {
+			return
+		}
+		raw, err := p.raw(msg)
+		if err != nil {
+			p.err("Failed to read message")
+			return
+		}
+		p.ok(fmt.Sprintf("%d octets", len(raw)))
+		p.multiline(raw)
+
+		if !msg.email.IsRead {
+			err = updateIsRead(strconv.FormatInt(msg.email.ID, 10))
+			if err != nil {
+				fmt.Println("error updateIsRead", err)
+			}
+			msg.email.IsRead = true
+		}
+	case "DELE":
+		if len(args) != 1 {
+			p.err("Usage: DELE msg")
+			return
+		}
+		num, msg := p.message(args[0])
+		if msg == nil {
+			return
+		}
+		msg.deleted = true
+		p.ok(fmt.Sprintf("Message %d deleted", num))
+	case "RSET":
+		for _, msg := range p.messages {
+			msg.deleted = false
+		}
+		p.ok("")
+	default:
+		p.err("Unknown command")
+	}
+}
+
+// quit enters the UPDATE state: messages marked with DELE are removed from
+// the emails table.
+func (p *pop3Session) quit() {
+	if p.user == nil {
+		p.ok("Bye")
+		return
+	}
+
+	for _, msg := range p.messages {
+		if !msg.deleted {
+			continue
+		}
+		_, err := config.DB.Exec(`
+			DELETE FROM emails
+			WHERE id = ? AND user_id = ? AND email_type = "inbox"`, msg.email.ID, p.user.ID)
+		if err != nil {
+			fmt.Printf("Failed to delete email %d: %v\n", msg.email.ID, err)
+			p.err("Some deleted messages not removed")
+			return
+		}
+		publishEmailEvent(p.user.ID, EventEmailDeleted, msg.email.ID)
+	}
+
+	p.ok("Bye")
+}
+
+func (p *pop3Session) authAllowed() bool {
+	return p.server.TLSConfig == nil || p.tls
+}
+
+// message resolves a message number argument, replying with -ERR when it is
+// invalid or already deleted.
+func (p *pop3Session) message(arg string) (int, *pop3Message) {
+	num, err := strconv.Atoi(arg)
+	if err != nil || num < 1 || num > len(p.messages) {
+		p.err("No such message")
+		return 0, nil
+	}
+	msg := p.messages[num-1]
+	if msg.deleted {
+		p.err("Message already deleted")
+		return 0, nil
+	}
+	return num, msg
+}
+
+func (p *pop3Session) raw(msg *pop3Message) ([]byte, error) {
+	if msg.raw != nil {
+		return msg.raw, nil
+	}
+
+	email, err := loadPOP3Email(p.user.ID, msg.email.ID)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := buildRawMessage(email, p.user.Email)
+	if err != nil {
+		return nil, err
+	}
+	msg.raw = normalizeCRLF(raw)
+	return msg.raw, nil
+}
+
+// size returns the size of a message for STAT and LIST without building
+// it. Stored sources are measured by loadPOP3Maildrop, reconstructed
+// messages already use CRLF line endings.
+func (p *pop3Session) size(msg *pop3Message) (int, error) {
+	if msg.raw != nil {
+		return len(msg.raw), nil
+	}
+	if msg.size > 0 {
+		return msg.size, nil
+	}
+
+	email, err := loadPOP3Email(p.user.ID, msg.email.ID)
+	if err != nil {
+		return 0, err
+	}
+	size, err := rawMessageSize(email, p.user.Email)
+	if err != nil {
+		return 0, err
+	}
+	msg.size = size
+	return size, nil
+}
+
+func (p *pop3Session) ok(message string) {
+	if message == "" {
+		p.line("+OK")
+		return
+	}
+	p.line("+OK " + message)
+}
+
+func (p *pop3Session) err(message string) {
+	p.line("-ERR " + message)
+}
+
+func (p *pop3Session) line(s string) {
+	p.writer.WriteString(s + "\r\n")
+	p.writer.Flush()
+}
+
+// multiline writes a dot-stuffed, CRLF-terminated response body.
+func (p *pop3Session) multiline(raw []byte) {
+	for _, l := range bytes.Split(bytes.TrimSuffix(raw, []byte("\r\n")), []byte("\r\n")) {
+		if bytes.HasPrefix(l, []byte(".")) {
+			p.writer.WriteString(".")
+		}
+		p.writer.Write(l)
+		p.writer.WriteString("\r\n")
+	}
+	p.writer.WriteString(".\r\n")
+	p.writer.Flush()
+}
+
+// loadPOP3Maildrop lists the inbox of a user with the size its stored
+// source has once normalizeCRLF turned bare LFs into CRLF, or 0 when the
+// message has to be reconstructed.
+func loadPOP3Maildrop(userID int64) ([]*pop3Message, error) {
+	var rows []struct {
+		ID     int64 `db:"id"`
+		IsRead bool  `db:"is_read"`
+		Size   int   `db:"size"`
+	}
+	err := config.DB.Select(&rows, `SELECT id,
+			is_read,
+			LENGTH(source)
+				+ (LENGTH(source) - LENGTH(REPLACE(source, CHAR(10), '')))
+				- (LENGTH(source) - LENGTH(REPLACE(source, CONCAT(CHAR(13), CHAR(10)), ''))) DIV 2 AS size
+		FROM (
+			SELECT e.id, e.is_read, COALESCE(e.body_eml, r.email_data, '') AS source
+			FROM emails e
+			LEFT JOIN raw_emails r ON r.id = e.raw_email_id
+			WHERE e.user_id = ? AND e.email_type = "inbox"
+		) inbox
+		ORDER BY id ASC`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]*pop3Message, len(rows))
+	for i, row := range rows {
+		messages[i] = &pop3Message{email: Email{ID: row.ID, IsRead: row.IsRead}, size: row.Size}
+	}
+	return messages, nil
+}
+
+// loadPOP3Email returns an inbox email with everything buildRawMessage
+// needs.
+func loadPOP3Email(userID, emailID int64) (Email, error) {
+	var email Email
+	err := config.DB.Get(&email, `SELECT e.id,
+			e.is_read,
+			e.user_id,
+			e.sender_email,
+			e.sender_name,
+			e.subject,
+			e.body,
+			COALESCE(e.body_eml, r.email_data, '') AS body_eml,
+			e.email_type,
+			e.attachments,
+			COALESCE(e.message_id, '') AS message_id,
+			e.timestamp
+		FROM emails e
+		LEFT JOIN raw_emails r ON r.id = e.raw_email_id
+		WHERE e.id = ? AND e.user_id = ? AND e.email_type = "inbox"`, emailID, userID)
+	return email, err
+}
+
+func normalizeCRLF(raw []byte) []byte {
+	raw = bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(raw, []byte("\n"), []byte("\r\n"))
+}
@@ -0,0 +1,327 @@
+package email
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Triaksa-Space/be-mail-platform/config"
+	"github.com/Triaksa-Space/be-mail-platform/domain/user"
+	"github.com/Triaksa-Space/be-mail-platform/utils"
+	"github.com/jhillyerd/enmime"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/spf13/viper"
+)
+
+// quarantineEmail keeps a message that no local user, alias or catch-all
+// accepts, so that a superadmin can inspect it and assign it to a mailbox.
+// The raw source is stored in raw_emails unless rawEmailID already points
+// at it. A message already in quarantine returns errDuplicateEmail.
+func quarantineEmail(messageID string, emailContent []byte, env *enmime.Envelope, recipients []string, rawEmailID *int64) error {
+	fp := fingerprintEmail(env, emailContent)
+
+	var quarantined bool
+	err := config.DB.Get(&quarantined, "SELECT EXISTS(SELECT 1 FROM quarantined_emails WHERE content_hash = ?)", fp.ContentHash)
+	if err != nil {
+		return fmt.Errorf("failed to check quarantine: %v", err)
+	}
+	if quarantined {
+		return errDuplicateEmail
+	}
+
+	if rawEmailID == nil {
+		id, err := insertRawEmail(config.DB, messageID, emailContent, fp)
+		if err != nil {
+			return err
+		}
+		rawEmailID = &id
+	}
+
+	var senderEmail string
+	if from := parseAddresses(env.GetHeader("From")); len(from) > 0 {
+		senderEmail = from[0].Address
+	}
+	var emailDate *time.Time
+	if dateT, err := env.Date(); err == nil {
+		emailDate = &dateT
+	}
+
+	subject := truncateRunes(env.GetHeader("Subject"), 255)
+
+	_, err = config.DB.Exec(`
+		INSERT INTO quarantined_emails (raw_email_id, content_hash, message_id, recipients, sender_email, subject, email_date, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, NOW())`,
+		*rawEmailID, fp.ContentHash, messageID, strings.Join(recipients, ","), senderEmail, subject, emailDate)
+	if err != nil {
+		return fmt.Errorf("failed to quarantine email: %v", err)
+	}
+
+	fmt.Println("Quarantined email", messageID, recipients)
+	return nil
+}
+
+// PurgeQuarantine deletes quarantined messages older than
+// QUARANTINE_RETENTION_DAYS (30 when unset). Their raw sources are dropped
+// by the housekeeping of the incoming email workers.
+func PurgeQuarantine() error {
+	days := 30
+	if viper.IsSet("QUARANTINE_RETENTION_DAYS") {
+		days = viper.GetInt("QUARANTINE_RETENTION_DAYS")
+	}
+	if days <= 0 {
+		return nil
+	}
+
+	result, err := config.DB.Exec(`
+		DELETE FROM quarantined_emails
+		WHERE created_at < NOW() - INTERVAL ? DAY`, days)
+	if err != nil {
+		return fmt.Errorf("failed to purge quarantine: %v", err)
+	}
+
+	if purged, _ := result.RowsAffected(); purged > 0 {
+		fmt.Printf("Purged %d quarantined emails\n", purged)
+	}
+	return nil
+}
+
+// ListQuarantinedEmailsHandler lists the quarantine, newest first. The
+// recipient query parameter filters on one of the original recipients.
+func ListQuarantinedEmailsHandler(c echo.Context) error {
+	query := `
+		SELECT id, message_id, recipients, COALESCE(sender_email, '') AS sender_email,
+			COALESCE(subject, '') AS subject, email_date, created_at
+		FROM quarantined_emails`
+	var args []interface{}
+
+	if recipient := strings.ToLower(strings.TrimSpace(c.QueryParam("recipient"))); recipient != "" {
+		query += " WHERE FIND_IN_SET(?, recipients) > 0"
+		args = append(args, recipient)
+	}
+	query += " ORDER BY id DESC LIMIT 100"
+
+	var emails []QuarantinedEmail
+	err := config.DB.Select(&emails, query, args...)
+	if err != nil {
+		fmt.Println("Failed to fetch quarantined emails", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch quarantined emails"})
+	}
+	for i := range emails {
+		emails[i].QuarantineEncodeID = utils.EncodeID(int(emails[i].ID))
+	}
+
+	return c.JSON(http.StatusOK, emails)
+}
+
+// GetQuarantinedEmailHandler previews a quarantined message.
+func GetQuarantinedEmailHandler(c echo.Context) error {
+	quarantined, content, err := getQuarantinedEmail(c.Param("id"))
+	if err != nil {
+		return quarantineErrorResponse(c, err)
+	}
+
+	env, err := enmime.ReadEnvelope(bytes.NewReader(content))
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": "Failed to parse email"})
+	}
+
+	preview := QuarantinedEmailPreview{
+		QuarantinedEmail: quarantined,
+		From:             parseAddresses(env.GetHeader("From")),
+		To:               parseAddresses(env.GetHeader("To")),
+		Cc:               parseAddresses(env.GetHeader("Cc")),
+		TextBody:         env.Text,
+		HTMLBody:         env.HTML,
+	}
+	for _, att := range env.Attachments {
+		preview.Attachments = append(preview.Attachments, att.FileName)
+	}
+
+	return c.JSON(http.StatusOK, preview)
+}
+
+// AssignQuarantinedEmailHandler delivers a quarantined message to an
+// existing user, given by user_id or email, or to a new user created from
+// email and password, and removes it from the quarantine.
+func AssignQuarantinedEmailHandler(c echo.Context) error {
+	adminID := c.Get("user_id").(int64)
+
+	req := new(AssignQuarantinedEmailRequest)
+	if err := c.Bind(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+	}
+
+	quarantined, content, err := getQuarantinedEmail(c.Param("id"))
+	if err != nil {
+		return quarantineErrorResponse(c, err)
+	}
+
+	env, err := enmime.ReadEnvelope(bytes.NewReader(content))
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": "Failed to parse email"})
+	}
+
+	recipient, status, err := assignmentRecipient(adminID, req)
+	if err != nil {
+		return c.JSON(status, map[string]string{"error": err.Error()})
+	}
+
+	// The message leaves quarantine with the delivery, so that two assigns
+	// at once cannot both deliver it
+	emailID, err := deliverToMailbox(recipient, quarantined.MessageID, env, content, &quarantined.RawEmailID, func(tx *sqlx.Tx) error {
+		result, err := tx.Exec("DELETE FROM quarantined_emails WHERE id = ?", quarantined.ID)
+		if err != nil {
+			return fmt.Errorf("failed to remove quarantined email: %v", err)
+		}
+		if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+			return sql.ErrNoRows
+		}
+		return nil
+	})
+	if err == errDuplicateEmail {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "User already has this email"})
+	}
+	if err == sql.ErrNoRows {
+		return quarantineErrorResponse(c, err)
+	}
+	if err != nil {
+		fmt.Println("Failed to deliver quarantined email", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to deliver email"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"message":  "Email assigned successfully",
+		"email_id": utils.EncodeID(int(emailID)),
+		"user_id":  utils.EncodeID(int(recipient.UserID)),
+	})
+}
+
+// DeleteQuarantinedEmailHandler drops a quarantined message.
+func DeleteQuarantinedEmailHandler(c echo.Context) error {
+	quarantineID, err := utils.DecodeID(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid quarantined email ID"})
+	}
+
+	result, err := config.DB.Exec("DELETE FROM quarantined_emails WHERE id = ?", quarantineID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete quarantined email"})
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Quarantined email not found"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Quarantined email deleted successfully"})
+}
+
+func getQuarantinedEmail(id string) (QuarantinedEmail, []byte, error) {
+	quarantineID, err := utils.DecodeID(id)
+	if err != nil {
+		return QuarantinedEmail{}, nil, sql.ErrNoRows
+	}
+
+	var quarantined struct {
+		QuarantinedEmail
+		EmailData []byte `db:"email_data"`
+	}
+	err = config.DB.Get(&quarantined, `
+		SELECT q.id, q.raw_email_id, q.message_id, q.recipients,
+			COALESCE(q.sender_email, '') AS sender_email, COALESCE(q.subject, '') AS subject,
+			q.email_date, q.created_at, r.email_data
+		FROM quarantined_emails q
+		JOIN raw_emails r ON r.id = q.raw_email_id
+		WHERE q.id = ?`, quarantineID)
+	if err != nil {
+		return QuarantinedEmail{}, nil, err
+	}
+	quarantined.QuarantineEncodeID = utils.EncodeID(int(quarantined.ID))
+
+	return quarantined.QuarantinedEmail, quarantined.EmailData, nil
+}
+
+func quarantineErrorResponse(c echo.Context, err error) error {
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Quarantined email not found"})
+	}
+	fmt.Println("Failed to fetch quarantined email", err)
+	return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch quarantined email"})
+}
+
+// assignmentRecipient finds or creates the user a quarantined message is
+// assigned to, returning the HTTP status to use on failure.
+func assignmentRecipient(adminID int64, req *AssignQuarantinedEmailRequest) (localRecipient, int, error) {
+	var recipient localRecipient
+
+	if req.UserID != "" {
+		userID, err := utils.DecodeID(req.UserID)
+		if err != nil {
+			return recipient, http.StatusBadRequest, fmt.Errorf("Invalid user ID")
+		}
+		err = config.DB.Get(&recipient, "SELECT id, email FROM users WHERE id = ?", userID)
+		if err != nil {
+			return recipient, http.StatusNotFound, fmt.Errorf("User not found")
+		}
+		return recipient, http.StatusOK, nil
+	}
+
+	address := strings.ToLower(strings.TrimSpace(req.Email))
+	if address == "" {
+		return recipient, http.StatusBadRequest, fmt.Errorf("user_id or email is required")
+	}
+	parsed, err := mail.ParseAddress(address)
+	if err != nil || parsed.Address != address {
+		return recipient, http.StatusBadRequest, fmt.Errorf("Invalid email address")
+	}
+
+	err = config.DB.Get(&recipient, "SELECT id, email FROM users WHERE email = ?", address)
+	if err == nil {
+		return recipient, http.StatusOK, nil
+	}
+	if err != sql.ErrNoRows {
+		return recipient, http.StatusInternalServerError, fmt.Errorf("Failed to fetch user")
+	}
+
+	// Unknown address, create the mailbox on one of our domains
+	var domainExists bool
+	domain := address[strings.LastIndex(address, "@")+1:]
+	err = config.DB.Get(&domainExists, "SELECT EXISTS(SELECT 1 FROM domains WHERE domain = ?)", domain)
+	if err != nil {
+		return recipient, http.StatusInternalServerError, fmt.Errorf("Failed to fetch domain")
+	}
+	if !domainExists {
+		return recipient, http.StatusBadRequest, fmt.Errorf("Domain %s is not configured", domain)
+	}
+	if len(req.Password) < 6 {
+		return recipient, http.StatusBadRequest, fmt.Errorf("A password of at least 6 characters is required to create the user")
+	}
+	hashedPassword, err := utils.HashPassword(req.Password)
+	if err != nil {
+		return recipient, http.StatusInternalServerError, fmt.Errorf("Failed to create user")
+	}
+	adminEmail, _ := getUserEmail(adminID)
+
+	userID, err := user.CreateMailboxUser(address, hashedPassword, adminID, adminEmail)
+	if err != nil {
+		fmt.Println("Failed to create user for quarantined email", err)
+		return recipient, http.StatusInternalServerError, fmt.Errorf("Failed to create user")
+	}
+
+	return localRecipient{UserID: userID, Email: address}, http.StatusOK, nil
+}
+
+// truncateRunes cuts s to at most n characters, the way VARCHAR columns
+// count them, without splitting a multi-byte character.
+func truncateRunes(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
@@ -0,0 +1,88 @@
+package email
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"github.com/Triaksa-Space/be-mail-platform/pkg"
+	"github.com/labstack/echo/v4"
+)
+
+var errNoRecipients = errors.New("At least one recipient is required")
+
+// AddressList is a list of addresses, given either as a JSON array or as a
+// comma separated string.
+type AddressList []string
+
+func (l *AddressList) UnmarshalJSON(data []byte) error {
+	var addresses []string
+	if err := json.Unmarshal(data, &addresses); err == nil {
+		*l = addresses
+		return nil
+	}
+
+	var address string
+	if err := json.Unmarshal(data, &address); err != nil {
+		return fmt.Errorf("address list must be a string or an array of strings")
+	}
+	*l = AddressList{address}
+	return nil
+}
+
+// parseRecipients validates the to, cc and bcc lists of an outbound email.
+// Every entry may hold several comma separated addresses. An address is kept
+// in the first list it appears in, so nobody gets the email twice.
+func parseRecipients(to, cc, bcc []string) (pkg.Recipients, error) {
+	seen := map[string]bool{}
+	parse := func(values []string) ([]string, error) {
+		var addresses []string
+		for _, value := range values {
+			if strings.TrimSpace(value) == "" {
+				continue
+			}
+			list, err := mail.ParseAddressList(value)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid recipient address: %s", value)
+			}
+			for _, addr := range list {
+				address := strings.ToLower(addr.Address)
+				if seen[address] {
+					continue
+				}
+				seen[address] = true
+				addresses = append(addresses, address)
+			}
+		}
+		return addresses, nil
+	}
+
+	var recipients pkg.Recipients
+	var err error
+	if recipients.To, err = parse(to); err != nil {
+		return recipients, err
+	}
+	if recipients.Cc, err = parse(cc); err != nil {
+		return recipients, err
+	}
+	if recipients.Bcc, err = parse(bcc); err != nil {
+		return recipients, err
+	}
+
+	if recipients.Count() == 0 {
+		return recipients, errNoRecipients
+	}
+	return recipients, nil
+}
+
+// formRecipients reads the to, cc and bcc fields of a form, each of them
+// either repeated or comma separated.
+func formRecipients(c echo.Context) (pkg.Recipients, error) {
+	form, err := c.FormParams()
+	if err != nil {
+		return pkg.Recipients{}, err
+	}
+	return parseRecipients(form["to"], form["cc"], form["bcc"])
+}
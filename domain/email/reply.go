@@ -0,0 +1,392 @@
+package email
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Triaksa-Space/be-mail-platform/config"
+	"github.com/Triaksa-Space/be-mail-platform/pkg"
+	"github.com/Triaksa-Space/be-mail-platform/utils"
+	"github.com/jhillyerd/enmime"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	replyModeReply    = "reply"
+	replyModeReplyAll = "reply_all"
+	replyModeForward  = "forward"
+)
+
+// maxReferences caps the References header, keeping the oldest id and the
+// most recent ones as RFC 5322 suggests for long threads.
+const maxReferences = 20
+
+var errAttachmentsNotStored = errors.New("The attachments of this email were not stored and cannot be forwarded")
+
+var (
+	replyPrefixPattern   = regexp.MustCompile(`(?i)^\s*re\s*:`)
+	forwardPrefixPattern = regexp.MustCompile(`(?i)^\s*(fwd?)\s*:`)
+)
+
+// originalEmail is the email a reply or forward refers to, with the headers
+// of its raw source when one was kept.
+type originalEmail struct {
+	ID              int64     `db:"id"`
+	ThreadID        int64     `db:"thread_id"`
+	SenderEmail     string    `db:"sender_email"`
+	SenderName      string    `db:"sender_name"`
+	ToAddresses     string    `db:"to_addresses"`
+	CcAddresses     string    `db:"cc_addresses"`
+	Subject         string    `db:"subject"`
+	Body            string    `db:"body"`
+	Attachments     string    `db:"attachments"`
+	EmailType       string    `db:"email_type"`
+	HeaderMessageID string    `db:"header_message_id"`
+	Timestamp       time.Time `db:"timestamp"`
+	BodyEml         []byte    `db:"body_eml"`
+
+	env *enmime.Envelope
+}
+
+// ReplyEmailHandler answers the sender of a received email, or the recipients
+// of a sent one.
+func ReplyEmailHandler(c echo.Context) error {
+	return respondToEmail(c, replyModeReply)
+}
+
+// ReplyAllEmailHandler answers the sender and every other recipient of an
+// email.
+func ReplyAllEmailHandler(c echo.Context) error {
+	return respondToEmail(c, replyModeReplyAll)
+}
+
+// ForwardEmailHandler forwards an email, with its attachments, to new
+// recipients.
+func ForwardEmailHandler(c echo.Context) error {
+	return respondToEmail(c, replyModeForward)
+}
+
+func respondToEmail(c echo.Context, mode string) error {
+	userID := c.Get("user_id").(int64)
+
+	emailIDDecode, err := utils.DecodeID(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid email ID"})
+	}
+
+	emailUser, err := getUserEmail(userID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to fetch user email",
+		})
+	}
+
+	var req ReplyEmailRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid request payload",
+		})
+	}
+
+	original, err := getOriginalEmail(int64(emailIDDecode), userID)
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Email not found"})
+	}
+	if err != nil {
+		fmt.Println("Failed to fetch original email", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch email"})
+	}
+
+	to, cc := []string(req.To), []string(req.Cc)
+	if mode != replyModeForward {
+		to, cc = replyRecipients(original, emailUser, mode == replyModeReplyAll)
+		if len(to) == 0 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Email has no address to reply to"})
+		}
+		cc = append(cc, req.Cc...)
+	}
+
+	recipients, err := parseRecipients(to, cc, req.Bcc)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	if err := checkSuppressedRecipients(recipients); err != nil {
+		return suppressionResponse(c, err)
+	}
+
+	// Check email limit, every recipient counts
+	if err := CheckEmailLimit(userID, recipients.Count()); err != nil {
+		return emailLimitResponse(c, err)
+	}
+
+	var subject, body string
+	var attachments []pkg.Attachment
+	if mode == replyModeForward {
+		subject = prefixSubject(original.Subject, "Fwd: ", forwardPrefixPattern)
+		body = req.Body + forwardedBody(original)
+
+		attachments, err = originalAttachments(original)
+		if err == errAttachmentsNotStored {
+			return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+		}
+		if err != nil {
+			fmt.Println("Failed to fetch original attachments", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch attachments"})
+		}
+		var totalBytes int64
+		for _, att := range attachments {
+			totalBytes += int64(len(att.Content))
+		}
+		if err := checkAttachmentBytes(userID, totalBytes); err != nil {
+			return emailLimitResponse(c, err)
+		}
+	} else {
+		subject = prefixSubject(original.Subject, "Re: ", replyPrefixPattern)
+		body = req.Body + quotedBody(original)
+	}
+
+	headers := map[string]string{}
+	references := original.references()
+	if messageID := original.messageID(); messageID != "" {
+		headers["In-Reply-To"] = "<" + messageID + ">"
+	}
+	if len(references) > 0 {
+		headers["References"] = "<" + strings.Join(references, "> <") + ">"
+	}
+
+	// A forward gets its own copy of the attachments, deleting either email
+	// must not remove the objects of the other
+	messageID := pkg.GenerateMessageID(emailUser)
+	attachmentURLs := []string{}
+	if mode == replyModeForward {
+		attachmentURLs, err = copyAttachments(attachments, messageID, userID)
+		if err != nil {
+			fmt.Println("Failed to copy forwarded attachments", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to copy attachments"})
+		}
+	}
+	attachmentsJSON, _ := json.Marshal(attachmentURLs)
+
+	// Save the email and queue it for delivery
+	payload := outboundPayload{
+		Message: pkg.Message{
+			MessageID:   messageID,
+			From:        emailUser,
+			Recipients:  recipients,
+			Subject:     subject,
+			HTMLBody:    body,
+			Headers:     headers,
+			Attachments: attachments,
+		},
+	}
+	emailID, _, err := enqueueEmail(userID, payload, generatePreview("", req.Body), attachmentsJSON, nil)
+	if isSendQuotaError(err) {
+		return emailLimitResponse(c, err)
+	}
+	if err != nil {
+		fmt.Println("Failed to queue email", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to queue email",
+		})
+	}
+
+	// Replies and forwards stay in the thread of the original
+	setEmailThread(emailID, original.ThreadID, subject)
+
+	// Update last login
+	err = updateLastLogin(userID)
+	if err != nil {
+		fmt.Println("error updateLastLogin", err)
+	}
+
+	return queuedEmailResponse(c, emailID)
+}
+
+func getOriginalEmail(emailID, userID int64) (*originalEmail, error) {
+	var original originalEmail
+	err := config.DB.Get(&original, `
+		SELECT e.id,
+			COALESCE(e.thread_id, e.id) AS thread_id,
+			e.sender_email,
+			e.sender_name,
+			COALESCE(e.to_addresses, '') AS to_addresses,
+			COALESCE(e.cc_addresses, '') AS cc_addresses,
+			COALESCE(e.subject, '') AS subject,
+			COALESCE(e.body, '') AS body,
+			COALESCE(e.attachments, '') AS attachments,
+			e.email_type,
+			COALESCE(e.header_message_id, '') AS header_message_id,
+			e.timestamp,
+			COALESCE(e.body_eml, r.email_data, '') AS body_eml
+		FROM emails e
+		LEFT JOIN raw_emails r ON r.id = e.raw_email_id
+		WHERE e.id = ? AND e.user_id = ? AND e.email_type IN ('inbox', 'sent')`, emailID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(original.BodyEml) > 0 {
+		env, err := enmime.ReadEnvelope(bytes.NewReader(original.BodyEml))
+		if err == nil {
+			original.env = env
+		}
+	}
+	return &original, nil
+}
+
+// header returns a header of the raw source, empty when none was kept.
+func (o *originalEmail) header(name string) string {
+	if o.env == nil {
+		return ""
+	}
+	return o.env.GetHeader(name)
+}
+
+func (o *originalEmail) messageID() string {
+	if o.HeaderMessageID != "" {
+		return o.HeaderMessageID
+	}
+	return normalizeMessageID(o.header("Message-ID"))
+}
+
+// references returns the References of a reply: those of the original
+// followed by the original itself.
+func (o *originalEmail) references() []string {
+	references := parseMessageIDs(o.header("References"))
+	if len(references) == 0 {
+		references = parseMessageIDs(o.header("In-Reply-To"))
+	}
+	if messageID := o.messageID(); messageID != "" {
+		references = append(references, messageID)
+	}
+	if len(references) > maxReferences {
+		references = append(references[:1], references[len(references)-maxReferences+1:]...)
+	}
+	return references
+}
+
+// replyRecipients returns the To and Cc of a reply. A received email is
+// answered to its Reply-To or sender, a sent one to its own recipients.
+// Reply-all copies the other recipients of the original, except the user.
+func replyRecipients(original *originalEmail, emailUser string, all bool) ([]string, []string) {
+	var to, cc []string
+	if original.EmailType == "sent" {
+		to = pkg.SplitAddresses(original.ToAddresses)
+		if all {
+			cc = pkg.SplitAddresses(original.CcAddresses)
+		}
+		return to, cc
+	}
+
+	if replyTo := parseAddresses(original.header("Reply-To")); len(replyTo) > 0 {
+		for _, addr := range replyTo {
+			to = append(to, addr.Address)
+		}
+	} else {
+		to = append(to, original.SenderEmail)
+	}
+
+	if all {
+		for _, header := range []string{"To", "Cc"} {
+			for _, addr := range parseAddresses(original.header(header)) {
+				if !strings.EqualFold(addr.Address, emailUser) {
+					cc = append(cc, addr.Address)
+				}
+			}
+		}
+	}
+	return to, cc
+}
+
+// prefixSubject adds "Re: " or "Fwd: " unless the subject already has it.
+func prefixSubject(subject, prefix string, existing *regexp.Regexp) string {
+	if existing.MatchString(subject) {
+		return subject
+	}
+	return prefix + subject
+}
+
+// originalBodyHTML returns the body of the original as HTML, escaping plain
+// text bodies.
+func originalBodyHTML(original *originalEmail) string {
+	if original.env != nil && original.env.HTML != "" {
+		return original.env.HTML
+	}
+	if original.env != nil && original.env.Text != "" {
+		return strings.ReplaceAll(html.EscapeString(original.env.Text), "\n", "<br>")
+	}
+	if strings.Contains(original.Body, "<") {
+		return original.Body
+	}
+	return strings.ReplaceAll(html.EscapeString(original.Body), "\n", "<br>")
+}
+
+func senderLine(original *originalEmail) string {
+	if original.SenderName != "" && original.SenderName != original.SenderEmail {
+		return fmt.Sprintf("%s &lt;%s&gt;", html.EscapeString(original.SenderName), html.EscapeString(original.SenderEmail))
+	}
+	return html.EscapeString(original.SenderEmail)
+}
+
+func quotedBody(original *originalEmail) string {
+	return fmt.Sprintf(`<br><div class="quote"><div>On %s, %s wrote:</div>`+
+		`<blockquote style="margin:0 0 0 .8ex;border-left:1px solid #ccc;padding-left:1ex">%s</blockquote></div>`,
+		original.Timestamp.Format("Mon, Jan 2, 2006 at 3:04 PM"), senderLine(original), originalBodyHTML(original))
+}
+
+func forwardedBody(original *originalEmail) string {
+	to := original.header("To")
+	if to == "" {
+		to = strings.ReplaceAll(original.ToAddresses, ",", ", ")
+	}
+	return fmt.Sprintf(`<br><div class="forward"><div>---------- Forwarded message ---------</div>`+
+		`<div>From: %s</div><div>Date: %s</div><div>Subject: %s</div><div>To: %s</div><br>%s</div>`,
+		senderLine(original), original.Timestamp.Format("Mon, Jan 2, 2006 at 3:04 PM"),
+		html.EscapeString(original.Subject), html.EscapeString(to), originalBodyHTML(original))
+}
+
+// originalAttachments downloads the attachments of the original from S3.
+// Emails sent with uploaded files only keep the file names, their content
+// is gone and errAttachmentsNotStored is returned.
+func originalAttachments(original *originalEmail) ([]pkg.Attachment, error) {
+	var attachments []pkg.Attachment
+	for _, att := range getAttachmentURLs(original.Attachments) {
+		if !strings.HasPrefix(att.URL, "https://") {
+			return nil, errAttachmentsNotStored
+		}
+		content, contentType, err := pkg.DownloadAttachment(att.URL)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", att.Filename, err)
+		}
+		attachments = append(attachments, pkg.Attachment{
+			Filename:    strings.SplitN(att.Filename, "?", 2)[0],
+			ContentType: contentType,
+			Content:     content,
+		})
+	}
+	return attachments, nil
+}
+
+// copyAttachments uploads the attachments of a forward under a key of its
+// own and returns their URLs.
+func copyAttachments(attachments []pkg.Attachment, messageID string, userID int64) ([]string, error) {
+	urls := []string{}
+	for _, att := range attachments {
+		key := fmt.Sprintf("attachments/%s/%d/%s", messageID, userID, att.Filename)
+		url, err := pkg.UploadAttachment(att.Content, key, att.ContentType)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", att.Filename, err)
+		}
+		urls = append(urls, url)
+	}
+	return urls, nil
+}
@@ -0,0 +1,145 @@
+package email
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Triaksa-Space/be-mail-platform/config"
+	"github.com/Triaksa-Space/be-mail-platform/domain/user"
+	"github.com/Triaksa-Space/be-mail-platform/pkg"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+type retentionEmail struct {
+	ID          int64     `db:"id"`
+	Attachments string    `db:"attachments"`
+	Size        int64     `db:"size"`
+	Timestamp   time.Time `db:"timestamp"`
+}
+
+// EnforceRetentionPolicies applies the retention policy of every user to
+// their inbox, deleting the oldest emails and their S3 attachments once a
+// mailbox exceeds its max count, max age or max total bytes. The size of an
+// email is the size of its raw source, or of its body when none was kept.
+func EnforceRetentionPolicies() error {
+	var users []struct {
+		ID    int64  `db:"id"`
+		Email string `db:"email"`
+	}
+	err := config.DB.Select(&users, "SELECT id, email FROM users")
+	if err != nil {
+		return fmt.Errorf("failed to fetch users: %v", err)
+	}
+
+	sess, err := pkg.InitAWS()
+	if err != nil {
+		return fmt.Errorf("failed to initialize AWS session: %v", err)
+	}
+	s3Client := s3.New(sess)
+
+	for _, u := range users {
+		policy, err := user.GetRetentionPolicy(u.ID, u.Email)
+		if err != nil {
+			fmt.Printf("Failed to get retention policy for user %d: %v\n", u.ID, err)
+			continue
+		}
+		if policy.MaxCount == nil && policy.MaxAgeDays == nil && policy.MaxBytes == nil {
+			continue
+		}
+
+		deleted, err := enforceRetentionPolicy(s3Client, u.ID, policy)
+		if err != nil {
+			fmt.Printf("Failed to enforce retention policy for user %d: %v\n", u.ID, err)
+			continue
+		}
+		if deleted > 0 {
+			fmt.Printf("Retention deleted %d emails for user %d (%s policy)\n", deleted, u.ID, policy.Source)
+		}
+	}
+
+	return nil
+}
+
+func enforceRetentionPolicy(s3Client *s3.S3, userID int64, policy user.RetentionPolicy) (int, error) {
+	var emails []retentionEmail
+	err := config.DB.Select(&emails, `
+		SELECT e.id,
+			COALESCE(e.attachments, '') AS attachments,
+			COALESCE(LENGTH(e.body_eml), LENGTH(r.email_data), LENGTH(e.body), 0) AS size,
+			e.timestamp
+		FROM emails e
+		LEFT JOIN raw_emails r ON r.id = e.raw_email_id
+		WHERE e.user_id = ? AND e.email_type = 'inbox'
+		ORDER BY e.timestamp DESC, e.id DESC`, userID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch emails: %v", err)
+	}
+
+	expired := expiredEmails(emails, policy, time.Now())
+
+	deleted := 0
+	for _, email := range expired {
+		deleteAttachmentObjects(s3Client, email.Attachments)
+
+		_, err := config.DB.Exec("DELETE FROM emails WHERE id = ? AND user_id = ?", email.ID, userID)
+		if err != nil {
+			return deleted, fmt.Errorf("failed to delete email %d: %v", email.ID, err)
+		}
+		publishEmailEvent(userID, EventEmailDeleted, email.ID)
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+// expiredEmails returns the emails, ordered newest first, that fall outside
+// the policy. The newest emails are kept as long as they fit every limit;
+// the first one that does not is expired together with everything older.
+func expiredEmails(emails []retentionEmail, policy user.RetentionPolicy, now time.Time) []retentionEmail {
+	var totalBytes int64
+
+	for i, email := range emails {
+		if policy.MaxCount != nil && i >= *policy.MaxCount {
+			return emails[i:]
+		}
+		if policy.MaxAgeDays != nil && email.Timestamp.Before(now.AddDate(0, 0, -*policy.MaxAgeDays)) {
+			return emails[i:]
+		}
+		if policy.MaxBytes != nil && totalBytes+email.Size > *policy.MaxBytes {
+			return emails[i:]
+		}
+		totalBytes += email.Size
+	}
+
+	return nil
+}
+
+// deleteAttachmentObjects removes the S3 objects referenced by an emails row.
+// Failures are logged so that a missing object never blocks the deletion.
+func deleteAttachmentObjects(s3Client *s3.S3, attachmentsJSON string) {
+	if attachmentsJSON == "" {
+		return
+	}
+
+	for _, att := range getAttachmentURLs(attachmentsJSON) {
+		parsedURL, err := url.Parse(att.URL)
+		if err != nil {
+			fmt.Printf("Invalid attachment URL %s: %v\n", att.URL, err)
+			continue
+		}
+
+		bucket := strings.Split(parsedURL.Host, ".")[0]
+		key := strings.TrimPrefix(parsedURL.Path, "/")
+
+		_, err = s3Client.DeleteObject(&s3.DeleteObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			fmt.Printf("Failed to delete attachment %s: %v\n", att.URL, err)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package email
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Triaksa-Space/be-mail-platform/domain/user"
+)
+
+func TestExpiredEmails(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	intPtr := func(v int) *int { return &v }
+	int64Ptr := func(v int64) *int64 { return &v }
+
+	// Newest first, like enforceRetentionPolicy fetches them
+	emails := []retentionEmail{
+		{ID: 5, Size: 100, Timestamp: now.AddDate(0, 0, -1)},
+		{ID: 4, Size: 500, Timestamp: now.AddDate(0, 0, -2)},
+		{ID: 3, Size: 50, Timestamp: now.AddDate(0, 0, -10)},
+		{ID: 2, Size: 50, Timestamp: now.AddDate(0, 0, -20)},
+		{ID: 1, Size: 10, Timestamp: now.AddDate(0, 0, -40)},
+	}
+
+	tests := []struct {
+		name   string
+		policy user.RetentionPolicy
+		want   []int64
+	}{
+		{name: "no limits", policy: user.RetentionPolicy{}, want: nil},
+		{name: "max count", policy: user.RetentionPolicy{MaxCount: intPtr(2)}, want: []int64{3, 2, 1}},
+		{name: "max count zero", policy: user.RetentionPolicy{MaxCount: intPtr(0)}, want: []int64{5, 4, 3, 2, 1}},
+		{name: "max age", policy: user.RetentionPolicy{MaxAgeDays: intPtr(15)}, want: []int64{2, 1}},
+		{name: "max bytes fits all", policy: user.RetentionPolicy{MaxBytes: int64Ptr(710)}, want: nil},
+		{name: "max bytes expires older smaller emails", policy: user.RetentionPolicy{MaxBytes: int64Ptr(200)}, want: []int64{4, 3, 2, 1}},
+		{name: "max bytes on the boundary", policy: user.RetentionPolicy{MaxBytes: int64Ptr(600)}, want: []int64{3, 2, 1}},
+		{name: "tightest limit wins", policy: user.RetentionPolicy{MaxCount: intPtr(4), MaxAgeDays: intPtr(5), MaxBytes: int64Ptr(1000)}, want: []int64{3, 2, 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []int64
+			for _, email := range expiredEmails(emails, tt.policy, now) {
+				got = append(got, email.ID)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expiredEmails() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
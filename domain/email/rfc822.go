@@ -0,0 +1,329 @@
+package email
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Triaksa-Space/be-mail-platform/pkg"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/spf13/viper"
+)
+
+var htmlTagPattern = regexp.MustCompile(`<[a-zA-Z][^>]*>`)
+
+// rawAttachment is an attachment of a reconstructed message. Content is
+// nil when only the size of the message is wanted.
+type rawAttachment struct {
+	Filename    string
+	ContentType string
+	Size        int64
+	Content     []byte
+}
+
+// buildRawMessage returns the RFC 5322 message for a stored emails row so
+// that mail clients (IMAP/POP3) can read it. The original source in body_eml
+// is used when available; otherwise the message is reconstructed and
+// attachments are downloaded from S3, skipping any that cannot be fetched.
+// Listing a mailbox should use rawMessageSize and rawMessageHeader instead.
+func buildRawMessage(email Email, mailboxAddress string) ([]byte, error) {
+	if email.BodyEml != "" {
+		return []byte(email.BodyEml), nil
+	}
+
+	attachments, err := rawAttachments(email, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw bytes.Buffer
+	if _, err := writeRawMessage(&raw, email, mailboxAddress, attachments); err != nil {
+		return nil, err
+	}
+	return raw.Bytes(), nil
+}
+
+// rawMessageSize returns the length of the message buildRawMessage builds
+// without downloading the attachments: their sizes come from S3 and the
+// length of their base64 encoding is computed.
+func rawMessageSize(email Email, mailboxAddress string) (int, error) {
+	if email.BodyEml != "" {
+		return len(email.BodyEml), nil
+	}
+
+	attachments, err := rawAttachments(email, false)
+	if err != nil {
+		return 0, err
+	}
+
+	var raw bytes.Buffer
+	skipped, err := writeRawMessage(&raw, email, mailboxAddress, attachments)
+	if err != nil {
+		return 0, err
+	}
+	return raw.Len() + int(skipped), nil
+}
+
+// rawMessageHeader returns the header block of the message, which is all
+// ENVELOPE, BODY[HEADER] and header searches need.
+func rawMessageHeader(email Email, mailboxAddress string) []byte {
+	if email.BodyEml != "" {
+		raw := []byte(email.BodyEml)
+		end := len(raw)
+		for _, separator := range []string{"\r\n\r\n", "\n\n"} {
+			if i := bytes.Index(raw, []byte(separator)); i >= 0 && i+len(separator) < end {
+				end = i + len(separator)
+			}
+		}
+		return raw[:end]
+	}
+
+	var raw bytes.Buffer
+	writeMIMEHeader(&raw, rawMessageHeaderFields(email, mailboxAddress))
+	return raw.Bytes()
+}
+
+func rawMessageHeaderFields(email Email, mailboxAddress string) textproto.MIMEHeader {
+	from := mail.Address{Name: email.SenderName, Address: email.SenderEmail}
+
+	header := textproto.MIMEHeader{}
+	header.Set("From", from.String())
+	if email.EmailType == "inbox" {
+		header.Set("To", mailboxAddress)
+	}
+	header.Set("Subject", mime.QEncoding.Encode("utf-8", email.Subject))
+	header.Set("Date", email.Timestamp.Format(time.RFC1123Z))
+	header.Set("Message-ID", rfc822MessageID(email))
+	header.Set("MIME-Version", "1.0")
+	return header
+}
+
+// rawAttachments looks up the S3 attachments of an emails row with a single
+// client, downloading them when withContent is set.
+func rawAttachments(email Email, withContent bool) ([]rawAttachment, error) {
+	urls := getAttachmentURLs(email.Attachments)
+	if len(urls) == 0 {
+		return nil, nil
+	}
+
+	s3Client, err := newInboundS3Client()
+	if err != nil {
+		return nil, err
+	}
+
+	var attachments []rawAttachment
+	for _, att := range urls {
+		var attachment rawAttachment
+		var err error
+		if withContent {
+			attachment, err = downloadAttachment(s3Client, att.URL)
+		} else {
+			attachment, err = statAttachment(s3Client, att.URL)
+		}
+		if err != nil {
+			fmt.Printf("Failed to fetch attachment %s: %v\n", att.URL, err)
+			continue
+		}
+		attachment.Filename = att.Filename
+		attachments = append(attachments, attachment)
+	}
+	return attachments, nil
+}
+
+// writeRawMessage writes the reconstructed message. Attachments without
+// Content are left out; it returns how many bytes they would have taken.
+func writeRawMessage(raw *bytes.Buffer, email Email, mailboxAddress string, attachments []rawAttachment) (int64, error) {
+	header := rawMessageHeaderFields(email, mailboxAddress)
+
+	bodyContentType := "text/plain; charset=UTF-8"
+	if htmlTagPattern.MatchString(email.Body) {
+		bodyContentType = "text/html; charset=UTF-8"
+	}
+
+	if len(attachments) == 0 {
+		header.Set("Content-Type", bodyContentType)
+		header.Set("Content-Transfer-Encoding", "quoted-printable")
+		writeMIMEHeader(raw, header)
+
+		qp := quotedprintable.NewWriter(raw)
+		if _, err := qp.Write([]byte(email.Body)); err != nil {
+			return 0, err
+		}
+		qp.Close()
+		return 0, nil
+	}
+
+	writer := multipart.NewWriter(raw)
+	header.Set("Content-Type", fmt.Sprintf("multipart/mixed; boundary=\"%s\"", writer.Boundary()))
+	writeMIMEHeader(raw, header)
+
+	bodyHeader := textproto.MIMEHeader{}
+	bodyHeader.Set("Content-Type", bodyContentType)
+	bodyHeader.Set("Content-Transfer-Encoding", "quoted-printable")
+	bodyPart, err := writer.CreatePart(bodyHeader)
+	if err != nil {
+		return 0, err
+	}
+	qp := quotedprintable.NewWriter(bodyPart)
+	if _, err := qp.Write([]byte(email.Body)); err != nil {
+		return 0, err
+	}
+	qp.Close()
+
+	var skipped int64
+	for _, att := range attachments {
+		filename := mime.QEncoding.Encode("utf-8", att.Filename)
+
+		attHeader := textproto.MIMEHeader{}
+		attHeader.Set("Content-Type", fmt.Sprintf("%s; name=\"%s\"", att.ContentType, filename))
+		attHeader.Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
+		attHeader.Set("Content-Transfer-Encoding", "base64")
+
+		attPart, err := writer.CreatePart(attHeader)
+		if err != nil {
+			return 0, err
+		}
+		if att.Content == nil {
+			skipped += base64LinesLength(att.Size)
+			continue
+		}
+		if err := writeBase64Lines(attPart, att.Content); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return 0, err
+	}
+
+	return skipped, nil
+}
+
+// rfc822MessageID returns the stored Message-ID when it looks like one,
+// otherwise a stable ID derived from the emails row.
+func rfc822MessageID(email Email) string {
+	if strings.HasPrefix(email.MessageID, "<") && strings.HasSuffix(email.MessageID, ">") {
+		return email.MessageID
+	}
+
+	domain := "localhost"
+	if parts := strings.Split(email.SenderEmail, "@"); len(parts) == 2 {
+		domain = parts[1]
+	}
+	return fmt.Sprintf("<%d.%d@%s>", email.ID, email.Timestamp.Unix(), domain)
+}
+
+func writeMIMEHeader(w io.Writer, header textproto.MIMEHeader) {
+	for _, key := range []string{"From", "To", "Subject", "Date", "Message-ID", "MIME-Version", "Content-Type", "Content-Transfer-Encoding"} {
+		if value := header.Get(key); value != "" {
+			fmt.Fprintf(w, "%s: %s\r\n", key, value)
+		}
+	}
+	fmt.Fprint(w, "\r\n")
+}
+
+// writeBase64Lines writes base64 content wrapped at 76 characters per line.
+func writeBase64Lines(w io.Writer, content []byte) error {
+	encoded := base64.StdEncoding.EncodeToString(content)
+	for len(encoded) > 76 {
+		if _, err := io.WriteString(w, encoded[:76]+"\r\n"); err != nil {
+			return err
+		}
+		encoded = encoded[76:]
+	}
+	_, err := io.WriteString(w, encoded+"\r\n")
+	return err
+}
+
+// base64LinesLength is how many bytes writeBase64Lines writes for size
+// bytes of content.
+func base64LinesLength(size int64) int64 {
+	encoded := (size + 2) / 3 * 4
+	lines := (encoded + 75) / 76
+	if lines == 0 {
+		lines = 1
+	}
+	return encoded + 2*lines
+}
+
+// downloadAttachment fetches an attachment stored in S3 by its public URL.
+func downloadAttachment(s3Client *s3.S3, attachmentURL string) (rawAttachment, error) {
+	bucket, key, err := attachmentObject(attachmentURL)
+	if err != nil {
+		return rawAttachment{}, err
+	}
+
+	output, err := s3Client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return rawAttachment{}, fmt.Errorf("failed to get file from S3: %v", err)
+	}
+	defer output.Body.Close()
+
+	content, err := io.ReadAll(output.Body)
+	if err != nil {
+		return rawAttachment{}, err
+	}
+
+	return rawAttachment{
+		ContentType: attachmentContentType(aws.StringValue(output.ContentType), key),
+		Size:        int64(len(content)),
+		Content:     content,
+	}, nil
+}
+
+// statAttachment looks up the size and type of an attachment stored in S3
+// without downloading it.
+func statAttachment(s3Client *s3.S3, attachmentURL string) (rawAttachment, error) {
+	bucket, key, err := attachmentObject(attachmentURL)
+	if err != nil {
+		return rawAttachment{}, err
+	}
+
+	output, err := s3Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return rawAttachment{}, fmt.Errorf("failed to stat file in S3: %v", err)
+	}
+
+	return rawAttachment{
+		ContentType: attachmentContentType(aws.StringValue(output.ContentType), key),
+		Size:        aws.Int64Value(output.ContentLength),
+	}, nil
+}
+
+// attachmentObject returns the bucket and key of a stored attachment URL.
+// Sent emails keep the URLs their sender gave, so anything outside the
+// attachment bucket and prefix is refused, see pkg.AttachmentObjectKey.
+func attachmentObject(attachmentURL string) (string, string, error) {
+	key, err := pkg.AttachmentObjectKey(attachmentURL)
+	if err != nil {
+		return "", "", err
+	}
+	return viper.GetString("S3_BUCKET_NAME"), key, nil
+}
+
+func attachmentContentType(contentType, key string) string {
+	if contentType == "" {
+		contentType = mime.TypeByExtension(path.Ext(key))
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return contentType
+}
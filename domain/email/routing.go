@@ -0,0 +1,439 @@
+package email
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/Triaksa-Space/be-mail-platform/config"
+	"github.com/Triaksa-Space/be-mail-platform/pkg"
+	"github.com/jhillyerd/enmime"
+	"github.com/jmoiron/sqlx"
+)
+
+// recipientHeaders are the headers that may name a mailbox the message was
+// delivered to. Bcc recipients only show up in the envelope.
+var recipientHeaders = []string{"To", "Cc", "Delivered-To", "X-Original-To"}
+
+// localRecipient is a user an inbound address delivers to. Label holds the
+// tag of a plus-address (user+tag@domain).
+type localRecipient struct {
+	UserID int64  `db:"id"`
+	Email  string `db:"email"`
+	Label  string `db:"-"`
+}
+
+// deliveryAddress is the address queued in incoming_emails for the user,
+// with the tag kept so that the worker restores the label.
+func (r localRecipient) deliveryAddress() string {
+	if r.Label == "" {
+		return r.Email
+	}
+	at := strings.LastIndex(r.Email, "@")
+	if at < 0 {
+		return r.Email
+	}
+	return r.Email[:at] + "+" + r.Label + r.Email[at:]
+}
+
+// candidateRecipients returns the lower-cased, de-duplicated addresses of
+// the recipient headers, in header order.
+func candidateRecipients(env *enmime.Envelope) []string {
+	var addresses []string
+	for _, header := range recipientHeaders {
+		for _, value := range env.GetHeaderValues(header) {
+			list, err := mail.ParseAddressList(value)
+			if err != nil {
+				// Fall back to the lenient parser used for display
+				for _, addr := range parseAddresses(value) {
+					addresses = append(addresses, addr.Address)
+				}
+				continue
+			}
+			for _, addr := range list {
+				addresses = append(addresses, addr.Address)
+			}
+		}
+	}
+	return normalizeRecipients(addresses)
+}
+
+func normalizeRecipients(addresses []string) []string {
+	seen := map[string]bool{}
+	var result []string
+	for _, address := range addresses {
+		address = strings.ToLower(strings.TrimSpace(address))
+		if address == "" || !strings.Contains(address, "@") || seen[address] {
+			continue
+		}
+		seen[address] = true
+		result = append(result, address)
+	}
+	return result
+}
+
+// resolveLocalRecipients returns the users the addresses deliver to, each
+// user once, in address order.
+func resolveLocalRecipients(addresses []string) ([]localRecipient, error) {
+	seen := map[int64]bool{}
+	var result []localRecipient
+	for _, address := range addresses {
+		recipients, err := resolveAddress(address)
+		if err != nil {
+			return nil, err
+		}
+		for _, recipient := range recipients {
+			if seen[recipient.UserID] {
+				continue
+			}
+			seen[recipient.UserID] = true
+			result = append(result, recipient)
+		}
+	}
+	return result, nil
+}
+
+// resolveAddress looks an address up as, in order, the address of a user, a
+// plus-address of a user, an alias of its domain and the catch-all of its
+// domain. The first match wins.
+func resolveAddress(address string) ([]localRecipient, error) {
+	address = strings.ToLower(strings.TrimSpace(address))
+	at := strings.LastIndex(address, "@")
+	if at <= 0 || at == len(address)-1 {
+		return nil, nil
+	}
+	localPart, domain := address[:at], address[at+1:]
+
+	var tag string
+	if i := strings.Index(localPart, "+"); i > 0 {
+		localPart, tag = localPart[:i], localPart[i+1:]
+		if len(tag) > 64 {
+			tag = tag[:64]
+		}
+	}
+
+	var recipients []localRecipient
+	err := config.DB.Select(&recipients, "SELECT id, email FROM users WHERE email = ?", address)
+	if err != nil || len(recipients) > 0 {
+		return recipients, err
+	}
+
+	if tag != "" {
+		err = config.DB.Select(&recipients, "SELECT id, email FROM users WHERE email = ?", localPart+"@"+domain)
+		if err != nil || len(recipients) > 0 {
+			return withLabel(recipients, tag), err
+		}
+	}
+
+	err = config.DB.Select(&recipients, `
+		SELECT u.id, u.email
+		FROM domain_aliases a
+		JOIN domains d ON d.id = a.domain_id
+		JOIN domain_alias_targets t ON t.alias_id = a.id
+		JOIN users u ON u.id = t.user_id
+		WHERE d.domain = ? AND a.local_part = ?
+		ORDER BY u.id`, domain, localPart)
+	if err != nil || len(recipients) > 0 {
+		return withLabel(recipients, tag), err
+	}
+
+	err = config.DB.Select(&recipients, `
+		SELECT u.id, u.email
+		FROM domain_catch_alls c
+		JOIN domains d ON d.id = c.domain_id
+		JOIN users u ON u.id = c.user_id
+		WHERE d.domain = ?`, domain)
+	return withLabel(recipients, tag), err
+}
+
+func withLabel(recipients []localRecipient, label string) []localRecipient {
+	for i := range recipients {
+		recipients[i].Label = label
+	}
+	return recipients
+}
+
+// storeRawEmail queues an inbound message for every local recipient, or
+// quarantines it when there is none. The envelope recipients, when the source
+// knows them (SES notifications, SMTP), are authoritative; otherwise the
+// recipient headers are used. Recipients that already have the message are
+// counted as skipped.
+func storeRawEmail(messageID string, emailContent []byte, envelopeRecipients []string) (SyncStats, error) {
+	env, err := enmime.ReadEnvelope(bytes.NewReader(emailContent))
+	if err != nil {
+		return SyncStats{}, fmt.Errorf("failed to parse email: %v", err)
+	}
+
+	candidates := normalizeRecipients(envelopeRecipients)
+	if len(candidates) == 0 {
+		candidates = candidateRecipients(env)
+	}
+	if len(candidates) == 0 {
+		return SyncStats{}, fmt.Errorf("failed to parse recipient addresses")
+	}
+
+	recipients, err := resolveLocalRecipients(candidates)
+	if err != nil {
+		return SyncStats{}, fmt.Errorf("failed to resolve recipients: %v", err)
+	}
+
+	if len(recipients) == 0 {
+		// Nobody here to deliver to, keep it for a superadmin to assign
+		err = quarantineEmail(messageID, emailContent, env, candidates, nil)
+		if err == errDuplicateEmail {
+			return SyncStats{SkippedEmails: 1}, nil
+		}
+		if err != nil {
+			return SyncStats{}, err
+		}
+		return SyncStats{QuarantinedEmails: 1}, nil
+	}
+
+	return storeIncomingEmail(messageID, env, emailContent, recipients)
+}
+
+// storeIncomingEmail saves the raw content once in raw_emails and queues one
+// incoming_emails row per recipient pointing at it, skipping recipients that
+// already have the message delivered or queued.
+func storeIncomingEmail(messageID string, env *enmime.Envelope, emailContent []byte, recipients []localRecipient) (SyncStats, error) {
+	stats := SyncStats{}
+	fp := fingerprintEmail(env, emailContent)
+
+	dateEmail, err := env.Date()
+	if err != nil {
+		dateEmail = time.Now()
+	}
+
+	tx, err := config.DB.Beginx()
+	if err != nil {
+		return stats, fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	rawEmailID, err := insertRawEmail(tx, messageID, emailContent, fp)
+	if err != nil {
+		return stats, err
+	}
+
+	for _, recipient := range recipients {
+		sendTo := recipient.deliveryAddress()
+
+		delivered, err := alreadyDelivered(tx, recipient.UserID, fp)
+		if err != nil {
+			return stats, fmt.Errorf("failed to check delivery to %s: %v", sendTo, err)
+		}
+		queued, err := alreadyQueued(tx, sendTo, fp)
+		if err != nil {
+			return stats, fmt.Errorf("failed to check queue of %s: %v", sendTo, err)
+		}
+		if delivered || queued {
+			fmt.Println("Skipping duplicate email", messageID, "for", sendTo)
+			stats.SkippedEmails++
+			continue
+		}
+
+		// A redelivered object is already queued under its key
+		result, err := tx.Exec(`
+			INSERT IGNORE INTO incoming_emails (
+				email_send_to,
+				message_id,
+				raw_email_id,
+				content_hash,
+				header_message_id,
+				created_at,
+				processed,
+				email_date
+			) VALUES (?, ?, ?, ?, ?, NOW(), false, ?)`,
+			sendTo, messageID, rawEmailID, fp.ContentHash, fp.headerMessageID(), dateEmail)
+		if err != nil {
+			return stats, fmt.Errorf("failed to insert incoming email for %s: %v", sendTo, err)
+		}
+		if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+			stats.SkippedEmails++
+			continue
+		}
+		stats.NewEmails++
+	}
+
+	// When every recipient was skipped the raw_emails row is left unused and
+	// purged by the housekeeping of the workers
+	return stats, tx.Commit()
+}
+
+// insertRawEmail stores the source of an inbound message once, however many
+// mailboxes it is delivered to and however often it is ingested: a source
+// with the same content hash is reused.
+func insertRawEmail(db sqlx.Ext, messageID string, emailContent []byte, fp emailFingerprint) (int64, error) {
+	var rawEmailID int64
+	err := sqlx.Get(db, &rawEmailID, "SELECT id FROM raw_emails WHERE content_hash = ? ORDER BY id LIMIT 1", fp.ContentHash)
+	if err == nil {
+		return rawEmailID, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, fmt.Errorf("failed to look up raw email: %v", err)
+	}
+
+	result, err := db.Exec(`
+		INSERT INTO raw_emails (message_id, email_data, content_hash, header_message_id, created_at)
+		VALUES (?, ?, ?, ?, NOW())`, messageID, emailContent, fp.ContentHash, fp.headerMessageID())
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert raw email: %v", err)
+	}
+	return result.LastInsertId()
+}
+
+// deliverToMailbox stores a parsed inbound message in the inbox of one user,
+// under the label of the plus-address it came in on, if any. It returns
+// errDuplicateEmail when the user already has the message. Attachments are
+// uploaded under a per-user key so that deleting one copy never removes the
+// objects of another. When rawEmailID is set the source is read from
+// raw_emails, otherwise emailContent is kept on the row. When onDelivered is
+// set it runs in the transaction that inserts the row, so the bookkeeping of
+// the caller commits or rolls back together with the email.
+func deliverToMailbox(recipient localRecipient, messageID string, env *enmime.Envelope, emailContent []byte, rawEmailID *int64, onDelivered func(tx *sqlx.Tx) error) (int64, error) {
+	userID := recipient.UserID
+
+	dateT, _ := env.Date()
+
+	// Extract email information
+	email := &PEmail{
+		ID:       messageID,
+		From:     parseAddresses(env.GetHeader("From")),
+		To:       parseAddresses(env.GetHeader("To")),
+		Cc:       parseAddresses(env.GetHeader("Cc")),
+		Bcc:      parseAddresses(env.GetHeader("Bcc")),
+		Subject:  env.GetHeader("Subject"),
+		Date:     dateT,
+		TextBody: env.Text,
+		HTMLBody: env.HTML,
+	}
+	if len(email.From) == 0 {
+		return 0, fmt.Errorf("email has no From address")
+	}
+
+	fp := fingerprintEmail(env, emailContent)
+	delivered, err := alreadyDelivered(config.DB, userID, fp)
+	if err != nil {
+		return 0, fmt.Errorf("failed to check for duplicates: %v", err)
+	}
+	if delivered {
+		return 0, errDuplicateEmail
+	}
+
+	// Handle attachments, a failed upload fails the whole delivery
+	var attachmentURLs []string
+	for _, att := range env.Attachments {
+		attachmentKey := fmt.Sprintf("attachments/%s/%d/%s", email.ID, userID, att.FileName)
+		attachmentURL, err := pkg.UploadAttachment(att.Content, attachmentKey, att.ContentType)
+		if err != nil {
+			return 0, fmt.Errorf("failed to upload attachment %s: %v", att.FileName, err)
+		}
+		attachmentURLs = append(attachmentURLs, attachmentURL)
+	}
+	attachmentsJSON, _ := json.Marshal(attachmentURLs)
+
+	// Select the email body and generate a preview
+	var bodyEmail string
+	if email.HTMLBody != "" {
+		bodyEmail = email.HTMLBody
+	} else {
+		bodyEmail = email.TextBody
+	}
+	preview := generatePreview(email.TextBody, email.HTMLBody)
+
+	var bodyEml []byte
+	if rawEmailID == nil {
+		bodyEml = emailContent
+	}
+
+	var label *string
+	if recipient.Label != "" {
+		label = &recipient.Label
+	}
+
+	tx, err := config.DB.Beginx()
+	if err != nil {
+		return 0, fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		INSERT INTO emails (
+			user_id,
+			sender_email,
+			sender_name,
+			subject,
+			preview,
+			body,
+			body_eml,
+			raw_email_id,
+			content_hash,
+			body_text,
+			email_type,
+			label,
+			attachments,
+			message_id,
+			header_message_id,
+			timestamp,
+			created_at,
+			updated_at
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NOW(), NOW())
+	`,
+		userID,
+		email.From[0].Address,
+		email.From[0].Name,
+		email.Subject,
+		preview,
+		bodyEmail,
+		bodyEml,
+		rawEmailID,
+		fp.ContentHash,
+		generateBodyText(email.TextBody, email.HTMLBody),
+		"inbox",
+		label,
+		string(attachmentsJSON),
+		email.ID,
+		fp.headerMessageID(),
+		email.Date,
+	)
+	if isDuplicateKeyError(err) {
+		return 0, errDuplicateEmail
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert email into DB: %v", err)
+	}
+
+	emailID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	if onDelivered != nil {
+		if err := onDelivered(tx); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit email: %v", err)
+	}
+
+	// Grouping is best effort, the email is delivered either way
+	headers := threadHeadersFromEnvelope(env)
+	var addresses []string
+	for _, addrs := range [][]EmailAddress{email.From, email.To, email.Cc} {
+		for _, addr := range addrs {
+			addresses = append(addresses, addr.Address)
+		}
+	}
+	headers.Participants = threadParticipants(recipient.Email, addresses)
+	if _, err := assignThread(config.DB, userID, emailID, headers); err != nil {
+		fmt.Println("Failed to thread email", emailID, err)
+	}
+
+	publishEmailEvent(userID, EventNewEmail, emailID)
+	return emailID, nil
+}
@@ -0,0 +1,394 @@
+package email
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Triaksa-Space/be-mail-platform/config"
+	"github.com/Triaksa-Space/be-mail-platform/domain/user"
+	"github.com/Triaksa-Space/be-mail-platform/utils"
+	"github.com/labstack/echo/v4"
+)
+
+const scheduledBatchSize = 100
+
+var errSendAtInPast = errors.New("send_at must be in the future")
+
+// parseSendAt parses the RFC 3339 send_at of a send request, nil when the
+// email goes out right away.
+func parseSendAt(value string) (*time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, nil
+	}
+
+	sendAt, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, fmt.Errorf("send_at must be an RFC 3339 time")
+	}
+	if !sendAt.After(time.Now()) {
+		return nil, errSendAtInPast
+	}
+
+	sendAt = sendAt.UTC().Truncate(time.Second)
+	return &sendAt, nil
+}
+
+func scheduledEmailResponse(c echo.Context, emailID int64, sendAt time.Time) error {
+	return c.JSON(http.StatusAccepted, map[string]string{
+		"message":  "Email scheduled",
+		"email_id": utils.EncodeID(int(emailID)),
+		"send_at":  sendAt.Format(time.RFC3339),
+	})
+}
+
+// checkSendLimit checks the quota of a send request. A scheduled email is
+// only held to the recipient limit of the plan now, the daily and monthly
+// limits apply when it is dispatched.
+func checkSendLimit(userID int64, recipients int, scheduled bool) error {
+	err := CheckEmailLimit(userID, recipients)
+	if scheduled && (err == user.ErrDailyLimitExceeded || err == user.ErrMonthlyLimitExceeded) {
+		return nil
+	}
+	return err
+}
+
+// DispatchScheduledEmails hands the scheduled emails that are due to the
+// outbound queue. The send quota is checked now rather than when the emails
+// were written; an email over the daily or monthly limit waits for the reset.
+func DispatchScheduledEmails() error {
+	var due []OutboundEmail
+	err := config.DB.Select(&due, `
+		SELECT id, email_id, user_id, message_id, payload, attempts
+		FROM outbound_emails
+		WHERE status = ? AND next_attempt_at <= NOW()
+		ORDER BY next_attempt_at ASC
+		LIMIT ?`, OutboundStatusScheduled, scheduledBatchSize)
+	if err != nil {
+		return fmt.Errorf("failed to fetch scheduled emails: %v", err)
+	}
+
+	for _, outbound := range due {
+		if err := dispatchScheduledEmail(outbound); err != nil {
+			fmt.Printf("Failed to dispatch scheduled email %d: %v\n", outbound.EmailID, err)
+		}
+	}
+	return nil
+}
+
+func dispatchScheduledEmail(outbound OutboundEmail) error {
+	tx, err := config.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// The row is locked and read again, it may have been edited, cancelled
+	// or dispatched by another sync process since it was listed
+	var due bool
+	err = tx.QueryRow(`
+		SELECT payload, next_attempt_at <= NOW()
+		FROM outbound_emails
+		WHERE id = ? AND status = ?
+		FOR UPDATE`, outbound.ID, OutboundStatusScheduled).Scan(&outbound.Payload, &due)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !due {
+		return nil
+	}
+
+	var payload outboundPayload
+	if err := json.Unmarshal(outbound.Payload, &payload); err != nil {
+		return failScheduledEmail(tx, outbound, fmt.Sprintf("invalid payload: %v", err))
+	}
+	recipients := payload.Message.Recipients.Count()
+
+	// Recipients may have bounced since the email was scheduled
+	if err := checkSuppressedRecipients(payload.Message.Recipients); err != nil {
+		if _, ok := err.(*suppressedRecipientsError); ok {
+			return failScheduledEmail(tx, outbound, err.Error())
+		}
+		return err
+	}
+
+	if err := CheckEmailLimit(outbound.UserID, recipients); err == user.ErrTooManyRecipients {
+		return failScheduledEmail(tx, outbound, err.Error())
+	} else if err != nil && !isSendQuotaError(err) {
+		return err
+	}
+
+	// Every recipient counts against the quota once queued
+	err = user.ReserveSentEmails(tx, outbound.UserID, payload.Message.From, recipients)
+	if isSendQuotaError(err) {
+		return postponeScheduledEmail(tx, outbound, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE outbound_emails
+		SET status = ?, next_attempt_at = NULL, last_error = NULL
+		WHERE id = ?`, OutboundStatusQueued, outbound.ID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE emails
+		SET email_type = "sent", status = ?, last_error = NULL, timestamp = NOW()
+		WHERE id = ?`, OutboundStatusQueued, outbound.EmailID)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	threadSentEmail(outbound.UserID, outbound.EmailID, payload.Message)
+	return nil
+}
+
+// postponeScheduledEmail moves a scheduled email over the send limit to the
+// moment the limit resets, and commits tx.
+func postponeScheduledEmail(tx *sql.Tx, outbound OutboundEmail, cause error) error {
+	emailUser, err := getUserEmail(outbound.UserID)
+	if err != nil {
+		return err
+	}
+	quota, err := user.GetSendQuota(outbound.UserID, emailUser)
+	if err != nil {
+		return err
+	}
+
+	retryAt := quota.DailyResetAt
+	if cause == user.ErrMonthlyLimitExceeded {
+		retryAt = quota.MonthlyResetAt
+	}
+	if !retryAt.After(time.Now()) {
+		retryAt = time.Now().Add(time.Hour)
+	}
+
+	_, err = tx.Exec(`
+		UPDATE outbound_emails o
+		JOIN emails e ON e.id = o.email_id
+		SET o.next_attempt_at = ?, o.last_error = ?, e.last_error = ?
+		WHERE o.id = ? AND o.status = ?`,
+		retryAt.UTC(), cause.Error(), cause.Error(), outbound.ID, OutboundStatusScheduled)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// failScheduledEmail gives up on a scheduled email, it shows up as a failed
+// sent email, and commits tx.
+func failScheduledEmail(tx *sql.Tx, outbound OutboundEmail, reason string) error {
+	_, err := tx.Exec(`
+		UPDATE outbound_emails o
+		JOIN emails e ON e.id = o.email_id
+		SET o.status = ?, o.last_error = ?, e.email_type = "sent", e.status = ?, e.last_error = ?
+		WHERE o.id = ? AND o.status = ?`,
+		OutboundStatusFailed, reason, OutboundStatusFailed, reason, outbound.ID, OutboundStatusScheduled)
+	if err != nil {
+		return fmt.Errorf("failed to fail scheduled email: %v", err)
+	}
+	return tx.Commit()
+}
+
+// ListScheduledEmailsHandler lists the scheduled emails of the current user,
+// the next one to go out first.
+func ListScheduledEmailsHandler(c echo.Context) error {
+	userID := c.Get("user_id").(int64)
+
+	var emails []ScheduledEmail
+	err := config.DB.Select(&emails, `
+		SELECT id,
+			COALESCE(to_addresses, '') AS to_addresses,
+			COALESCE(cc_addresses, '') AS cc_addresses,
+			COALESCE(bcc_addresses, '') AS bcc_addresses,
+			COALESCE(subject, '') AS subject,
+			COALESCE(preview, '') AS preview,
+			COALESCE(body, '') AS body,
+			COALESCE(attachments, '') AS attachments,
+			timestamp AS send_at,
+			COALESCE(last_error, '') AS last_error
+		FROM emails
+		WHERE user_id = ? AND email_type = "scheduled"
+		ORDER BY timestamp ASC, id ASC`, userID)
+	if err != nil {
+		fmt.Println("Failed to fetch scheduled emails", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch scheduled emails"})
+	}
+
+	for i := range emails {
+		emails[i].EmailEncodeID = utils.EncodeID(int(emails[i].ID))
+		emails[i].ListAttachments = getAttachmentURLs(emails[i].Attachments)
+	}
+
+	return c.JSON(http.StatusOK, emails)
+}
+
+// UpdateScheduledEmailHandler edits the recipients, content or send time of
+// a scheduled email that has not been dispatched yet.
+func UpdateScheduledEmailHandler(c echo.Context) error {
+	userID := c.Get("user_id").(int64)
+
+	emailID, err := utils.DecodeID(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid email ID"})
+	}
+
+	var req UpdateScheduledEmailRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+	}
+
+	tx, err := config.DB.Beginx()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to start transaction"})
+	}
+	defer tx.Rollback()
+
+	// The lock keeps the dispatcher off the row while it is edited
+	var outbound OutboundEmail
+	err = tx.Get(&outbound, `
+		SELECT o.id, o.email_id, o.user_id, o.message_id, o.payload, o.attempts
+		FROM outbound_emails o
+		JOIN emails e ON e.id = o.email_id
+		WHERE e.id = ? AND e.user_id = ? AND o.status = ?
+		FOR UPDATE`, emailID, userID, OutboundStatusScheduled)
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Scheduled email not found"})
+	}
+	if err != nil {
+		fmt.Println("Failed to fetch scheduled email", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch scheduled email"})
+	}
+
+	var payload outboundPayload
+	if err := json.Unmarshal(outbound.Payload, &payload); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to read scheduled email"})
+	}
+	msg := &payload.Message
+
+	if req.To != nil || req.Cc != nil || req.Bcc != nil {
+		to, cc, bcc := msg.Recipients.To, msg.Recipients.Cc, msg.Recipients.Bcc
+		if req.To != nil {
+			to = *req.To
+		}
+		if req.Cc != nil {
+			cc = *req.Cc
+		}
+		if req.Bcc != nil {
+			bcc = *req.Bcc
+		}
+		msg.Recipients, err = parseRecipients(to, cc, bcc)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		if err := checkSuppressedRecipients(msg.Recipients); err != nil {
+			return suppressionResponse(c, err)
+		}
+		if err := checkSendLimit(userID, msg.Recipients.Count(), true); err != nil {
+			return emailLimitResponse(c, err)
+		}
+	}
+	if req.Subject != nil {
+		msg.Subject = *req.Subject
+	}
+	if req.Body != nil {
+		msg.HTMLBody = *req.Body
+	}
+	if req.TextBody != nil {
+		msg.TextBody = *req.TextBody
+	}
+
+	var sendAt time.Time
+	err = tx.Get(&sendAt, "SELECT next_attempt_at FROM outbound_emails WHERE id = ?", outbound.ID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch scheduled email"})
+	}
+	if req.SendAt != nil {
+		newSendAt, err := parseSendAt(*req.SendAt)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		if newSendAt == nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "send_at is required"})
+		}
+		sendAt = *newSendAt
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update scheduled email"})
+	}
+
+	_, err = tx.Exec(`
+		UPDATE outbound_emails
+		SET payload = ?, next_attempt_at = ?, last_error = NULL
+		WHERE id = ?`, data, sendAt, outbound.ID)
+	if err != nil {
+		fmt.Println("Failed to update scheduled email", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update scheduled email"})
+	}
+
+	_, err = tx.Exec(`
+		UPDATE emails
+		SET to_addresses = ?, cc_addresses = ?, bcc_addresses = ?,
+			subject = ?, body = ?, preview = ?, timestamp = ?, last_error = NULL, updated_at = NOW()
+		WHERE id = ?`,
+		strings.Join(msg.Recipients.To, ","), strings.Join(msg.Recipients.Cc, ","), strings.Join(msg.Recipients.Bcc, ","),
+		msg.Subject, msg.HTMLBody, generatePreview(msg.TextBody, msg.HTMLBody), sendAt, outbound.EmailID)
+	if err != nil {
+		fmt.Println("Failed to update scheduled email", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update scheduled email"})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to commit transaction"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": "Scheduled email updated successfully",
+		"send_at": sendAt.Format(time.RFC3339),
+	})
+}
+
+// DeleteScheduledEmailHandler cancels a scheduled email that has not been
+// dispatched yet.
+func DeleteScheduledEmailHandler(c echo.Context) error {
+	userID := c.Get("user_id").(int64)
+
+	emailID, err := utils.DecodeID(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid email ID"})
+	}
+
+	// The queue entry goes with the email
+	result, err := config.DB.Exec(`
+		DELETE FROM emails
+		WHERE id = ? AND user_id = ? AND email_type = "scheduled"`, emailID, userID)
+	if err != nil {
+		fmt.Println("Failed to cancel scheduled email", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to cancel scheduled email"})
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Scheduled email not found"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Scheduled email cancelled successfully"})
+}
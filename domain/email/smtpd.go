@@ -0,0 +1,170 @@
+package email
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/Triaksa-Space/be-mail-platform/config"
+	"github.com/emersion/go-smtp"
+	"github.com/google/uuid"
+	"github.com/jhillyerd/enmime"
+	"github.com/spf13/viper"
+)
+
+// smtpBackend accepts inbound mail over SMTP for local users and writes it
+// into incoming_emails, the same table SyncEmails fills from S3.
+type smtpBackend struct{}
+
+func (b *smtpBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &smtpSession{remoteAddr: c.Conn().RemoteAddr().String()}, nil
+}
+
+type smtpSession struct {
+	remoteAddr string
+	from       string
+	recipients []localRecipient
+}
+
+func (s *smtpSession) Mail(from string, opts *smtp.MailOptions) error {
+	s.from = from
+	return nil
+}
+
+func (s *smtpSession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	address := strings.ToLower(strings.TrimSpace(to))
+
+	recipients, err := localRecipientsFor(address)
+	if err != nil {
+		fmt.Println("Failed to check recipient", address, err)
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+			Message:      "Temporary failure, please try again later",
+		}
+	}
+	if len(recipients) == 0 {
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "Mailbox unavailable",
+		}
+	}
+
+	// An alias expands to its users, each of them is queued once
+	for _, recipient := range recipients {
+		if !s.hasRecipient(recipient.UserID) {
+			s.recipients = append(s.recipients, recipient)
+		}
+	}
+	return nil
+}
+
+func (s *smtpSession) Data(r io.Reader) error {
+	emailContent, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	env, err := enmime.ReadEnvelope(bytes.NewReader(emailContent))
+	if err != nil {
+		return &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+			Message:      "Malformed message",
+		}
+	}
+
+	// The recipients were checked in Rcpt, the raw message is stored once for all of them
+	messageID := fmt.Sprintf("smtp/%s", uuid.New().String())
+	stats, err := storeIncomingEmail(messageID, env, emailContent, s.recipients)
+	if err != nil {
+		fmt.Printf("Failed to store SMTP email from %s for %v: %v\n", s.from, s.recipients, err)
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+			Message:      "Failed to store message, please try again later",
+		}
+	}
+	fmt.Printf("Accepted SMTP email %s %s %+v\n", s.remoteAddr, s.from, stats)
+
+	return nil
+}
+
+func (s *smtpSession) Reset() {
+	s.from = ""
+	s.recipients = nil
+}
+
+func (s *smtpSession) Logout() error {
+	return nil
+}
+
+// localRecipientsFor returns the users an address on one of our domains
+// delivers to, through a user address, plus-address, alias or catch-all.
+func localRecipientsFor(address string) ([]localRecipient, error) {
+	parts := strings.Split(address, "@")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, nil
+	}
+
+	var domainExists bool
+	err := config.DB.Get(&domainExists, "SELECT EXISTS(SELECT 1 FROM domains WHERE domain = ?)", parts[1])
+	if err != nil {
+		return nil, err
+	}
+	if !domainExists {
+		return nil, nil
+	}
+
+	return resolveLocalRecipients([]string{address})
+}
+
+func (s *smtpSession) hasRecipient(userID int64) bool {
+	for _, recipient := range s.recipients {
+		if recipient.UserID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// NewSMTPServer builds the inbound SMTP server from configuration.
+// STARTTLS is advertised when SMTPD_TLS_CERT and SMTPD_TLS_KEY are set.
+func NewSMTPServer() (*smtp.Server, error) {
+	addr := viper.GetString("SMTPD_ADDR")
+	if addr == "" {
+		addr = ":2525"
+	}
+	domain := viper.GetString("SMTPD_DOMAIN")
+	if domain == "" {
+		domain = "localhost"
+	}
+	maxMessageBytes := viper.GetInt64("SMTPD_MAX_MESSAGE_BYTES")
+	if maxMessageBytes <= 0 {
+		maxMessageBytes = 25 * 1024 * 1024
+	}
+
+	s := smtp.NewServer(&smtpBackend{})
+	s.Addr = addr
+	s.Domain = domain
+	s.MaxMessageBytes = maxMessageBytes
+	s.MaxRecipients = 50
+	s.ReadTimeout = 60 * time.Second
+	s.WriteTimeout = 60 * time.Second
+
+	certFile := viper.GetString("SMTPD_TLS_CERT")
+	keyFile := viper.GetString("SMTPD_TLS_KEY")
+	if certFile != "" && keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load SMTP TLS certificate: %v", err)
+		}
+		s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	return s, nil
+}
@@ -0,0 +1,246 @@
+package email
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Triaksa-Space/be-mail-platform/pkg"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/labstack/echo/v4"
+	"github.com/spf13/viper"
+)
+
+// SNSNotificationHandler receives S3 event and SES receipt notifications for
+// the inbound bucket, and SES feedback on sent mail, through SNS. Every
+// message is verified against its signing certificate before it is trusted.
+func SNSNotificationHandler(c echo.Context) error {
+	body, err := io.ReadAll(io.LimitReader(c.Request().Body, 256*1024))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Failed to read request body"})
+	}
+
+	var message pkg.SNSMessage
+	if err := json.Unmarshal(body, &message); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid SNS message"})
+	}
+
+	if err := pkg.VerifySNSMessage(message); err != nil {
+		fmt.Println("Failed to verify SNS message:", err)
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "Invalid SNS signature"})
+	}
+
+	// Any AWS account can publish signed messages, without an allow-list
+	// there is no telling ours apart
+	if viper.GetString("SNS_TOPIC_ARNS") == "" {
+		fmt.Println("SNS_TOPIC_ARNS is not configured, rejecting SNS message from", message.TopicArn)
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "SNS topics are not configured"})
+	}
+	if !isAllowedSNSTopic(message.TopicArn) {
+		fmt.Println("SNS message from unexpected topic:", message.TopicArn)
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "Unexpected SNS topic"})
+	}
+
+	switch message.Type {
+	case "SubscriptionConfirmation":
+		if err := pkg.ConfirmSubscription(message.SubscribeURL); err != nil {
+			fmt.Println("Failed to confirm SNS subscription:", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to confirm subscription"})
+		}
+		fmt.Println("Confirmed SNS subscription", message.TopicArn)
+	case "Notification":
+		if err := handleInboundNotification(message.Message, message.TopicArn); err != nil {
+			fmt.Println("Failed to handle notification:", err)
+			// A non-2xx response makes SNS retry the delivery
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to handle notification"})
+		}
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "OK"})
+}
+
+// isAllowedSNSTopic checks the topic against SNS_TOPIC_ARNS. Nothing is
+// allowed while the list is empty.
+func isAllowedSNSTopic(topicArn string) bool {
+	return topicInList(topicArn, viper.GetString("SNS_TOPIC_ARNS"))
+}
+
+// isFeedbackSNSTopic checks the topic against SES_FEEDBACK_TOPIC_ARNS, the
+// topics SES publishes bounces, complaints and deliveries on.
+func isFeedbackSNSTopic(topicArn string) bool {
+	return topicInList(topicArn, viper.GetString("SES_FEEDBACK_TOPIC_ARNS"))
+}
+
+// topicInList reports whether topicArn is one of the comma separated ARNs.
+func topicInList(topicArn, list string) bool {
+	if topicArn == "" {
+		return false
+	}
+	for _, arn := range strings.Split(list, ",") {
+		if strings.TrimSpace(arn) == topicArn {
+			return true
+		}
+	}
+	return false
+}
+
+// handleInboundNotification ingests the objects named in an S3 event or an
+// SES receipt notification, and hands SES feedback published on a topic of
+// SES_FEEDBACK_TOPIC_ARNS to handleSESFeedbackNotification. Only keys of the
+// configured inbound bucket and prefix are fetched.
+func handleInboundNotification(message, topicArn string) error {
+	var notification pkg.SESNotification
+	if err := json.Unmarshal([]byte(message), &notification); err == nil {
+		switch notification.Type() {
+		case "Received":
+			return handleSESReceivedNotification(notification)
+		case "Bounce", "Complaint", "Delivery":
+			// Feedback suppresses addresses, it must come from our own
+			// configuration set and not from any topic that reaches us
+			if !isFeedbackSNSTopic(topicArn) {
+				fmt.Println("Ignoring SES feedback from topic", topicArn)
+				return nil
+			}
+			return handleSESFeedbackNotification(notification)
+		}
+	}
+
+	var event pkg.S3Event
+	if err := json.Unmarshal([]byte(message), &event); err != nil {
+		return fmt.Errorf("invalid S3 event: %v", err)
+	}
+
+	// s3:TestEvent and other records without objects have nothing to fetch
+	if len(event.Records) == 0 {
+		return nil
+	}
+
+	s3Client, err := newInboundS3Client()
+	if err != nil {
+		return err
+	}
+
+	bucketName := viper.GetString("S3_BUCKET_NAME")
+	prefix := viper.GetString("S3_PREFIX")
+
+	for _, record := range event.Records {
+		if !strings.HasPrefix(record.EventName, "ObjectCreated:") {
+			continue
+		}
+		if record.S3.Bucket.Name != bucketName {
+			fmt.Println("Ignoring S3 event for bucket", record.S3.Bucket.Name)
+			continue
+		}
+
+		// Keys in S3 events are URL encoded
+		key, err := url.QueryUnescape(record.S3.Object.Key)
+		if err != nil {
+			return fmt.Errorf("invalid object key %s: %v", record.S3.Object.Key, err)
+		}
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		_, err = ingestS3Object(s3Client, bucketName, key, nil)
+		if err != nil {
+			return fmt.Errorf("failed to ingest object %s: %v", key, err)
+		}
+	}
+
+	return nil
+}
+
+// handleSESReceivedNotification ingests the object an SES S3 action stored,
+// routing it to the envelope recipients so Bcc'd users get their copy.
+func handleSESReceivedNotification(notification pkg.SESNotification) error {
+	action := notification.Receipt.Action
+	if action.Type != "S3" || action.ObjectKey == "" {
+		return nil
+	}
+
+	bucketName := viper.GetString("S3_BUCKET_NAME")
+	if action.BucketName != bucketName {
+		fmt.Println("Ignoring SES notification for bucket", action.BucketName)
+		return nil
+	}
+	if !strings.HasPrefix(action.ObjectKey, viper.GetString("S3_PREFIX")) {
+		return nil
+	}
+
+	s3Client, err := newInboundS3Client()
+	if err != nil {
+		return err
+	}
+
+	_, err = ingestS3Object(s3Client, bucketName, action.ObjectKey, notification.Receipt.Recipients)
+	if err != nil {
+		return fmt.Errorf("failed to ingest object %s: %v", action.ObjectKey, err)
+	}
+	return nil
+}
+
+// newInboundS3Client returns a client for the inbound bucket.
+func newInboundS3Client() (*s3.S3, error) {
+	sess, err := pkg.InitAWS()
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize AWS session: %v", err)
+	}
+	return s3.New(sess), nil
+}
+
+// RunSQSConsumer long-polls SQS_QUEUE_URL for S3 event or SES receipt
+// notifications, either delivered directly or wrapped in an SNS envelope.
+// Messages are only deleted once their objects have been stored, so failures
+// are redelivered after the visibility timeout.
+func RunSQSConsumer(queueURL string) {
+	sess, err := pkg.InitAWS()
+	if err != nil {
+		fmt.Println("Failed to initialize AWS session for SQS:", err)
+		return
+	}
+	sqsClient := sqs.New(sess)
+
+	for {
+		output, err := sqsClient.ReceiveMessage(&sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(queueURL),
+			MaxNumberOfMessages: aws.Int64(10),
+			WaitTimeSeconds:     aws.Int64(20),
+		})
+		if err != nil {
+			fmt.Println("Failed to receive SQS messages:", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+
+		for _, msg := range output.Messages {
+			body := aws.StringValue(msg.Body)
+
+			// Unwrap SNS envelopes when the queue is subscribed to a topic
+			var envelope pkg.SNSMessage
+			var topicArn string
+			if err := json.Unmarshal([]byte(body), &envelope); err == nil && envelope.Type == "Notification" {
+				body = envelope.Message
+				topicArn = envelope.TopicArn
+			}
+
+			if err := handleInboundNotification(body, topicArn); err != nil {
+				fmt.Printf("Failed to handle SQS message %s: %v\n", aws.StringValue(msg.MessageId), err)
+				continue
+			}
+
+			_, err := sqsClient.DeleteMessage(&sqs.DeleteMessageInput{
+				QueueUrl:      aws.String(queueURL),
+				ReceiptHandle: msg.ReceiptHandle,
+			})
+			if err != nil {
+				fmt.Printf("Failed to delete SQS message %s: %v\n", aws.StringValue(msg.MessageId), err)
+			}
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package email
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestIsAllowedSNSTopic(t *testing.T) {
+	const inbound = "arn:aws:sns:us-east-1:123456789012:inbound"
+	const feedback = "arn:aws:sns:us-east-1:123456789012:feedback"
+
+	tests := []struct {
+		name     string
+		allowed  string
+		topicArn string
+		want     bool
+	}{
+		{name: "not configured", allowed: "", topicArn: inbound, want: false},
+		{name: "single topic", allowed: inbound, topicArn: inbound, want: true},
+		{name: "one of several", allowed: inbound + "," + feedback, topicArn: feedback, want: true},
+		{name: "spaces around entries", allowed: " " + inbound + " , " + feedback + " ", topicArn: inbound, want: true},
+		{name: "unknown topic", allowed: inbound, topicArn: "arn:aws:sns:us-east-1:999999999999:inbound", want: false},
+		{name: "prefix of an allowed topic", allowed: inbound, topicArn: "arn:aws:sns:us-east-1:123456789012:in", want: false},
+		{name: "empty topic", allowed: inbound + ",", topicArn: "", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Set("SNS_TOPIC_ARNS", tt.allowed)
+			t.Cleanup(func() { viper.Set("SNS_TOPIC_ARNS", "") })
+
+			if got := isAllowedSNSTopic(tt.topicArn); got != tt.want {
+				t.Errorf("isAllowedSNSTopic(%q) = %v, want %v", tt.topicArn, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsFeedbackSNSTopic(t *testing.T) {
+	const inbound = "arn:aws:sns:us-east-1:123456789012:inbound"
+	const feedback = "arn:aws:sns:us-east-1:123456789012:feedback"
+
+	viper.Set("SNS_TOPIC_ARNS", inbound+","+feedback)
+	viper.Set("SES_FEEDBACK_TOPIC_ARNS", feedback)
+	t.Cleanup(func() {
+		viper.Set("SNS_TOPIC_ARNS", "")
+		viper.Set("SES_FEEDBACK_TOPIC_ARNS", "")
+	})
+
+	tests := []struct {
+		topicArn string
+		want     bool
+	}{
+		{topicArn: feedback, want: true},
+		{topicArn: inbound, want: false},
+		{topicArn: "", want: false},
+	}
+	for _, tt := range tests {
+		if got := isFeedbackSNSTopic(tt.topicArn); got != tt.want {
+			t.Errorf("isFeedbackSNSTopic(%q) = %v, want %v", tt.topicArn, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package email
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Triaksa-Space/be-mail-platform/config"
+	"github.com/Triaksa-Space/be-mail-platform/utils"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	EventNewEmail     = "new_email"
+	EventEmailRead    = "email_read"
+	EventEmailDeleted = "email_deleted"
+)
+
+const (
+	// An event id skipped by a poll belongs to a transaction that may still
+	// commit, it is polled again for this long
+	emailEventGapTimeout = time.Minute
+	maxEmailEventGaps    = 500
+)
+
+// publishEmailEvent records a mailbox change in email_events. The table is
+// the bridge between the processes that change mailboxes (server, sync,
+// smtpd, imapd, pop3d) and the server that streams the events to clients.
+func publishEmailEvent(userID int64, eventType string, emailID int64) {
+	_, err := config.DB.Exec(`
+		INSERT INTO email_events (user_id, event_type, email_id, created_at)
+		VALUES (?, ?, ?, NOW())`, userID, eventType, emailID)
+	if err != nil {
+		fmt.Printf("Failed to publish %s event for email %d: %v\n", eventType, emailID, err)
+	}
+}
+
+// emailEventHub polls email_events and fans new rows out to the streams of
+// the users they belong to. Ids are handed out at insert but rows show up at
+// commit, so the ids a poll skipped over are kept in gaps and polled again
+// until they show up or time out.
+type emailEventHub struct {
+	mu          sync.Mutex
+	subscribers map[int64]map[chan EmailEvent]struct{}
+	lastID      int64
+	gaps        map[int64]time.Time
+}
+
+var (
+	eventHub = &emailEventHub{
+		subscribers: map[int64]map[chan EmailEvent]struct{}{},
+		gaps:        map[int64]time.Time{},
+	}
+	eventHubOnce sync.Once
+)
+
+func (h *emailEventHub) start() {
+	err := config.DB.Get(&h.lastID, "SELECT COALESCE(MAX(id), 0) FROM email_events")
+	if err != nil {
+		fmt.Println("Failed to read last email event:", err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		polls := 0
+		for range ticker.C {
+			h.poll()
+
+			// Events only need to live long enough for clients to reconnect
+			polls++
+			if polls%600 == 0 {
+				_, err := config.DB.Exec("DELETE FROM email_events WHERE created_at < NOW() - INTERVAL 1 DAY")
+				if err != nil {
+					fmt.Println("Failed to purge email events:", err)
+				}
+			}
+		}
+	}()
+}
+
+func (h *emailEventHub) poll() {
+	where, args := "ev.id > ?", []interface{}{h.lastID}
+	if len(h.gaps) > 0 {
+		gaps := make([]int64, 0, len(h.gaps))
+		for id := range h.gaps {
+			gaps = append(gaps, id)
+		}
+		var err error
+		where, args, err = sqlx.In("ev.id > ? OR ev.id IN (?)", h.lastID, gaps)
+		if err != nil {
+			fmt.Println("Failed to poll email events:", err)
+			return
+		}
+	}
+
+	events, err := loadEmailEvents(where, args...)
+	if err != nil {
+		fmt.Println("Failed to poll email events:", err)
+		return
+	}
+
+	now := time.Now()
+	for id, seen := range h.gaps {
+		if now.Sub(seen) > emailEventGapTimeout {
+			delete(h.gaps, id)
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, event := range events {
+		if event.ID > h.lastID {
+			for id := h.lastID + 1; id < event.ID && len(h.gaps) < maxEmailEventGaps; id++ {
+				h.gaps[id] = now
+			}
+			h.lastID = event.ID
+		} else {
+			delete(h.gaps, event.ID)
+		}
+
+		for ch := range h.subscribers[event.UserID] {
+			select {
+			case ch <- event:
+			default:
+				// Slow client, it can catch up with Last-Event-ID
+			}
+		}
+	}
+}
+
+func (h *emailEventHub) subscribe(userID int64) chan EmailEvent {
+	eventHubOnce.Do(h.start)
+
+	ch := make(chan EmailEvent, 64)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.subscribers[userID] == nil {
+		h.subscribers[userID] = map[chan EmailEvent]struct{}{}
+	}
+	h.subscribers[userID][ch] = struct{}{}
+	return ch
+}
+
+func (h *emailEventHub) unsubscribe(userID int64, ch chan EmailEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.subscribers[userID], ch)
+	if len(h.subscribers[userID]) == 0 {
+		delete(h.subscribers, userID)
+	}
+}
+
+func loadEmailEvents(where string, args ...interface{}) ([]EmailEvent, error) {
+	var events []EmailEvent
+	err := config.DB.Select(&events, `
+		SELECT ev.id,
+			ev.user_id,
+			ev.event_type,
+			ev.email_id,
+			ev.created_at,
+			COALESCE(e.email_type, '') AS email_type,
+			COALESCE(e.is_read, FALSE) AS is_read,
+			COALESCE(e.sender_email, '') AS sender_email,
+			COALESCE(e.sender_name, '') AS sender_name,
+			COALESCE(e.subject, '') AS subject,
+			COALESCE(e.preview, '') AS preview
+		FROM email_events ev
+		LEFT JOIN emails e ON e.id = ev.email_id
+		WHERE `+where+`
+		ORDER BY ev.id ASC
+		LIMIT 500`, args...)
+	return events, err
+}
+
+// StreamEmailHandler streams mailbox changes of the current user as
+// Server-Sent Events. Clients resuming with Last-Event-ID receive the events
+// they missed first.
+func StreamEmailHandler(c echo.Context) error {
+	userID := c.Get("user_id").(int64)
+
+	ch := eventHub.subscribe(userID)
+	defer eventHub.unsubscribe(userID, ch)
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("Connection", "keep-alive")
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+
+	// The hub hands out every event once, late ones with a lower id
+	// included, only the replayed events can come in twice
+	var lastID int64
+	replayed := map[int64]bool{}
+	if lastEventID, err := strconv.ParseInt(c.Request().Header.Get("Last-Event-ID"), 10, 64); err == nil {
+		lastID = lastEventID
+		missed, err := loadEmailEvents("ev.user_id = ? AND ev.id > ?", userID, lastEventID)
+		if err != nil {
+			fmt.Println("Failed to load missed email events:", err)
+		}
+		for _, event := range missed {
+			if err := writeEmailEvent(res, event, event.ID); err != nil {
+				return nil
+			}
+			lastID = event.ID
+			replayed[event.ID] = true
+		}
+	}
+
+	fmt.Fprint(res, "retry: 5000\n\n")
+	res.Flush()
+
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+
+	ctx := c.Request().Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(res, ": ping\n\n"); err != nil {
+				return nil
+			}
+			res.Flush()
+		case event := <-ch:
+			if replayed[event.ID] {
+				continue
+			}
+			if event.ID > lastID {
+				lastID = event.ID
+			}
+			if err := writeEmailEvent(res, event, lastID); err != nil {
+				return nil
+			}
+		}
+	}
+}
+
+// writeEmailEvent sends one event, lastID is the highest id the stream sent
+// so a late event does not move Last-Event-ID back on reconnect.
+func writeEmailEvent(res *echo.Response, event EmailEvent, lastID int64) error {
+	event.EmailEncodeID = utils.EncodeID(int(event.EmailID))
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(res, "id: %d\nevent: %s\ndata: %s\n\n", lastID, event.EventType, data)
+	if err != nil {
+		return err
+	}
+	res.Flush()
+	return nil
+}
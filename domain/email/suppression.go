@@ -0,0 +1,149 @@
+package email
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Triaksa-Space/be-mail-platform/config"
+	"github.com/Triaksa-Space/be-mail-platform/pkg"
+	"github.com/Triaksa-Space/be-mail-platform/utils"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// Why an address is on the suppression list.
+const (
+	SuppressionReasonBounce    = "bounce"
+	SuppressionReasonComplaint = "complaint"
+)
+
+// suppressedRecipientsError lists the recipients of a message that are on
+// the suppression list.
+type suppressedRecipientsError struct {
+	Addresses []string
+}
+
+func (e *suppressedRecipientsError) Error() string {
+	return "Recipients are on the suppression list: " + strings.Join(e.Addresses, ", ")
+}
+
+// suppressRecipient adds an address to the suppression list, or refreshes
+// the reason when it is already there. emailID is the sent email the
+// feedback was about, 0 when unknown.
+func suppressRecipient(address, reason, detail string, emailID int64) error {
+	address = strings.ToLower(strings.TrimSpace(address))
+	if address == "" {
+		return nil
+	}
+
+	var sourceEmailID sql.NullInt64
+	if emailID != 0 {
+		sourceEmailID = sql.NullInt64{Int64: emailID, Valid: true}
+	}
+
+	_, err := config.DB.Exec(`
+		INSERT INTO suppressed_recipients (email, reason, detail, email_id, created_at, updated_at)
+		VALUES (?, ?, ?, ?, NOW(), NOW())
+		ON DUPLICATE KEY UPDATE reason = VALUES(reason), detail = VALUES(detail), email_id = VALUES(email_id), updated_at = NOW()`,
+		address, reason, detail, sourceEmailID)
+	if err != nil {
+		return fmt.Errorf("failed to suppress %s: %v", address, err)
+	}
+	return nil
+}
+
+// checkSuppressedRecipients refuses a message when any of its recipients is
+// on the suppression list, sending to them again only hurts the reputation
+// of the sending domain.
+func checkSuppressedRecipients(recipients pkg.Recipients) error {
+	addresses := recipients.All()
+	if len(addresses) == 0 {
+		return nil
+	}
+
+	query, args, err := sqlx.In("SELECT email FROM suppressed_recipients WHERE email IN (?)", addresses)
+	if err != nil {
+		return err
+	}
+
+	var suppressed []string
+	if err := config.DB.Select(&suppressed, config.DB.Rebind(query), args...); err != nil {
+		return fmt.Errorf("failed to check suppression list: %v", err)
+	}
+	if len(suppressed) > 0 {
+		return &suppressedRecipientsError{Addresses: suppressed}
+	}
+	return nil
+}
+
+func suppressionResponse(c echo.Context, err error) error {
+	if suppressedErr, ok := err.(*suppressedRecipientsError); ok {
+		return c.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error":      suppressedErr.Error(),
+			"recipients": suppressedErr.Addresses,
+		})
+	}
+
+	fmt.Println("Failed to check suppression list", err)
+	return c.JSON(http.StatusInternalServerError, map[string]string{
+		"error": "Failed to check suppression list",
+	})
+}
+
+// ListSuppressedRecipientsHandler lists the suppression list, optionally
+// filtered by address.
+func ListSuppressedRecipientsHandler(c echo.Context) error {
+	query := `
+		SELECT id, email, reason, COALESCE(detail, '') AS detail, created_at, updated_at
+		FROM suppressed_recipients`
+	var args []interface{}
+
+	if email := strings.ToLower(strings.TrimSpace(c.QueryParam("email"))); email != "" {
+		query += " WHERE email LIKE ?"
+		args = append(args, "%"+email+"%")
+	}
+	if reason := c.QueryParam("reason"); reason != "" {
+		if len(args) == 0 {
+			query += " WHERE reason = ?"
+		} else {
+			query += " AND reason = ?"
+		}
+		args = append(args, reason)
+	}
+	query += " ORDER BY id DESC LIMIT 100"
+
+	var recipients []SuppressedRecipient
+	err := config.DB.Select(&recipients, query, args...)
+	if err != nil {
+		fmt.Println("Failed to fetch suppressed recipients", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch suppressed recipients"})
+	}
+	for i := range recipients {
+		recipients[i].SuppressionEncodeID = utils.EncodeID(int(recipients[i].ID))
+	}
+
+	return c.JSON(http.StatusOK, recipients)
+}
+
+// DeleteSuppressedRecipientHandler takes an address off the suppression
+// list, for example once its mailbox is fixed.
+func DeleteSuppressedRecipientHandler(c echo.Context) error {
+	id, err := utils.DecodeID(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid suppressed recipient ID"})
+	}
+
+	result, err := config.DB.Exec("DELETE FROM suppressed_recipients WHERE id = ?", id)
+	if err != nil {
+		fmt.Println("Failed to delete suppressed recipient", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete suppressed recipient"})
+	}
+
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Suppressed recipient not found"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Suppressed recipient deleted successfully"})
+}
@@ -0,0 +1,387 @@
+package email
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Triaksa-Space/be-mail-platform/config"
+	"github.com/Triaksa-Space/be-mail-platform/pkg"
+	"github.com/Triaksa-Space/be-mail-platform/utils"
+	"github.com/jhillyerd/enmime"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// threadSubjectWindow bounds the subject fallback, so that an unrelated
+// "Hello" months later starts a thread of its own.
+const threadSubjectWindow = 30 * 24 * time.Hour
+
+var (
+	messageIDPattern     = regexp.MustCompile(`<([^<>\s]+)>`)
+	subjectPrefixPattern = regexp.MustCompile(`(?i)^\s*((re|fw|fwd|aw|wg|sv|vs|antw)(\[\d+\])?\s*:|\[[^\]]*\])\s*`)
+)
+
+// threadHeaders are what an email is threaded by: the ids of the messages
+// it replies to (In-Reply-To first, then References from newest to oldest),
+// its subject and the addresses of the other parties, see
+// threadParticipants.
+type threadHeaders struct {
+	References   []string
+	Subject      string
+	Participants []string
+}
+
+func threadHeadersFromEnvelope(env *enmime.Envelope) threadHeaders {
+	references := parseMessageIDs(env.GetHeader("In-Reply-To"))
+	ids := parseMessageIDs(env.GetHeader("References"))
+	for i := len(ids) - 1; i >= 0; i-- {
+		references = append(references, ids[i])
+	}
+	return threadHeaders{References: references, Subject: env.GetHeader("Subject")}
+}
+
+// parseMessageIDs extracts the <id> tokens of In-Reply-To or References.
+func parseMessageIDs(value string) []string {
+	var ids []string
+	for _, match := range messageIDPattern.FindAllStringSubmatch(value, -1) {
+		ids = append(ids, normalizeMessageID(match[1]))
+	}
+	return ids
+}
+
+// threadParticipants returns the lowercased addresses of an email without
+// the address of the mailbox owner, who takes part in every thread.
+func threadParticipants(owner string, addresses []string) []string {
+	owner = strings.ToLower(strings.TrimSpace(owner))
+	seen := map[string]bool{}
+	var participants []string
+	for _, address := range addresses {
+		address = strings.ToLower(strings.TrimSpace(address))
+		if address == "" || address == owner || seen[address] {
+			continue
+		}
+		seen[address] = true
+		participants = append(participants, address)
+	}
+	return participants
+}
+
+// normalizeSubject strips reply and forward prefixes and list tags, e.g.
+// "Re: [team] Fwd: Lunch" becomes "lunch".
+func normalizeSubject(subject string) string {
+	for {
+		stripped := subjectPrefixPattern.ReplaceAllString(subject, "")
+		if stripped == subject {
+			break
+		}
+		subject = stripped
+	}
+	subject = strings.ToLower(strings.Join(strings.Fields(subject), " "))
+	return truncateRunes(subject, 255)
+}
+
+// assignThread puts an email of the user in the thread of the messages it
+// refers to, else in the most recent thread with the same normalized
+// subject and a participant in common, else in a new thread identified by
+// the email itself.
+func assignThread(db sqlx.Ext, userID, emailID int64, headers threadHeaders) (int64, error) {
+	threadID, err := findThread(db, userID, emailID, headers)
+	if err != nil {
+		return 0, err
+	}
+	if threadID == 0 {
+		threadID = emailID
+	}
+
+	var subject interface{}
+	if normalized := normalizeSubject(headers.Subject); normalized != "" {
+		subject = normalized
+	}
+
+	_, err = db.Exec("UPDATE emails SET thread_id = ?, thread_subject = ? WHERE id = ?", threadID, subject, emailID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to set thread: %v", err)
+	}
+	return threadID, nil
+}
+
+func findThread(db sqlx.Ext, userID, emailID int64, headers threadHeaders) (int64, error) {
+	var threadID int64
+
+	if len(headers.References) > 0 {
+		query, args, err := sqlx.In(`
+			SELECT thread_id FROM emails
+			WHERE user_id = ? AND id <> ? AND thread_id IS NOT NULL AND header_message_id IN (?)
+			ORDER BY id DESC
+			LIMIT 1`, userID, emailID, headers.References)
+		if err != nil {
+			return 0, err
+		}
+		err = sqlx.Get(db, &threadID, db.Rebind(query), args...)
+		if err == nil {
+			return threadID, nil
+		}
+		if err != sql.ErrNoRows {
+			return 0, fmt.Errorf("failed to find thread by references: %v", err)
+		}
+	}
+
+	// A shared subject alone would merge every "Invoice" of the mailbox, the
+	// other email must also come from or go to one of the participants
+	subject := normalizeSubject(headers.Subject)
+	if subject == "" || len(headers.Participants) == 0 {
+		return 0, nil
+	}
+
+	overlap := []string{"sender_email IN (?)"}
+	args := []interface{}{userID, emailID, subject, time.Now().Add(-threadSubjectWindow), headers.Participants}
+	for _, participant := range headers.Participants {
+		overlap = append(overlap, "FIND_IN_SET(?, to_addresses) > 0")
+		args = append(args, participant)
+	}
+	query, args, err := sqlx.In(`
+		SELECT thread_id FROM emails
+		WHERE user_id = ? AND id <> ? AND thread_id IS NOT NULL AND thread_subject = ? AND timestamp > ?
+			AND (`+strings.Join(overlap, " OR ")+`)
+		ORDER BY timestamp DESC, id DESC
+		LIMIT 1`, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	err = sqlx.Get(db, &threadID, db.Rebind(query), args...)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to find thread by subject: %v", err)
+	}
+	return threadID, nil
+}
+
+// insertSentEmail saves a queued email in the mailbox of the sender and
+// returns its ID. Threading happens once the transaction is committed, see
+// threadSentEmail.
+func insertSentEmail(tx *sql.Tx, userID int64, msg pkg.Message, preview string, attachmentsJSON []byte) (int64, error) {
+	originalUsername := strings.Split(msg.From, "@")[0]
+	result, err := tx.Exec(`
+		INSERT INTO emails (
+			user_id,
+			email_type,
+			status,
+			preview,
+			sender_email,
+			sender_name,
+			to_addresses,
+			cc_addresses,
+			bcc_addresses,
+			subject,
+			body,
+			attachments,
+			header_message_id,
+			timestamp,
+			created_at,
+			updated_at,
+			created_by,
+			updated_by
+		)
+		VALUES (?, "sent", ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NOW(), NOW(), NOW(), ?, ?)`,
+		userID, OutboundStatusQueued, preview, msg.From, originalUsername,
+		strings.Join(msg.Recipients.To, ","), strings.Join(msg.Recipients.Cc, ","), strings.Join(msg.Recipients.Bcc, ","),
+		msg.Subject, msg.HTMLBody, attachmentsJSON, msg.MessageID, userID, userID)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// setEmailThread puts a sent email in a known thread, such as the one of the
+// email it replies to. A failure only costs the grouping, so it is logged.
+func setEmailThread(emailID, threadID int64, subject string) {
+	_, err := config.DB.Exec("UPDATE emails SET thread_id = ?, thread_subject = ? WHERE id = ?",
+		threadID, normalizeSubject(subject), emailID)
+	if err != nil {
+		fmt.Println("Failed to thread sent email", emailID, err)
+	}
+}
+
+// threadSentEmail threads a sent email by its subject and recipients. A
+// failure only costs the grouping, so it is logged.
+func threadSentEmail(userID, emailID int64, msg pkg.Message) {
+	headers := threadHeaders{
+		Subject:      msg.Subject,
+		Participants: threadParticipants(msg.From, msg.Recipients.All()),
+	}
+	_, err := assignThread(config.DB, userID, emailID, headers)
+	if err != nil {
+		fmt.Println("Failed to thread sent email", emailID, err)
+	}
+}
+
+// ListThreadsHandler lists the threads of the current user, most recently
+// active first, with their message and unread counts.
+func ListThreadsHandler(c echo.Context) error {
+	userID := c.Get("user_id").(int64)
+
+	page, err := parseEmailPage(c, 20)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid cursor"})
+	}
+	if page.limit == 0 || page.limit > 100 {
+		page.limit = 20
+	}
+
+	// The latest email is the one at last_timestamp, inbound timestamps come
+	// from the Date header so the highest id may be an older message
+	query := `
+		SELECT e.thread_id,
+			COUNT(*) AS message_count,
+			COALESCE(SUM(e.is_read = FALSE AND e.email_type = 'inbox'), 0) AS unread_count,
+			MAX(e.timestamp) AS last_timestamp,
+			(SELECT l.id FROM emails l
+				WHERE l.user_id = ? AND l.thread_id = e.thread_id AND l.email_type IN ('inbox', 'sent')
+				ORDER BY l.timestamp DESC, l.id DESC
+				LIMIT 1) AS last_email_id
+		FROM emails e
+		WHERE e.user_id = ? AND e.thread_id IS NOT NULL AND e.email_type IN ('inbox', 'sent')
+		GROUP BY e.thread_id`
+	args := []interface{}{userID, userID}
+	if page.hasCursor {
+		query += " HAVING (last_timestamp < ? OR (last_timestamp = ? AND thread_id < ?))"
+		args = append(args, page.timestamp, page.timestamp, page.id)
+	}
+	query += " ORDER BY last_timestamp DESC, thread_id DESC LIMIT ?"
+	args = append(args, page.limit+1)
+
+	var threads []EmailThread
+	if err := config.DB.Select(&threads, query, args...); err != nil {
+		fmt.Println("Failed to fetch threads", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch threads"})
+	}
+
+	var nextCursor string
+	hasMore := len(threads) > page.limit
+	if hasMore {
+		threads = threads[:page.limit]
+		last := threads[len(threads)-1]
+		nextCursor = encodeEmailCursor(last.LastTimestamp, last.ThreadID)
+	}
+
+	if err := loadLatestThreadEmails(threads); err != nil {
+		fmt.Println("Failed to fetch latest thread emails", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch threads"})
+	}
+
+	return c.JSON(http.StatusOK, PaginatedThreads{
+		Threads:    threads,
+		NextCursor: nextCursor,
+		HasMore:    hasMore,
+	})
+}
+
+// loadLatestThreadEmails fills in the subject, sender and preview of the
+// newest email of every thread.
+func loadLatestThreadEmails(threads []EmailThread) error {
+	if len(threads) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, len(threads))
+	for i, thread := range threads {
+		ids[i] = thread.LastEmailID
+	}
+
+	query, args, err := sqlx.In(`
+		SELECT id, sender_email, sender_name, COALESCE(subject, '') AS subject, COALESCE(preview, '') AS preview
+		FROM emails
+		WHERE id IN (?)`, ids)
+	if err != nil {
+		return err
+	}
+
+	var emails []Email
+	if err := config.DB.Select(&emails, config.DB.Rebind(query), args...); err != nil {
+		return err
+	}
+
+	byID := map[int64]Email{}
+	for _, email := range emails {
+		byID[email.ID] = email
+	}
+	for i := range threads {
+		latest := byID[threads[i].LastEmailID]
+		threads[i].ThreadEncodeID = utils.EncodeID(int(threads[i].ThreadID))
+		threads[i].Subject = latest.Subject
+		threads[i].SenderEmail = latest.SenderEmail
+		threads[i].SenderName = latest.SenderName
+		threads[i].Preview = latest.Preview
+		threads[i].RelativeTime = formatRelativeTime(threads[i].LastTimestamp)
+	}
+	return nil
+}
+
+// GetThreadHandler returns the emails of a thread of the current user,
+// oldest first.
+func GetThreadHandler(c echo.Context) error {
+	userID := c.Get("user_id").(int64)
+
+	threadID, err := utils.DecodeID(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid thread ID"})
+	}
+
+	var emails []Email
+	err = config.DB.Select(&emails, `SELECT id,
+			is_read,
+			user_id,
+			sender_email, sender_name,
+			COALESCE(subject, '') AS subject,
+			COALESCE(preview, '') AS preview,
+			body,
+			email_type,
+			COALESCE(label, '') AS label,
+			COALESCE(to_addresses, '') AS to_addresses,
+			COALESCE(cc_addresses, '') AS cc_addresses,
+			COALESCE(bcc_addresses, '') AS bcc_addresses,
+			COALESCE(status, '') AS status,
+			COALESCE(last_error, '') AS last_error,
+			attachments,
+			timestamp,
+			created_at,
+			updated_at
+		FROM emails
+		WHERE user_id = ? AND thread_id = ? AND email_type IN ('inbox', 'sent')
+		ORDER BY timestamp ASC, id ASC`, userID, threadID)
+	if err != nil {
+		fmt.Println("Failed to fetch thread", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch thread"})
+	}
+	if len(emails) == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Thread not found"})
+	}
+
+	thread := ThreadResponse{
+		ThreadEncodeID: c.Param("id"),
+		Subject:        emails[0].Subject,
+		MessageCount:   len(emails),
+		Emails:         make([]EmailResponse, len(emails)),
+	}
+	for i, email := range emails {
+		if email.EmailType == "inbox" && !email.IsRead {
+			thread.UnreadCount++
+		}
+		email.EmailEncodeID = utils.EncodeID(int(email.ID))
+		email.UserEncodeID = utils.EncodeID(int(email.UserID))
+		thread.Emails[i] = EmailResponse{
+			Email:           email,
+			ListAttachments: getAttachmentURLs(email.Attachments),
+			RelativeTime:    formatRelativeTime(email.Timestamp),
+		}
+	}
+
+	return c.JSON(http.StatusOK, thread)
+}
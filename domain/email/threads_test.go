@@ -0,0 +1,127 @@
+package email
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jhillyerd/enmime"
+)
+
+func TestNormalizeSubject(t *testing.T) {
+	tests := []struct {
+		subject string
+		want    string
+	}{
+		{subject: "Lunch", want: "lunch"},
+		{subject: "Re: Lunch", want: "lunch"},
+		{subject: "RE: Fwd: Lunch", want: "lunch"},
+		{subject: "Re: [team] Fwd: Lunch", want: "lunch"},
+		{subject: "[JIRA-12] Re: Lunch", want: "lunch"},
+		{subject: "Re[2]: Lunch", want: "lunch"},
+		{subject: "Fwd : Lunch", want: "lunch"},
+		{subject: "AW: WG: Termin", want: "termin"},
+		{subject: "SV: VS: Antw: Möte", want: "möte"},
+		{subject: "  Hello \t  World  ", want: "hello world"},
+		{subject: "Return policy", want: "return policy"},
+		{subject: "Lunch re: tomorrow", want: "lunch re: tomorrow"},
+		{subject: "Re:", want: ""},
+		{subject: "", want: ""},
+		{subject: strings.Repeat("a", 300), want: strings.Repeat("a", 255)},
+		{subject: strings.Repeat("é", 300), want: strings.Repeat("é", 255)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.subject, func(t *testing.T) {
+			if got := normalizeSubject(tt.subject); got != tt.want {
+				t.Errorf("normalizeSubject(%q) = %q, want %q", tt.subject, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMessageIDs(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  []string
+	}{
+		{name: "empty", value: "", want: nil},
+		{name: "single", value: "<a@example.com>", want: []string{"a@example.com"}},
+		{name: "several", value: "<a@example.com> <b@example.com>", want: []string{"a@example.com", "b@example.com"}},
+		{name: "folded", value: "<a@example.com>\r\n\t<b@example.com>", want: []string{"a@example.com", "b@example.com"}},
+		{name: "with comments", value: "<a@example.com> (sent by Bob)", want: []string{"a@example.com"}},
+		{name: "no brackets", value: "a@example.com", want: nil},
+		{name: "whitespace inside", value: "<a b@example.com>", want: nil},
+		{name: "nested brackets", value: "<<a@example.com>>", want: []string{"a@example.com"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseMessageIDs(tt.value); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseMessageIDs(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestThreadHeadersFromEnvelope(t *testing.T) {
+	raw := "From: bob@example.com\r\n" +
+		"To: alice@example.com\r\n" +
+		"Subject: Re: Lunch\r\n" +
+		"In-Reply-To: <c@example.com>\r\n" +
+		"References: <a@example.com> <b@example.com>\r\n" +
+		"\r\n" +
+		"See you there\r\n"
+	env, err := enmime.ReadEnvelope(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	headers := threadHeadersFromEnvelope(env)
+	want := []string{"c@example.com", "b@example.com", "a@example.com"}
+	if !reflect.DeepEqual(headers.References, want) {
+		t.Errorf("References = %q, want %q", headers.References, want)
+	}
+	if headers.Subject != "Re: Lunch" {
+		t.Errorf("Subject = %q, want %q", headers.Subject, "Re: Lunch")
+	}
+}
+
+func TestThreadParticipants(t *testing.T) {
+	tests := []struct {
+		name      string
+		owner     string
+		addresses []string
+		want      []string
+	}{
+		{name: "no addresses", owner: "alice@example.com", addresses: nil, want: nil},
+		{name: "owner only", owner: "alice@example.com", addresses: []string{"alice@example.com"}, want: nil},
+		{
+			name:      "owner left out",
+			owner:     "alice@example.com",
+			addresses: []string{"bob@example.com", "alice@example.com", "carol@example.com"},
+			want:      []string{"bob@example.com", "carol@example.com"},
+		},
+		{
+			name:      "case and spaces",
+			owner:     "Alice@Example.com",
+			addresses: []string{" ALICE@example.com ", "Bob@Example.com"},
+			want:      []string{"bob@example.com"},
+		},
+		{
+			name:      "duplicates and blanks",
+			owner:     "alice@example.com",
+			addresses: []string{"bob@example.com", "", "BOB@example.com"},
+			want:      []string{"bob@example.com"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := threadParticipants(tt.owner, tt.addresses); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("threadParticipants() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
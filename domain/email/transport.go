@@ -0,0 +1,35 @@
+package email
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/Triaksa-Space/be-mail-platform/config"
+	"github.com/Triaksa-Space/be-mail-platform/pkg"
+)
+
+// sendMessage sends an outbound message through the transport of the domain
+// of its sender and returns the Message-ID.
+func sendMessage(msg pkg.Message) (string, error) {
+	mailer, err := mailerFor(msg.From)
+	if err != nil {
+		return "", err
+	}
+	return mailer.Send(msg)
+}
+
+// mailerFor returns the mailer of the transport set on the domain of the
+// sender, or of MAIL_TRANSPORT when the domain has none.
+func mailerFor(sender string) (pkg.Mailer, error) {
+	var transport string
+	if at := strings.LastIndex(sender, "@"); at >= 0 {
+		err := config.DB.Get(&transport, `
+			SELECT COALESCE(transport, '') FROM domains WHERE domain = ? LIMIT 1`,
+			strings.ToLower(sender[at+1:]))
+		if err != nil && err != sql.ErrNoRows {
+			return nil, fmt.Errorf("failed to fetch transport of %s: %v", sender, err)
+		}
+	}
+	return pkg.NewMailer(transport)
+}
@@ -31,179 +31,38 @@ func LoginHandler(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
 	}
 
-	now := time.Now()
-
-	// Get user attempts info
-	type AttemptsInfo struct {
-		FailedAttempts int          `db:"failed_attempts"`
-		BlockedUntil   sql.NullTime `db:"blocked_until"`
-	}
-	var attempts AttemptsInfo
-
-	err := config.DB.Get(&attempts, `
-		SELECT failed_attempts, blocked_until 
-		FROM user_login_attempts
-		WHERE username = ?
-	`, req.Email)
-
+	user, err := Authenticate(req.Email, req.Password)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			// If no record found, create a default entry with zero attempts
-			_, err = config.DB.Exec(`
-				INSERT INTO user_login_attempts (username, failed_attempts, last_attempt_time)
-				VALUES (?, 0, ?)
-			`, req.Email, now)
-			if err != nil {
-				fmt.Println("Error inserting initial attempts record:", err)
-				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
-			}
-
-			// Refresh attempts info after insert
-			err = config.DB.Get(&attempts, `
-				SELECT failed_attempts, blocked_until 
-				FROM user_login_attempts
-				WHERE username = ?
-			`, req.Email)
-			if err != nil {
-				fmt.Println("Error fetching attempts after insert:", err)
-				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
-			}
-		} else {
-			fmt.Println("Error fetching attempts:", err)
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
-		}
-	}
-
-	// Check if user is currently blocked
-	if attempts.BlockedUntil.Valid && attempts.BlockedUntil.Time.After(now) {
-		remaining := attempts.BlockedUntil.Time.Sub(now)
-		return c.JSON(http.StatusTooManyRequests, map[string]string{
-			"error": fmt.Sprintf("Account temporarily locked. Please try again in %d minutes and %d seconds.",
-				int(remaining.Minutes()), int(remaining.Seconds())%60),
-		})
-	}
-
-	// If block period has passed, reset attempts
-	if attempts.BlockedUntil.Valid && attempts.BlockedUntil.Time.Before(now) {
-		_, err = config.DB.Exec(`
-			UPDATE user_login_attempts
-			SET failed_attempts = 0, blocked_until = NULL
-			WHERE username = ?
-		`, req.Email)
-		if err != nil {
-			fmt.Println("Error resetting attempts after block:", err)
+		loginErr, ok := err.(*LoginError)
+		if !ok {
+			fmt.Println("Error authenticating user:", err)
 			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
 		}
-		attempts.FailedAttempts = 0
-		attempts.BlockedUntil.Valid = false
-	}
-
-	// Fetch user from the database
-	var user User
-	err = config.DB.Get(&user, "SELECT * FROM users WHERE email = ?", req.Email)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			// User not found or password mismatch: increment failed attempts
-			attempts.FailedAttempts++
-			if attempts.FailedAttempts >= 4 {
-				// Block user for 5 minutes
-				blockedUntil := now.Add(5 * time.Minute)
-				_, updateErr := config.DB.Exec(`
-					UPDATE user_login_attempts
-					SET failed_attempts = ?, last_attempt_time = ?, blocked_until = ?
-					WHERE username = ?
-				`, attempts.FailedAttempts, now, blockedUntil, req.Email)
-				if updateErr != nil {
-					fmt.Println("Error updating attempts on block:", updateErr)
-				}
-				return c.JSON(http.StatusTooManyRequests, map[string]string{
-					"error": "Too many failed login attempts. Account locked for 5 minutes.",
-				})
-			} else {
-				// Just update the count
-				_, updateErr := config.DB.Exec(`
-					UPDATE user_login_attempts
-					SET failed_attempts = ?, last_attempt_time = ?
-					WHERE username = ?
-				`, attempts.FailedAttempts, now, req.Email)
-				if updateErr != nil {
-					fmt.Println("Error updating attempts on failure:", updateErr)
-				}
-			}
-			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid email or password"})
-		}
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
-	}
 
-	// Check password
-	if !utils.CheckPasswordHash(req.Password, user.Password) {
-		// Password mismatch: increment failed attempts
-		attempts.FailedAttempts++
-		if attempts.FailedAttempts >= 4 {
-			// Block user for 5 minutes
-			blockedUntil := now.Add(5 * time.Minute)
-			_, updateErr := config.DB.Exec(`
-				UPDATE user_login_attempts
-				SET failed_attempts = ?, last_attempt_time = ?, blocked_until = ?
-				WHERE username = ?
-			`, attempts.FailedAttempts, now, blockedUntil, req.Email)
-			if updateErr != nil {
-				fmt.Println("Error updating attempts on block:", updateErr)
-			}
+		switch {
+		case loginErr.Locked && loginErr.JustLocked:
 			return c.JSON(http.StatusTooManyRequests, map[string]string{
 				"error": "Too many failed login attempts. Account locked for 5 minutes.",
 			})
-		} else if attempts.FailedAttempts == 3 {
-			// Just update the attempts count
-			_, updateErr := config.DB.Exec(`
-				UPDATE user_login_attempts
-				SET failed_attempts = ?, last_attempt_time = ?
-				WHERE username = ?
-			`, attempts.FailedAttempts, now, req.Email)
-			if updateErr != nil {
-				fmt.Println("Error updating attempts on password mismatch:", updateErr)
-			}
+		case loginErr.Locked:
+			return c.JSON(http.StatusTooManyRequests, map[string]string{
+				"error": fmt.Sprintf("Account temporarily locked. Please try again in %d minutes and %d seconds.",
+					int(loginErr.Remaining.Minutes()), int(loginErr.Remaining.Seconds())%60),
+			})
+		case loginErr.AttemptsLeft == 1:
 			return c.JSON(http.StatusTooManyRequests, map[string]string{
 				"error": "Careful! One more failed attempt will disable login for 5 minutes.",
 			})
-		} else {
-			// Just update the attempts count
-			_, updateErr := config.DB.Exec(`
-				UPDATE user_login_attempts
-				SET failed_attempts = ?, last_attempt_time = ?
-				WHERE username = ?
-			`, attempts.FailedAttempts, now, req.Email)
-			if updateErr != nil {
-				fmt.Println("Error updating attempts on password mismatch:", updateErr)
-			}
 		}
 		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid email or password"})
 	}
 
-	// Successful login - reset attempts
-	_, err = config.DB.Exec(`
-		UPDATE user_login_attempts
-		SET failed_attempts = 0, blocked_until = NULL
-		WHERE username = ?
-	`, req.Email)
-	if err != nil {
-		fmt.Println("Error resetting attempts on success:", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
-	}
-
 	token, err := utils.GenerateJWT(user.ID, user.Email, user.RoleID)
 	if err != nil {
 		fmt.Println("GenerateJWT error:", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
 	}
 
-	// Update last login time
-	err = updateLastLogin(user.ID)
-	if err != nil {
-		fmt.Println("error updateLastLogin:", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
-	}
-
 	return c.JSON(http.StatusOK, map[string]string{"token": token})
 }
 
@@ -402,26 +261,41 @@ func CreateUserHandler(c echo.Context) error {
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
 	}
 
+	_, err = CreateMailboxUser(req.Email, hashedPassword, userID, userName)
+	if err != nil {
+		fmt.Println("ERROR", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	return c.JSON(http.StatusCreated, map[string]string{"message": "User created successfully"})
+}
+
+// CreateMailboxUser inserts a regular user (role 1) with an already hashed
+// password and records the address in generated_emails.
+func CreateMailboxUser(email, hashedPassword string, createdBy int64, createdByName string) (int64, error) {
 	// Insert the user into the database
-	_, err = config.DB.Exec(
+	result, err := config.DB.Exec(
 		"INSERT INTO users (email, password, role_id, created_at, updated_at, last_login, created_by, updated_by, created_by_name, updated_by_name) VALUES (?, ?, ?, NOW(), NOW(), NOW(), ?, ?, ?, ?)",
-		req.Email, hashedPassword, 1, userID, userID, userName, userName, // Hardcoded role ID for no, userName, userNamew
+		email, hashedPassword, 1, createdBy, createdBy, createdByName, createdByName,
 	)
 	if err != nil {
-		fmt.Println("ERROR", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return 0, err
+	}
+	userID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
 	}
 
 	// Insert into table generated_email
 	_, err = config.DB.Exec(
 		"INSERT INTO generated_emails (username, created_at, updated_at, created_by, updated_by) VALUES (?, NOW(), NOW(), ?, ?)",
-		req.Email, userID, userID, // Hardcoded role ID for no, userName, userNamew
+		email, createdBy, createdBy,
 	)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return 0, err
 	}
 
-	return c.JSON(http.StatusCreated, map[string]string{"message": "User created successfully"})
+	return userID, nil
 }
 
 func BulkCreateUserHandler(c echo.Context) error {
@@ -741,7 +615,15 @@ func GetUserMeHandler(c echo.Context) error {
 		fmt.Println("error updateLastLogin", err)
 	}
 
-	return c.JSON(http.StatusOK, user)
+	response := UserMeResponse{User: user}
+	quota, err := GetSendQuota(user.ID, user.Email)
+	if err != nil {
+		fmt.Println("error GetSendQuota", err)
+	} else {
+		response.Quota = &quota
+	}
+
+	return c.JSON(http.StatusOK, response)
 }
 
 func ListAdminUsersHandler(c echo.Context) error {
@@ -901,3 +783,78 @@ func getUserAdminByID(userID int64) (string, error) {
 
 	return user, nil
 }
+
+// Authenticate checks credentials for every login, HTTP, IMAP and POP3
+// alike, so they share one lockout: maxLoginAttempts failed attempts block
+// the account for loginBlockDuration. Failures are returned as *LoginError.
+func Authenticate(email, password string) (User, error) {
+	now := time.Now()
+
+	var blockedUntil sql.NullTime
+	var failedAttempts int
+	err := config.DB.QueryRow(`
+		SELECT failed_attempts, blocked_until
+		FROM user_login_attempts
+		WHERE username = ?
+	`, email).Scan(&failedAttempts, &blockedUntil)
+	if err != nil && err != sql.ErrNoRows {
+		return User{}, err
+	}
+
+	if blockedUntil.Valid && blockedUntil.Time.After(now) {
+		return User{}, &LoginError{Locked: true, Remaining: blockedUntil.Time.Sub(now)}
+	}
+	// The block period has passed
+	if blockedUntil.Valid {
+		failedAttempts = 0
+	}
+
+	var user User
+	err = config.DB.Get(&user, "SELECT * FROM users WHERE email = ?", email)
+	if err != nil && err != sql.ErrNoRows {
+		return User{}, err
+	}
+
+	if err == sql.ErrNoRows || !utils.CheckPasswordHash(password, user.Password) {
+		return User{}, recordFailedLogin(email, failedAttempts+1, now)
+	}
+
+	_, err = config.DB.Exec(`
+		UPDATE user_login_attempts
+		SET failed_attempts = 0, blocked_until = NULL
+		WHERE username = ?
+	`, email)
+	if err != nil {
+		fmt.Println("Error resetting attempts on success:", err)
+	}
+
+	err = updateLastLogin(user.ID)
+	if err != nil {
+		fmt.Println("error updateLastLogin:", err)
+	}
+
+	return user, nil
+}
+
+// recordFailedLogin stores a failed attempt and blocks the account once
+// maxLoginAttempts is reached.
+func recordFailedLogin(email string, failedAttempts int, now time.Time) *LoginError {
+	var blockUntil interface{}
+	if failedAttempts >= maxLoginAttempts {
+		blockUntil = now.Add(loginBlockDuration)
+	}
+
+	_, err := config.DB.Exec(`
+		INSERT INTO user_login_attempts (username, failed_attempts, last_attempt_time, blocked_until)
+		VALUES (?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE failed_attempts = VALUES(failed_attempts), last_attempt_time = VALUES(last_attempt_time), blocked_until = VALUES(blocked_until)
+	`, email, failedAttempts, now, blockUntil)
+	if err != nil {
+		fmt.Println("Error updating attempts on failure:", err)
+	}
+
+	if failedAttempts >= maxLoginAttempts {
+		return &LoginError{Locked: true, JustLocked: true, Remaining: loginBlockDuration}
+	}
+	return &LoginError{AttemptsLeft: maxLoginAttempts - failedAttempts}
+}
@@ -1,6 +1,43 @@
 package user
 
-import "time"
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrInvalidCredentials = errors.New("invalid email or password")
+	ErrAccountLocked      = errors.New("account temporarily locked")
+)
+
+// Failed logins allowed before the account is blocked, and for how long.
+const (
+	maxLoginAttempts   = 4
+	loginBlockDuration = 5 * time.Minute
+)
+
+// LoginError is a failed Authenticate. It matches ErrAccountLocked or
+// ErrInvalidCredentials with errors.Is.
+type LoginError struct {
+	Locked       bool
+	JustLocked   bool          // This attempt blocked the account
+	Remaining    time.Duration // Until the block ends
+	AttemptsLeft int           // Before the account is blocked
+}
+
+func (e *LoginError) Error() string {
+	if e.Locked {
+		return ErrAccountLocked.Error()
+	}
+	return ErrInvalidCredentials.Error()
+}
+
+func (e *LoginError) Is(target error) bool {
+	if e.Locked {
+		return target == ErrAccountLocked
+	}
+	return target == ErrInvalidCredentials
+}
 
 type User struct {
 	UserEncodeID  string     `json:"user_encode_id"` // User Encoded ID
@@ -61,3 +98,72 @@ type PaginatedUsers struct {
 	PageSize    int    `json:"page_size"`
 	TotalPages  int    `json:"total_pages"`
 }
+
+// RetentionPolicy limits how much inbox mail a user keeps. A nil limit means
+// no limit; Source tells whether the policy came from the user, the domain
+// or the default.
+type RetentionPolicy struct {
+	ID         int64   `db:"id" json:"-"`
+	UserID     *int64  `db:"user_id" json:"-"`
+	Domain     *string `db:"domain" json:"domain,omitempty"`
+	MaxCount   *int    `db:"max_count" json:"max_count"`
+	MaxAgeDays *int    `db:"max_age_days" json:"max_age_days"`
+	MaxBytes   *int64  `db:"max_bytes" json:"max_bytes"`
+	Source     string  `db:"-" json:"source"`
+}
+
+type RetentionPolicyRequest struct {
+	MaxCount   *int   `json:"max_count"`
+	MaxAgeDays *int   `json:"max_age_days"`
+	MaxBytes   *int64 `json:"max_bytes"`
+}
+
+type RetentionPolicyResponse struct {
+	User      *RetentionPolicy `json:"user"`
+	Domain    *RetentionPolicy `json:"domain"`
+	Effective RetentionPolicy  `json:"effective"`
+}
+
+// Plan is a named set of sending limits. A nil limit means unlimited.
+type Plan struct {
+	ID                 int64  `db:"id" json:"id"`
+	Name               string `db:"name" json:"name"`
+	DailyLimit         *int   `db:"daily_limit" json:"daily_limit"`
+	MonthlyLimit       *int   `db:"monthly_limit" json:"monthly_limit"`
+	MaxRecipients      *int   `db:"max_recipients" json:"max_recipients"`
+	MaxAttachmentBytes *int64 `db:"max_attachment_bytes" json:"max_attachment_bytes"`
+	Source             string `db:"-" json:"source,omitempty"`
+}
+
+type PlanRequest struct {
+	Name               string `json:"name"`
+	DailyLimit         *int   `json:"daily_limit"`
+	MonthlyLimit       *int   `json:"monthly_limit"`
+	MaxRecipients      *int   `json:"max_recipients"`
+	MaxAttachmentBytes *int64 `json:"max_attachment_bytes"`
+}
+
+type AssignPlanRequest struct {
+	Plan string `json:"plan" validate:"required"`
+}
+
+// SendQuota is the plan of a user with the usage of the current period.
+// Days and months roll over at midnight UTC.
+type SendQuota struct {
+	Plan               string    `json:"plan"`
+	DailyLimit         *int      `json:"daily_limit"`
+	DailyUsed          int       `json:"daily_used"`
+	DailyRemaining     *int      `json:"daily_remaining"`
+	DailyResetAt       time.Time `json:"daily_reset_at"`
+	MonthlyLimit       *int      `json:"monthly_limit"`
+	MonthlyUsed        int       `json:"monthly_used"`
+	MonthlyRemaining   *int      `json:"monthly_remaining"`
+	MonthlyResetAt     time.Time `json:"monthly_reset_at"`
+	MaxRecipients      *int      `json:"max_recipients"`
+	MaxAttachmentBytes *int64    `json:"max_attachment_bytes"`
+}
+
+type UserMeResponse struct {
+	User
+	Quota *SendQuota `json:"quota"`
+}
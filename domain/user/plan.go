@@ -0,0 +1,446 @@
+package user
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Triaksa-Space/be-mail-platform/config"
+	"github.com/labstack/echo/v4"
+	"github.com/spf13/viper"
+)
+
+var (
+	ErrDailyLimitExceeded      = errors.New("daily email limit exceeded")
+	ErrMonthlyLimitExceeded    = errors.New("monthly email limit exceeded")
+	ErrTooManyRecipients       = errors.New("too many recipients for your plan")
+	ErrAttachmentLimitExceeded = errors.New("attachments exceed the size allowed by your plan")
+)
+
+// GetPlan returns the sending plan of a user: the plan assigned to the user,
+// otherwise the plan assigned to the address domain, otherwise DEFAULT_PLAN
+// ("free" when unset).
+func GetPlan(userID int64, email string) (Plan, error) {
+	var plan Plan
+	err := config.DB.Get(&plan, `
+		SELECT p.id, p.name, p.daily_limit, p.monthly_limit, p.max_recipients, p.max_attachment_bytes
+		FROM plan_assignments pa
+		JOIN plans p ON p.id = pa.plan_id
+		WHERE pa.user_id = ?`, userID)
+	if err == nil {
+		plan.Source = "user"
+		return plan, nil
+	}
+	if err != sql.ErrNoRows {
+		return Plan{}, err
+	}
+
+	err = config.DB.Get(&plan, `
+		SELECT p.id, p.name, p.daily_limit, p.monthly_limit, p.max_recipients, p.max_attachment_bytes
+		FROM plan_assignments pa
+		JOIN plans p ON p.id = pa.plan_id
+		WHERE pa.domain = ?`, emailDomain(email))
+	if err == nil {
+		plan.Source = "domain"
+		return plan, nil
+	}
+	if err != sql.ErrNoRows {
+		return Plan{}, err
+	}
+
+	name := viper.GetString("DEFAULT_PLAN")
+	if name == "" {
+		name = "free"
+	}
+	err = config.DB.Get(&plan, `
+		SELECT id, name, daily_limit, monthly_limit, max_recipients, max_attachment_bytes
+		FROM plans
+		WHERE name = ?`, name)
+	if err == sql.ErrNoRows {
+		// Keep the historical 3 emails per day when no plan is configured
+		dailyLimit := 3
+		return Plan{Name: name, DailyLimit: &dailyLimit, Source: "default"}, nil
+	}
+	if err != nil {
+		return Plan{}, err
+	}
+	plan.Source = "default"
+	return plan, nil
+}
+
+// GetSendQuota reports the plan limits of a user together with the usage of
+// the current UTC day and month.
+func GetSendQuota(userID int64, email string) (SendQuota, error) {
+	plan, err := GetPlan(userID, email)
+	if err != nil {
+		return SendQuota{}, err
+	}
+
+	now := time.Now().UTC()
+	dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	var usage struct {
+		Daily   int `db:"daily"`
+		Monthly int `db:"monthly"`
+	}
+	err = config.DB.Get(&usage, `
+		SELECT
+			COALESCE(SUM(CASE WHEN usage_date = ? THEN sent_count ELSE 0 END), 0) AS daily,
+			COALESCE(SUM(sent_count), 0) AS monthly
+		FROM user_send_usage
+		WHERE user_id = ? AND usage_date >= ?`,
+		dayStart.Format("2006-01-02"), userID, monthStart.Format("2006-01-02"))
+	if err != nil {
+		return SendQuota{}, err
+	}
+
+	quota := SendQuota{
+		Plan:               plan.Name,
+		DailyLimit:         plan.DailyLimit,
+		DailyUsed:          usage.Daily,
+		DailyResetAt:       dayStart.AddDate(0, 0, 1),
+		MonthlyLimit:       plan.MonthlyLimit,
+		MonthlyUsed:        usage.Monthly,
+		MonthlyResetAt:     monthStart.AddDate(0, 1, 0),
+		MaxRecipients:      plan.MaxRecipients,
+		MaxAttachmentBytes: plan.MaxAttachmentBytes,
+	}
+	if plan.DailyLimit != nil {
+		remaining := *plan.DailyLimit - usage.Daily
+		if remaining < 0 {
+			remaining = 0
+		}
+		quota.DailyRemaining = &remaining
+	}
+	if plan.MonthlyLimit != nil {
+		remaining := *plan.MonthlyLimit - usage.Monthly
+		if remaining < 0 {
+			remaining = 0
+		}
+		quota.MonthlyRemaining = &remaining
+	}
+
+	return quota, nil
+}
+
+// CheckSend reports whether a message to the given number of recipients is
+// allowed by the quota. Every recipient counts as one sent email.
+func (q SendQuota) CheckSend(recipients int) error {
+	if q.MaxRecipients != nil && recipients > *q.MaxRecipients {
+		return ErrTooManyRecipients
+	}
+	if q.DailyRemaining != nil && recipients > *q.DailyRemaining {
+		return ErrDailyLimitExceeded
+	}
+	if q.MonthlyRemaining != nil && recipients > *q.MonthlyRemaining {
+		return ErrMonthlyLimitExceeded
+	}
+	return nil
+}
+
+// CheckAttachments reports whether attachments of the given total size are
+// allowed by the plan.
+func (q SendQuota) CheckAttachments(totalBytes int64) error {
+	if q.MaxAttachmentBytes != nil && totalBytes > *q.MaxAttachmentBytes {
+		return ErrAttachmentLimitExceeded
+	}
+	return nil
+}
+
+// ReserveSentEmails adds count sent emails to today's usage inside tx, or
+// returns ErrDailyLimitExceeded or ErrMonthlyLimitExceeded when the plan has
+// no room left for them. Today's usage row is locked first, so parallel sends
+// of a user are checked one after the other. users.sent_emails is kept in
+// step with today's count for older clients.
+func ReserveSentEmails(tx *sql.Tx, userID int64, email string, count int) error {
+	plan, err := GetPlan(userID, email)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	today := now.Format("2006-01-02")
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	_, err = tx.Exec(`
+		INSERT INTO user_send_usage (user_id, usage_date, sent_count)
+		VALUES (?, ?, 0)
+		ON DUPLICATE KEY UPDATE sent_count = sent_count`, userID, today)
+	if err != nil {
+		return err
+	}
+
+	var daily int
+	err = tx.QueryRow(`
+		SELECT sent_count
+		FROM user_send_usage
+		WHERE user_id = ? AND usage_date = ?
+		FOR UPDATE`, userID, today).Scan(&daily)
+	if err != nil {
+		return err
+	}
+
+	var monthly int
+	err = tx.QueryRow(`
+		SELECT COALESCE(SUM(sent_count), 0)
+		FROM user_send_usage
+		WHERE user_id = ? AND usage_date >= ?
+		FOR UPDATE`, userID, monthStart.Format("2006-01-02")).Scan(&monthly)
+	if err != nil {
+		return err
+	}
+
+	if plan.DailyLimit != nil && daily+count > *plan.DailyLimit {
+		return ErrDailyLimitExceeded
+	}
+	if plan.MonthlyLimit != nil && monthly+count > *plan.MonthlyLimit {
+		return ErrMonthlyLimitExceeded
+	}
+
+	_, err = tx.Exec(`
+		UPDATE user_send_usage
+		SET sent_count = sent_count + ?
+		WHERE user_id = ? AND usage_date = ?`, count, userID, today)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE users
+		SET sent_emails = ?, last_email_time = NOW(), last_login = NOW()
+		WHERE id = ?`, daily+count, userID)
+	return err
+}
+
+func ListPlansHandler(c echo.Context) error {
+	var plans []Plan
+	err := config.DB.Select(&plans, `
+		SELECT id, name, daily_limit, monthly_limit, max_recipients, max_attachment_bytes
+		FROM plans
+		ORDER BY id ASC`)
+	if err != nil {
+		fmt.Println("Failed to fetch plans", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch plans"})
+	}
+
+	return c.JSON(http.StatusOK, plans)
+}
+
+func CreatePlanHandler(c echo.Context) error {
+	req := new(PlanRequest)
+	if err := c.Bind(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+	}
+	if err := validatePlanRequest(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	_, err := config.DB.Exec(`
+		INSERT INTO plans (name, daily_limit, monthly_limit, max_recipients, max_attachment_bytes, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, NOW(), NOW())`,
+		strings.ToLower(req.Name), req.DailyLimit, req.MonthlyLimit, req.MaxRecipients, req.MaxAttachmentBytes)
+	if err != nil {
+		fmt.Println("Failed to create plan", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create plan"})
+	}
+
+	return c.JSON(http.StatusCreated, map[string]string{"message": "Plan created successfully"})
+}
+
+func UpdatePlanHandler(c echo.Context) error {
+	planID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid plan ID"})
+	}
+
+	req := new(PlanRequest)
+	if err := c.Bind(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+	}
+	if err := validatePlanRequest(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	result, err := config.DB.Exec(`
+		UPDATE plans
+		SET name = ?, daily_limit = ?, monthly_limit = ?, max_recipients = ?, max_attachment_bytes = ?, updated_at = NOW()
+		WHERE id = ?`,
+		strings.ToLower(req.Name), req.DailyLimit, req.MonthlyLimit, req.MaxRecipients, req.MaxAttachmentBytes, planID)
+	if err != nil {
+		fmt.Println("Failed to update plan", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update plan"})
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Plan not found"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Plan updated successfully"})
+}
+
+func DeletePlanHandler(c echo.Context) error {
+	planID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid plan ID"})
+	}
+
+	result, err := config.DB.Exec("DELETE FROM plans WHERE id = ?", planID)
+	if err != nil {
+		fmt.Println("Failed to delete plan", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete plan"})
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Plan not found"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Plan deleted successfully"})
+}
+
+// GetUserPlanHandler returns the plan and remaining quota of a user.
+func GetUserPlanHandler(c echo.Context) error {
+	userID, email, err := getManagedUser(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
+	}
+
+	quota, err := GetSendQuota(userID, email)
+	if err != nil {
+		fmt.Println("Failed to fetch send quota", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch plan"})
+	}
+
+	return c.JSON(http.StatusOK, quota)
+}
+
+func AssignUserPlanHandler(c echo.Context) error {
+	req := new(AssignPlanRequest)
+	if err := c.Bind(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+	}
+
+	userID, _, err := getManagedUser(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
+	}
+
+	planID, err := getPlanIDByName(req.Plan)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Plan not found"})
+	}
+
+	editorID := c.Get("user_id").(int64)
+
+	_, err = config.DB.Exec(`
+		INSERT INTO plan_assignments (plan_id, user_id, updated_by, created_at, updated_at)
+		VALUES (?, ?, ?, NOW(), NOW())
+		ON DUPLICATE KEY UPDATE plan_id = VALUES(plan_id), updated_by = VALUES(updated_by), updated_at = NOW()`,
+		planID, userID, editorID)
+	if err != nil {
+		fmt.Println("Failed to assign user plan", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to assign plan"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Plan assigned successfully"})
+}
+
+func DeleteUserPlanHandler(c echo.Context) error {
+	userID, _, err := getManagedUser(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
+	}
+
+	_, err = config.DB.Exec("DELETE FROM plan_assignments WHERE user_id = ?", userID)
+	if err != nil {
+		fmt.Println("Failed to delete user plan", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete plan assignment"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Plan assignment deleted successfully"})
+}
+
+func AssignDomainPlanHandler(c echo.Context) error {
+	domain := strings.ToLower(c.Param("domain"))
+
+	req := new(AssignPlanRequest)
+	if err := c.Bind(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+	}
+
+	var domainExists bool
+	err := config.DB.Get(&domainExists, "SELECT EXISTS(SELECT 1 FROM domains WHERE domain = ?)", domain)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch domain"})
+	}
+	if !domainExists {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Domain not found"})
+	}
+
+	planID, err := getPlanIDByName(req.Plan)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Plan not found"})
+	}
+
+	editorID := c.Get("user_id").(int64)
+
+	_, err = config.DB.Exec(`
+		INSERT INTO plan_assignments (plan_id, domain, updated_by, created_at, updated_at)
+		VALUES (?, ?, ?, NOW(), NOW())
+		ON DUPLICATE KEY UPDATE plan_id = VALUES(plan_id), updated_by = VALUES(updated_by), updated_at = NOW()`,
+		planID, domain, editorID)
+	if err != nil {
+		fmt.Println("Failed to assign domain plan", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to assign plan"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Plan assigned successfully"})
+}
+
+func DeleteDomainPlanHandler(c echo.Context) error {
+	domain := strings.ToLower(c.Param("domain"))
+
+	result, err := config.DB.Exec("DELETE FROM plan_assignments WHERE domain = ?", domain)
+	if err != nil {
+		fmt.Println("Failed to delete domain plan", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete plan assignment"})
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Plan assignment not found"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Plan assignment deleted successfully"})
+}
+
+func getPlanIDByName(name string) (int64, error) {
+	var planID int64
+	err := config.DB.Get(&planID, "SELECT id FROM plans WHERE name = ?", strings.ToLower(name))
+	return planID, err
+}
+
+func validatePlanRequest(req *PlanRequest) error {
+	if strings.TrimSpace(req.Name) == "" {
+		return fmt.Errorf("name is required")
+	}
+	for field, value := range map[string]*int{
+		"daily_limit":    req.DailyLimit,
+		"monthly_limit":  req.MonthlyLimit,
+		"max_recipients": req.MaxRecipients,
+	} {
+		if value != nil && *value < 0 {
+			return fmt.Errorf("%s must not be negative", field)
+		}
+	}
+	if req.MaxAttachmentBytes != nil && *req.MaxAttachmentBytes < 0 {
+		return fmt.Errorf("max_attachment_bytes must not be negative")
+	}
+	return nil
+}
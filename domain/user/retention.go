@@ -0,0 +1,289 @@
+package user
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Triaksa-Space/be-mail-platform/config"
+	"github.com/Triaksa-Space/be-mail-platform/utils"
+	"github.com/labstack/echo/v4"
+	"github.com/spf13/viper"
+)
+
+// GetRetentionPolicy returns the policy that applies to a mailbox: the user
+// policy if one exists, otherwise the policy of the address domain, otherwise
+// the default from RETENTION_DEFAULT_MAX_COUNT (10 messages when unset, which
+// was the historical inbox cap; 0 keeps everything).
+func GetRetentionPolicy(userID int64, email string) (RetentionPolicy, error) {
+	policy, err := getUserRetentionPolicy(userID)
+	if err != nil {
+		return RetentionPolicy{}, err
+	}
+	if policy != nil {
+		return *policy, nil
+	}
+
+	policy, err = getDomainRetentionPolicy(emailDomain(email))
+	if err != nil {
+		return RetentionPolicy{}, err
+	}
+	if policy != nil {
+		return *policy, nil
+	}
+
+	return defaultRetentionPolicy(), nil
+}
+
+func defaultRetentionPolicy() RetentionPolicy {
+	policy := RetentionPolicy{Source: "default"}
+
+	maxCount := 10
+	if viper.IsSet("RETENTION_DEFAULT_MAX_COUNT") {
+		maxCount = viper.GetInt("RETENTION_DEFAULT_MAX_COUNT")
+	}
+	if maxCount > 0 {
+		policy.MaxCount = &maxCount
+	}
+
+	return policy
+}
+
+func getUserRetentionPolicy(userID int64) (*RetentionPolicy, error) {
+	var policy RetentionPolicy
+	err := config.DB.Get(&policy, `
+		SELECT id, user_id, domain, max_count, max_age_days, max_bytes
+		FROM retention_policies
+		WHERE user_id = ?`, userID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	policy.Source = "user"
+	return &policy, nil
+}
+
+func getDomainRetentionPolicy(domain string) (*RetentionPolicy, error) {
+	if domain == "" {
+		return nil, nil
+	}
+
+	var policy RetentionPolicy
+	err := config.DB.Get(&policy, `
+		SELECT id, user_id, domain, max_count, max_age_days, max_bytes
+		FROM retention_policies
+		WHERE domain = ?`, domain)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	policy.Source = "domain"
+	return &policy, nil
+}
+
+func emailDomain(email string) string {
+	parts := strings.Split(email, "@")
+	if len(parts) != 2 {
+		return ""
+	}
+	return strings.ToLower(parts[1])
+}
+
+func validateRetentionRequest(req *RetentionPolicyRequest) error {
+	if req.MaxCount != nil && *req.MaxCount < 1 {
+		return fmt.Errorf("max_count must be at least 1")
+	}
+	if req.MaxAgeDays != nil && *req.MaxAgeDays < 1 {
+		return fmt.Errorf("max_age_days must be at least 1")
+	}
+	if req.MaxBytes != nil && *req.MaxBytes < 1 {
+		return fmt.Errorf("max_bytes must be at least 1")
+	}
+	return nil
+}
+
+func GetUserRetentionHandler(c echo.Context) error {
+	userID, email, err := getManagedUser(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
+	}
+
+	userPolicy, err := getUserRetentionPolicy(userID)
+	if err != nil {
+		fmt.Println("Failed to fetch user retention policy", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch retention policy"})
+	}
+
+	domainPolicy, err := getDomainRetentionPolicy(emailDomain(email))
+	if err != nil {
+		fmt.Println("Failed to fetch domain retention policy", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch retention policy"})
+	}
+
+	effective, err := GetRetentionPolicy(userID, email)
+	if err != nil {
+		fmt.Println("Failed to fetch retention policy", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch retention policy"})
+	}
+
+	return c.JSON(http.StatusOK, RetentionPolicyResponse{
+		User:      userPolicy,
+		Domain:    domainPolicy,
+		Effective: effective,
+	})
+}
+
+func UpdateUserRetentionHandler(c echo.Context) error {
+	req := new(RetentionPolicyRequest)
+	if err := c.Bind(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+	}
+	if err := validateRetentionRequest(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	userID, email, err := getManagedUser(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
+	}
+
+	editorID := c.Get("user_id").(int64)
+
+	_, err = config.DB.Exec(`
+		INSERT INTO retention_policies (user_id, max_count, max_age_days, max_bytes, updated_by, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, NOW(), NOW())
+		ON DUPLICATE KEY UPDATE
+			max_count = VALUES(max_count),
+			max_age_days = VALUES(max_age_days),
+			max_bytes = VALUES(max_bytes),
+			updated_by = VALUES(updated_by),
+			updated_at = NOW()`,
+		userID, req.MaxCount, req.MaxAgeDays, req.MaxBytes, editorID)
+	if err != nil {
+		fmt.Println("Failed to save user retention policy", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to save retention policy"})
+	}
+
+	effective, err := GetRetentionPolicy(userID, email)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch retention policy"})
+	}
+
+	return c.JSON(http.StatusOK, effective)
+}
+
+// DeleteUserRetentionHandler removes the user policy so the mailbox falls
+// back to the domain or default policy.
+func DeleteUserRetentionHandler(c echo.Context) error {
+	userID, _, err := getManagedUser(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
+	}
+
+	_, err = config.DB.Exec("DELETE FROM retention_policies WHERE user_id = ?", userID)
+	if err != nil {
+		fmt.Println("Failed to delete user retention policy", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete retention policy"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Retention policy deleted successfully"})
+}
+
+func GetDomainRetentionHandler(c echo.Context) error {
+	domain := strings.ToLower(c.Param("domain"))
+
+	policy, err := getDomainRetentionPolicy(domain)
+	if err != nil {
+		fmt.Println("Failed to fetch domain retention policy", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch retention policy"})
+	}
+	if policy == nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Retention policy not found"})
+	}
+
+	return c.JSON(http.StatusOK, policy)
+}
+
+func UpdateDomainRetentionHandler(c echo.Context) error {
+	domain := strings.ToLower(c.Param("domain"))
+
+	req := new(RetentionPolicyRequest)
+	if err := c.Bind(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+	}
+	if err := validateRetentionRequest(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	var domainExists bool
+	err := config.DB.Get(&domainExists, "SELECT EXISTS(SELECT 1 FROM domains WHERE domain = ?)", domain)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch domain"})
+	}
+	if !domainExists {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Domain not found"})
+	}
+
+	editorID := c.Get("user_id").(int64)
+
+	_, err = config.DB.Exec(`
+		INSERT INTO retention_policies (domain, max_count, max_age_days, max_bytes, updated_by, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, NOW(), NOW())
+		ON DUPLICATE KEY UPDATE
+			max_count = VALUES(max_count),
+			max_age_days = VALUES(max_age_days),
+			max_bytes = VALUES(max_bytes),
+			updated_by = VALUES(updated_by),
+			updated_at = NOW()`,
+		domain, req.MaxCount, req.MaxAgeDays, req.MaxBytes, editorID)
+	if err != nil {
+		fmt.Println("Failed to save domain retention policy", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to save retention policy"})
+	}
+
+	policy, err := getDomainRetentionPolicy(domain)
+	if err != nil || policy == nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch retention policy"})
+	}
+
+	return c.JSON(http.StatusOK, policy)
+}
+
+func DeleteDomainRetentionHandler(c echo.Context) error {
+	domain := strings.ToLower(c.Param("domain"))
+
+	result, err := config.DB.Exec("DELETE FROM retention_policies WHERE domain = ?", domain)
+	if err != nil {
+		fmt.Println("Failed to delete domain retention policy", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete retention policy"})
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Retention policy not found"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Retention policy deleted successfully"})
+}
+
+// getManagedUser resolves the encoded id of a user managed by an admin.
+func getManagedUser(encodedID string) (int64, string, error) {
+	userIDDecode, err := utils.DecodeID(encodedID)
+	if err != nil {
+		return 0, "", err
+	}
+
+	var email string
+	err = config.DB.Get(&email, "SELECT email FROM users WHERE role_id = 1 AND id = ?", strconv.Itoa(userIDDecode))
+	if err != nil {
+		return 0, "", err
+	}
+
+	return int64(userIDDecode), email, nil
+}
@@ -17,6 +17,11 @@ func JWTMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 
 		// Extract the token from the Authorization header
 		authHeader := c.Request().Header.Get("Authorization")
+
+		// EventSource cannot set headers, so event streams may pass the token as a query parameter
+		if authHeader == "" && c.Request().Header.Get("Accept") == "text/event-stream" && c.QueryParam("token") != "" {
+			authHeader = "Bearer " + c.QueryParam("token")
+		}
 		if !strings.HasPrefix(authHeader, "Bearer ") {
 			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Missing or invalid token"})
 		}
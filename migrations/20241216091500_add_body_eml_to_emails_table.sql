@@ -0,0 +1,9 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE emails ADD COLUMN body_eml LONGBLOB NULL AFTER body;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE emails DROP COLUMN body_eml;
+-- +goose StatementEnd
@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE emails ADD COLUMN body_text LONGTEXT NULL AFTER body_eml;
+-- +goose StatementEnd
+-- Existing rows are filled in by email.BackfillBodyText, which strips the
+-- HTML the way new rows get it
+-- +goose StatementBegin
+ALTER TABLE emails ADD FULLTEXT INDEX ft_emails_search (subject, sender_email, sender_name, body_text, attachments);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE emails DROP INDEX ft_emails_search;
+-- +goose StatementEnd
+-- +goose StatementBegin
+ALTER TABLE emails DROP COLUMN body_text;
+-- +goose StatementEnd
@@ -0,0 +1,21 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE retention_policies (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    user_id BIGINT NULL,
+    domain VARCHAR(255) NULL,
+    max_count INT NULL,
+    max_age_days INT NULL,
+    max_bytes BIGINT NULL,
+    updated_by BIGINT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    UNIQUE KEY uq_retention_policies_user (user_id),
+    UNIQUE KEY uq_retention_policies_domain (domain)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS retention_policies;
+-- +goose StatementEnd
@@ -0,0 +1,59 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE plans (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    name VARCHAR(64) NOT NULL,
+    daily_limit INT NULL,
+    monthly_limit INT NULL,
+    max_recipients INT NULL,
+    max_attachment_bytes BIGINT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    UNIQUE KEY uq_plans_name (name)
+);
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+INSERT INTO plans (name, daily_limit, monthly_limit, max_recipients, max_attachment_bytes) VALUES
+    ('free', 3, 60, 1, 10485760),
+    ('pro', 100, 2000, 50, 26214400),
+    ('internal', NULL, NULL, NULL, NULL);
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE TABLE plan_assignments (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    plan_id BIGINT NOT NULL,
+    user_id BIGINT NULL,
+    domain VARCHAR(255) NULL,
+    updated_by BIGINT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    UNIQUE KEY uq_plan_assignments_user (user_id),
+    UNIQUE KEY uq_plan_assignments_domain (domain),
+    FOREIGN KEY (plan_id) REFERENCES plans(id) ON DELETE CASCADE
+);
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE TABLE user_send_usage (
+    user_id BIGINT NOT NULL,
+    usage_date DATE NOT NULL,
+    sent_count INT NOT NULL DEFAULT 0,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, usage_date)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS user_send_usage;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+DROP TABLE IF EXISTS plan_assignments;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+DROP TABLE IF EXISTS plans;
+-- +goose StatementEnd
@@ -0,0 +1,23 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE incoming_emails
+    ADD COLUMN status VARCHAR(16) NOT NULL DEFAULT 'pending' AFTER processed_at,
+    ADD COLUMN attempts INT NOT NULL DEFAULT 0 AFTER status,
+    ADD COLUMN last_error TEXT NULL AFTER attempts,
+    ADD COLUMN next_attempt_at DATETIME NULL AFTER last_error,
+    ADD COLUMN claimed_by VARCHAR(64) NULL AFTER next_attempt_at,
+    ADD COLUMN claimed_at DATETIME NULL AFTER claimed_by,
+    ADD INDEX idx_incoming_emails_claim (processed, status, next_attempt_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE incoming_emails
+    DROP INDEX idx_incoming_emails_claim,
+    DROP COLUMN claimed_at,
+    DROP COLUMN claimed_by,
+    DROP COLUMN next_attempt_at,
+    DROP COLUMN last_error,
+    DROP COLUMN attempts,
+    DROP COLUMN status;
+-- +goose StatementEnd
@@ -0,0 +1,39 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE raw_emails (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    message_id VARCHAR(255) NOT NULL,
+    email_data LONGBLOB NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_raw_emails_message_id (message_id)
+);
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+ALTER TABLE incoming_emails
+    MODIFY COLUMN email_data LONGBLOB NULL,
+    ADD COLUMN raw_email_id BIGINT NULL AFTER email_data,
+    DROP INDEX message_id,
+    ADD UNIQUE KEY uq_incoming_emails_message_recipient (message_id, email_send_to);
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+ALTER TABLE emails ADD COLUMN raw_email_id BIGINT NULL AFTER body_eml;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE emails DROP COLUMN raw_email_id;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+ALTER TABLE incoming_emails
+    DROP INDEX uq_incoming_emails_message_recipient,
+    ADD UNIQUE KEY message_id (message_id),
+    DROP COLUMN raw_email_id,
+    MODIFY COLUMN email_data LONGBLOB NOT NULL;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+DROP TABLE IF EXISTS raw_emails;
+-- +goose StatementEnd
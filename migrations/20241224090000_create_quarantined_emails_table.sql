@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE quarantined_emails (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    raw_email_id BIGINT NOT NULL,
+    message_id VARCHAR(255) NOT NULL,
+    recipients TEXT NOT NULL,
+    sender_email VARCHAR(255) NULL,
+    subject VARCHAR(255) NULL,
+    email_date DATETIME NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_quarantined_emails_created_at (created_at)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS quarantined_emails;
+-- +goose StatementEnd
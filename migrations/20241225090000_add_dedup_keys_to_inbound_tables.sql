@@ -0,0 +1,59 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE raw_emails
+    ADD COLUMN content_hash CHAR(64) NULL AFTER email_data,
+    ADD COLUMN header_message_id VARCHAR(255) NULL AFTER content_hash,
+    ADD INDEX idx_raw_emails_content_hash (content_hash);
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+ALTER TABLE incoming_emails
+    ADD COLUMN content_hash CHAR(64) NULL AFTER raw_email_id,
+    ADD COLUMN header_message_id VARCHAR(255) NULL AFTER content_hash,
+    ADD INDEX idx_incoming_emails_send_to_hash (email_send_to, content_hash),
+    ADD INDEX idx_incoming_emails_send_to_header_id (email_send_to, header_message_id);
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+ALTER TABLE emails
+    ADD COLUMN content_hash CHAR(64) NULL AFTER raw_email_id,
+    ADD COLUMN header_message_id VARCHAR(255) NULL AFTER message_id,
+    ADD UNIQUE KEY uq_emails_user_content_hash (user_id, content_hash),
+    ADD INDEX idx_emails_user_header_message_id (user_id, header_message_id);
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+ALTER TABLE quarantined_emails
+    ADD COLUMN content_hash CHAR(64) NULL AFTER raw_email_id,
+    ADD INDEX idx_quarantined_emails_content_hash (content_hash);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE quarantined_emails
+    DROP INDEX idx_quarantined_emails_content_hash,
+    DROP COLUMN content_hash;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+ALTER TABLE emails
+    DROP INDEX idx_emails_user_header_message_id,
+    DROP INDEX uq_emails_user_content_hash,
+    DROP COLUMN header_message_id,
+    DROP COLUMN content_hash;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+ALTER TABLE incoming_emails
+    DROP INDEX idx_incoming_emails_send_to_header_id,
+    DROP INDEX idx_incoming_emails_send_to_hash,
+    DROP COLUMN header_message_id,
+    DROP COLUMN content_hash;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+ALTER TABLE raw_emails
+    DROP INDEX idx_raw_emails_content_hash,
+    DROP COLUMN header_message_id,
+    DROP COLUMN content_hash;
+-- +goose StatementEnd
@@ -0,0 +1,22 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE emails
+    ADD COLUMN thread_id BIGINT NULL AFTER user_id,
+    ADD COLUMN thread_subject VARCHAR(255) NULL AFTER thread_id,
+    ADD INDEX idx_emails_user_thread (user_id, thread_id),
+    ADD INDEX idx_emails_user_thread_subject (user_id, thread_subject);
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+-- Existing emails start out as threads of their own
+UPDATE emails SET thread_id = id WHERE thread_id IS NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE emails
+    DROP INDEX idx_emails_user_thread_subject,
+    DROP INDEX idx_emails_user_thread,
+    DROP COLUMN thread_subject,
+    DROP COLUMN thread_id;
+-- +goose StatementEnd
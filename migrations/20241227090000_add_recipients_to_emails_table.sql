@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Comma separated recipients of sent emails
+ALTER TABLE emails
+    ADD COLUMN to_addresses TEXT NULL AFTER sender_name,
+    ADD COLUMN cc_addresses TEXT NULL AFTER to_addresses,
+    ADD COLUMN bcc_addresses TEXT NULL AFTER cc_addresses;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE emails
+    DROP COLUMN bcc_addresses,
+    DROP COLUMN cc_addresses,
+    DROP COLUMN to_addresses;
+-- +goose StatementEnd
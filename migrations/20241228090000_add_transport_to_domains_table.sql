@@ -0,0 +1,10 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Outbound transport of the domain, MAIL_TRANSPORT when NULL
+ALTER TABLE domains ADD COLUMN transport VARCHAR(20) NULL AFTER domain;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE domains DROP COLUMN transport;
+-- +goose StatementEnd
@@ -0,0 +1,40 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE outbound_emails (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    email_id BIGINT NOT NULL,
+    user_id BIGINT NOT NULL,
+    message_id VARCHAR(255) NOT NULL,
+    payload LONGBLOB NOT NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'queued',
+    attempts INT NOT NULL DEFAULT 0,
+    last_error TEXT NULL,
+    next_attempt_at DATETIME NULL,
+    claimed_by VARCHAR(64) NULL,
+    claimed_at DATETIME NULL,
+    sent_at DATETIME NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    INDEX idx_outbound_emails_claim (status, next_attempt_at),
+    INDEX idx_outbound_emails_email (email_id),
+    FOREIGN KEY (email_id) REFERENCES emails(id) ON DELETE CASCADE
+);
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+-- Delivery state of sent emails, NULL for received ones
+ALTER TABLE emails
+    ADD COLUMN status VARCHAR(16) NULL AFTER email_type,
+    ADD COLUMN last_error TEXT NULL AFTER status;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE emails
+    DROP COLUMN last_error,
+    DROP COLUMN status;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+DROP TABLE IF EXISTS outbound_emails;
+-- +goose StatementEnd
@@ -0,0 +1,28 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Addresses that hard bounced or complained, sending to them is refused
+CREATE TABLE suppressed_recipients (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    email VARCHAR(255) NOT NULL,
+    reason VARCHAR(16) NOT NULL,
+    detail TEXT NULL,
+    email_id BIGINT NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    UNIQUE KEY uniq_suppressed_recipients_email (email)
+);
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+-- SES notifications name sent emails by their Message-ID
+ALTER TABLE emails ADD INDEX idx_emails_header_message_id (header_message_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE emails DROP INDEX idx_emails_header_message_id;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+DROP TABLE IF EXISTS suppressed_recipients;
+-- +goose StatementEnd
@@ -0,0 +1,22 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Recipients a sent email could not be delivered to, from SES bounces and
+-- DSN bounce messages
+CREATE TABLE delivery_failures (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    email_id BIGINT NOT NULL,
+    recipient VARCHAR(255) NOT NULL,
+    status VARCHAR(32) NULL,
+    diagnostic TEXT NULL,
+    source VARCHAR(16) NOT NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    UNIQUE KEY uniq_delivery_failures_recipient (email_id, recipient, source),
+    FOREIGN KEY (email_id) REFERENCES emails(id) ON DELETE CASCADE
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS delivery_failures;
+-- +goose StatementEnd
@@ -0,0 +1,21 @@
+-- +goose Up
+-- +goose StatementBegin
+-- SES notifications name sent emails by the ID SendRawEmail returned,
+-- header_message_id holds it with the SES domain added
+ALTER TABLE emails
+    ADD COLUMN ses_message_id VARCHAR(255) NULL AFTER header_message_id,
+    ADD INDEX idx_emails_ses_message_id (ses_message_id);
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+UPDATE emails
+SET ses_message_id = SUBSTRING_INDEX(header_message_id, '@', 1)
+WHERE email_type = 'sent' AND header_message_id LIKE '%@%.amazonses.com';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE emails
+    DROP INDEX idx_emails_ses_message_id,
+    DROP COLUMN ses_message_id;
+-- +goose StatementEnd
@@ -2,21 +2,19 @@ package pkg
 
 import (
 	"bytes"
-	"encoding/base64"
 	"fmt"
 	"io"
-	"mime/multipart"
-	"net/textproto"
+	"net/url"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/ses"
 	"github.com/spf13/viper"
-	"gopkg.in/gomail.v2"
 )
 
 // Attachment represents an email attachment
@@ -27,6 +25,38 @@ type Attachment struct {
 	URL         string
 }
 
+// Recipients are the addresses of an outbound email. Bcc addresses are only
+// given to the transport, they never appear in the headers.
+type Recipients struct {
+	To  []string
+	Cc  []string
+	Bcc []string
+}
+
+// All returns every address the email is delivered to.
+func (r Recipients) All() []string {
+	all := make([]string, 0, len(r.To)+len(r.Cc)+len(r.Bcc))
+	all = append(all, r.To...)
+	all = append(all, r.Cc...)
+	return append(all, r.Bcc...)
+}
+
+// Count returns the number of addresses the email is delivered to.
+func (r Recipients) Count() int {
+	return len(r.To) + len(r.Cc) + len(r.Bcc)
+}
+
+// SplitAddresses splits a comma separated list of addresses.
+func SplitAddresses(addresses string) []string {
+	var result []string
+	for _, address := range strings.Split(addresses, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			result = append(result, address)
+		}
+	}
+	return result
+}
+
 func InitAWS() (*session.Session, error) {
 	// Initialize AWS session
 	sess, err := session.NewSession(&aws.Config{
@@ -191,24 +221,11 @@ func UploadPreSignAttachment(content []byte, key string, contentType string) (st
 	return urlStr, nil
 }
 
-// SendEmailWithAttachmentURL sends an email with optional attachments using AWS SES
-func SendEmailWithAttachmentURL(toAddress, fromAddress, subject, htmlBody string, attachments []Attachment) error {
-	// Initialize AWS session
-	sess, err := InitAWS()
-	if err != nil {
-		return fmt.Errorf("failed to create AWS session: %v", err)
-	}
-
-	sesClient := ses.New(sess)
-
-	// Build the email body
-	var emailRaw bytes.Buffer
-	writer := multipart.NewWriter(&emailRaw)
-
-	// Write MIME headers
-	emailHeaders := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=\"%s\"\r\n\r\n",
-		fromAddress, toAddress, subject, writer.Boundary())
-	emailRaw.Write([]byte(emailHeaders))
+// WithAttachmentLinks returns the message with its attachments, already stored
+// in S3, replaced by download links appended to the body
+func WithAttachmentLinks(msg Message) Message {
+	attachments := msg.Attachments
+	htmlBody := msg.HTMLBody
 
 	// Calculate items per row and create rows of attachments
 	const itemsPerRow = 4
@@ -277,32 +294,18 @@ func SendEmailWithAttachmentURL(toAddress, fromAddress, subject, htmlBody string
         `, len(attachments), val, strings.Join(attachmentRows, ""))
 	}
 
-	// Write the HTML body part
-	htmlPartHeaders := textproto.MIMEHeader{}
-	htmlPartHeaders.Set("Content-Type", "text/html; charset=UTF-8")
-	htmlPartHeaders.Set("Content-Transfer-Encoding", "base64")
-
-	htmlPart, _ := writer.CreatePart(htmlPartHeaders)
-	encodedBody := base64.StdEncoding.EncodeToString([]byte(htmlBody))
-	htmlPart.Write([]byte(encodedBody))
-
-	fmt.Println("htmlPart", htmlPart)
-
-	writer.Close()
-
-	// Send the email
-	input := &ses.SendRawEmailInput{
-		RawMessage: &ses.RawMessage{
-			Data: emailRaw.Bytes(),
-		},
-	}
-
-	_, err = sesClient.SendRawEmail(input)
-	if err != nil {
-		return fmt.Errorf("failed to send email: %v", err)
+	// A text part given by the user gets the links as well
+	if msg.TextBody != "" && len(attachments) > 0 {
+		msg.TextBody += "\n\nAttachments:\n"
+		for _, att := range attachments {
+			msg.TextBody += fmt.Sprintf("%s: %s\n", transformFilename(att.Filename), att.URL)
+		}
 	}
 
-	return nil
+	// The links replace the attachments
+	msg.HTMLBody = htmlBody
+	msg.Attachments = nil
+	return msg
 }
 
 // TransformFilename transforms the filename to the desired format
@@ -317,183 +320,161 @@ func TransformFilename(filename string) string {
 	return filename
 }
 
-// SendEmailWithHARAKA sends an email with optional attachments using Haraka SMTP server
-func SendEmailWithHARAKA(toAddress, fromAddress, subject, htmlBody string, attachments []Attachment) error {
-	// SMTP server configuration
-	smtpHost := viper.GetString("SMTP_HOST")
-	smtpPort := viper.GetInt("SMTP_PORT")
-	smtpUser := viper.GetString("SMTP_USERNAME")
-	smtpPassword := viper.GetString("SMTP_PASSWORD")
-
-	fmt.Println("SMTP_HOST: ", smtpHost)
-	fmt.Println("SMTP_USERNAME: ", smtpUser)
-
-	// Create a new email message
-	m := gomail.NewMessage()
-	m.SetHeader("From", fromAddress)
-	m.SetHeader("To", toAddress)
-	m.SetHeader("Subject", subject)
-	m.SetBody("text/html", htmlBody)
+// TransformFilename transforms the filename to the desired format
+func transformFilename(filename string) string {
+	// Split the filename by underscore
+	parts := strings.Split(filename, "_")
+	if len(parts) > 1 {
+		// Return the last part of the split filename
+		return parts[len(parts)-1]
+	}
+	// Return the original filename if it doesn't contain an underscore
+	return filename
+}
 
-	// Calculate items per row and create rows of attachments
-	const itemsPerRow = 4
-	var attachmentRows []string
-	var currentRow []string
+// SendEmail sends an email with optional attachments using the default
+// transport
+func SendEmail(toAddress, fromAddress, subject, htmlBody string, attachments []Attachment) error {
+	mailer, err := NewMailer("")
+	if err != nil {
+		return err
+	}
 
-	for i, att := range attachments {
-		transformedFilename := TransformFilename(att.Filename)
-		attachmentItem := fmt.Sprintf(`
-        <div style="display: inline-block; margin: 0 10px; width: calc(25%% - 20px); min-width: 200px; vertical-align: top;">
-            <div style="border: 1px solid #e0e0e0; border-radius: 4px; background: #f8f9fa; padding: 12px; 
-                        transition: all 0.2s ease-in-out; cursor: pointer;"
-                 onmouseover="this.style.backgroundColor='#f0f0f0'; this.style.boxShadow='0 2px 5px rgba(0,0,0,0.1)'" 
-                 onmouseout="this.style.backgroundColor='#f8f9fa'; this.style.boxShadow='none'">
-                <a href="%s" style="text-decoration: none;" download="%s">
-                    <table cellpadding="0" cellspacing="0" style="width: 100%%;">
-                        <tr>
-                            <td style="width: 36px; vertical-align: top;">
-                                <img src="https://www.gstatic.com/images/icons/material/system_gm/1x/attach_file_grey600_24dp.png" 
-                                     alt="Attachment" style="width: 24px; height: 24px;">
-                            </td>
-                            <td style="padding-left: 8px;">
-                                <div style="font-family: Arial, sans-serif;">
-                                    <div style="color: #1a73e8; font-size: 14px; 
-                                            white-space: nowrap; overflow: hidden; text-overflow: ellipsis;" 
-                                         title="%s">%s</div>
-                                    <div style="color: #5f6368; font-size: 12px; margin-top: 4px;">
-                                        Click to download
-                                    </div>
-                                </div>
-                            </td>
-                        </tr>
-                    </table>
-                </a>
-            </div>
-        </div>
-        `, att.URL, att.Filename, transformedFilename, transformedFilename)
+	_, err = mailer.Send(Message{
+		From:        fromAddress,
+		Recipients:  Recipients{To: SplitAddresses(toAddress)},
+		Subject:     subject,
+		HTMLBody:    htmlBody,
+		Attachments: attachments,
+	})
+	return err
+}
 
-		currentRow = append(currentRow, attachmentItem)
+// SESMailer sends messages using AWS SES.
+type SESMailer struct{}
 
-		// When we reach itemsPerRow items or it's the last item, create a row
-		if len(currentRow) == itemsPerRow || i == len(attachments)-1 {
-			row := fmt.Sprintf(`
-            <div style="display: flex; justify-content: flex-start; margin-bottom: 20px; flex-wrap: wrap;">
-                %s
-            </div>`, strings.Join(currentRow, ""))
-			attachmentRows = append(attachmentRows, row)
-			currentRow = []string{} // Reset current row
-		}
+// Send returns the Message-ID SES gave the message, as SES replaces the one
+// we set.
+func (SESMailer) Send(msg Message) (string, error) {
+	// Initialize AWS session
+	sess, err := InitAWS()
+	if err != nil {
+		return "", fmt.Errorf("failed to create AWS session: %v", err)
 	}
 
-	// If there are attachments, append them to the HTML body
-	if len(attachmentRows) > 0 {
-		val := ""
-		if len(attachments) > 1 {
-			val = "s"
-		}
+	sesClient := ses.New(sess)
 
-		htmlBody += fmt.Sprintf(`
-            <div style="margin-top: 20px; border-top: 1px solid #e0e0e0; padding-top: 20px;">
-                <div style="color: #5f6368; font-family: Arial, sans-serif; font-size: 14px; margin-bottom: 10px;">
-                    %d Attachment%s
-                </div>
-                %s
-            </div>
-        `, len(attachments), val, strings.Join(attachmentRows, ""))
+	raw, err := msg.Build()
+	if err != nil {
+		return "", fmt.Errorf("failed to build email: %v", err)
 	}
 
-	// Add attachments to the email
-	for _, att := range attachments {
-		m.Attach(att.Filename, gomail.SetCopyFunc(func(w io.Writer) error {
-			_, err := w.Write(att.Content)
-			return err
-		}))
+	// Send the email, the destinations include the Bcc addresses
+	input := &ses.SendRawEmailInput{
+		Destinations: aws.StringSlice(msg.Recipients.All()),
+		RawMessage: &ses.RawMessage{
+			Data: raw,
+		},
 	}
 
-	// Send the email using Haraka SMTP
-	d := gomail.NewDialer(smtpHost, smtpPort, smtpUser, smtpPassword)
-	if err := d.DialAndSend(m); err != nil {
-		fmt.Println("SendMail via HARAKA err", err)
-		return fmt.Errorf("failed to send email: %v", err)
+	output, err := sesClient.SendRawEmail(input)
+	if err != nil {
+		// Rejected messages and unverified senders fail the same way again
+		if aerr, ok := err.(awserr.Error); ok {
+			switch aerr.Code() {
+			case ses.ErrCodeMessageRejected, ses.ErrCodeMailFromDomainNotVerifiedException:
+				return "", PermanentError{Err: fmt.Errorf("failed to send email: %v", err)}
+			}
+		}
+		return "", fmt.Errorf("failed to send email: %v", err)
 	}
 
-	fmt.Println("Email sent successfully")
-	return nil
+	return sesMessageID(aws.StringValue(output.MessageId)), nil
 }
 
-// TransformFilename transforms the filename to the desired format
-func transformFilename(filename string) string {
-	// Split the filename by underscore
-	parts := strings.Split(filename, "_")
-	if len(parts) > 1 {
-		// Return the last part of the split filename
-		return parts[len(parts)-1]
+// sesMessageID turns the ID SendRawEmail returns into the Message-ID header
+// SES sets on the message.
+func sesMessageID(id string) string {
+	region := viper.GetString("AWS_REGION")
+	if region == "" || region == "us-east-1" {
+		return id + "@email.amazonses.com"
 	}
-	// Return the original filename if it doesn't contain an underscore
-	return filename
+	return id + "@" + region + ".amazonses.com"
 }
 
-// SendEmail sends an email with optional attachments using AWS SES
-func SendEmail(toAddress, fromAddress, subject, htmlBody string, attachments []Attachment) error {
-	// Initialize AWS session
-	sess, _ := InitAWS()
+// SESMessageID returns the ID SendRawEmail returned for a Message-ID made by
+// sesMessageID, "" when the message was not sent through SES.
+func SESMessageID(messageID string) string {
+	at := strings.LastIndex(messageID, "@")
+	if at <= 0 || !strings.HasSuffix(messageID[at+1:], ".amazonses.com") {
+		return ""
+	}
+	return messageID[:at]
+}
 
-	sesClient := ses.New(sess)
+// AttachmentObjectKey returns the S3 key of an attachment URL made by
+// UploadAttachment. The URLs of sent emails and drafts come from the client,
+// so only objects under attachments/ in S3_BUCKET_NAME are accepted and the
+// bucket is never taken from the URL.
+func AttachmentObjectKey(objectURL string) (string, error) {
+	parsedURL, err := url.Parse(objectURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid attachment URL: %v", err)
+	}
 
-	// Build the email body
-	var emailRaw bytes.Buffer
-	writer := multipart.NewWriter(&emailRaw)
-
-	// Write MIME headers
-	emailHeaders := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=\"%s\"\r\n\r\n",
-		fromAddress, toAddress, subject, writer.Boundary())
-	emailRaw.Write([]byte(emailHeaders))
-
-	// Write the HTML body part
-	htmlPartHeaders := textproto.MIMEHeader{}
-	htmlPartHeaders.Set("Content-Type", "text/html; charset=UTF-8")
-	htmlPartHeaders.Set("Content-Transfer-Encoding", "base64")
-
-	htmlPart, _ := writer.CreatePart(htmlPartHeaders)
-	encodedBody := base64.StdEncoding.EncodeToString([]byte(htmlBody))
-	htmlPart.Write([]byte(encodedBody))
-
-	// Write attachments
-	for _, att := range attachments {
-		attachmentPartHeaders := textproto.MIMEHeader{}
-		attachmentPartHeaders.Set("Content-Type", att.ContentType+"; name=\""+att.Filename+"\"")
-		attachmentPartHeaders.Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", att.Filename))
-		attachmentPartHeaders.Set("Content-Transfer-Encoding", "base64")
-
-		attachmentPart, err := writer.CreatePart(attachmentPartHeaders)
-		if err != nil {
-			return err
-		}
+	bucketName := viper.GetString("S3_BUCKET_NAME")
+	host := strings.ToLower(parsedURL.Hostname())
+	if parsedURL.Scheme != "https" || bucketName == "" ||
+		!strings.HasPrefix(host, strings.ToLower(bucketName)+".s3.") || !strings.HasSuffix(host, ".amazonaws.com") {
+		return "", fmt.Errorf("not an attachment URL: %s", objectURL)
+	}
 
-		// Stream encode to handle large files
-		encoder := base64.NewEncoder(base64.StdEncoding, attachmentPart)
-		_, err = encoder.Write(att.Content)
-		if err != nil {
-			return err
+	// The SDK cleans the request path, a dot segment could leave the prefix
+	key := strings.TrimPrefix(parsedURL.Path, "/")
+	if !strings.HasPrefix(key, "attachments/") {
+		return "", fmt.Errorf("not an attachment URL: %s", objectURL)
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return "", fmt.Errorf("not an attachment URL: %s", objectURL)
 		}
-		encoder.Close()
 	}
+	return key, nil
+}
 
-	writer.Close()
+// DownloadAttachment fetches an attachment stored by UploadAttachment from
+// its S3 URL and returns the content and content type.
+func DownloadAttachment(objectURL string) ([]byte, string, error) {
+	key, err := AttachmentObjectKey(objectURL)
+	if err != nil {
+		return nil, "", err
+	}
+	bucket := viper.GetString("S3_BUCKET_NAME")
 
-	// Send the email
-	input := &ses.SendRawEmailInput{
-		RawMessage: &ses.RawMessage{
-			Data: emailRaw.Bytes(),
-		},
+	sess, err := InitAWS()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create AWS session: %v", err)
+	}
+
+	output, err := s3.New(sess).GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get attachment: %v", err)
 	}
+	defer output.Body.Close()
 
-	_, err := sesClient.SendRawEmail(input)
+	content, err := io.ReadAll(output.Body)
 	if err != nil {
-		return fmt.Errorf("failed to send email: %v", err)
+		return nil, "", fmt.Errorf("failed to read attachment: %v", err)
 	}
 
-	return nil
+	contentType := aws.StringValue(output.ContentType)
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return content, contentType, nil
 }
 
 func ExtractNameFromEmail(email string) string {
@@ -0,0 +1,69 @@
+package pkg
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestAttachmentObjectKey(t *testing.T) {
+	viper.Set("S3_BUCKET_NAME", "mail-bucket")
+	defer viper.Set("S3_BUCKET_NAME", "")
+
+	tests := []struct {
+		name    string
+		url     string
+		wantKey string
+		wantErr bool
+	}{
+		{name: "uploaded file", url: "https://mail-bucket.s3.us-east-1.amazonaws.com/attachments/sent/1_a.pdf", wantKey: "attachments/sent/1_a.pdf"},
+		{name: "inbound attachment", url: "https://mail-bucket.s3.ap-southeast-1.amazonaws.com/attachments/abc@example.com/7/report.pdf", wantKey: "attachments/abc@example.com/7/report.pdf"},
+		{name: "other bucket", url: "https://other-bucket.s3.us-east-1.amazonaws.com/attachments/sent/1_a.pdf", wantErr: true},
+		{name: "bucket prefix", url: "https://mail-bucket-2.s3.us-east-1.amazonaws.com/attachments/sent/1_a.pdf", wantErr: true},
+		{name: "other host", url: "https://mail-bucket.s3.evil.example.com/attachments/sent/1_a.pdf", wantErr: true},
+		{name: "plain http", url: "http://mail-bucket.s3.us-east-1.amazonaws.com/attachments/sent/1_a.pdf", wantErr: true},
+		{name: "outside the prefix", url: "https://mail-bucket.s3.us-east-1.amazonaws.com/user@example.com/message", wantErr: true},
+		{name: "dot segments", url: "https://mail-bucket.s3.us-east-1.amazonaws.com/attachments/../message", wantErr: true},
+		{name: "encoded dot segments", url: "https://mail-bucket.s3.us-east-1.amazonaws.com/attachments/%2E%2E/message", wantErr: true},
+		{name: "not a URL", url: "report.pdf", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := AttachmentObjectKey(tt.url)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("AttachmentObjectKey(%q) = %q, want an error", tt.url, key)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("AttachmentObjectKey(%q) returned %v", tt.url, err)
+			}
+			if key != tt.wantKey {
+				t.Errorf("AttachmentObjectKey(%q) = %q, want %q", tt.url, key, tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestSESMessageID(t *testing.T) {
+	tests := []struct {
+		messageID string
+		want      string
+	}{
+		{messageID: "0100018c-abc@email.amazonses.com", want: "0100018c-abc"},
+		{messageID: "0100018c-abc@ap-southeast-1.amazonses.com", want: "0100018c-abc"},
+		{messageID: "1703.abc@mail.example.com", want: ""},
+		{messageID: "@email.amazonses.com", want: ""},
+		{messageID: "", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.messageID, func(t *testing.T) {
+			if got := SESMessageID(tt.messageID); got != tt.want {
+				t.Errorf("SESMessageID(%q) = %q, want %q", tt.messageID, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/spf13/viper"
+	"gopkg.in/gomail.v2"
+)
+
+// Outbound transports, set with MAIL_TRANSPORT or per domain.
+const (
+	TransportSES    = "ses"
+	TransportSMTP   = "smtp"
+	TransportHaraka = "haraka"
+	TransportFile   = "file"
+)
+
+// Mailer sends outbound messages through one transport.
+type Mailer interface {
+	// Send delivers the message and returns its Message-ID, without angle
+	// brackets.
+	Send(msg Message) (string, error)
+}
+
+// PermanentError marks a failure that retrying cannot fix, such as a message
+// the transport rejected for good. The outbound and incoming queues give up
+// on such rows at once.
+type PermanentError struct {
+	Err error
+}
+
+func (e PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+// IsTransport reports whether name is a known transport.
+func IsTransport(name string) bool {
+	switch name {
+	case TransportSES, TransportSMTP, TransportHaraka, TransportFile:
+		return true
+	}
+	return false
+}
+
+// DefaultTransport returns MAIL_TRANSPORT, SES when it is not set.
+func DefaultTransport() string {
+	transport := strings.ToLower(viper.GetString("MAIL_TRANSPORT"))
+	if transport == "" {
+		return TransportSES
+	}
+	return transport
+}
+
+// NewMailer returns the mailer of a transport, the default one when empty.
+func NewMailer(transport string) (Mailer, error) {
+	if transport == "" {
+		transport = DefaultTransport()
+	}
+
+	switch transport {
+	case TransportSES:
+		return SESMailer{}, nil
+	case TransportSMTP:
+		return newSMTPMailer("SMTP"), nil
+	case TransportHaraka:
+		return newSMTPMailer("HARAKA"), nil
+	case TransportFile:
+		dir := viper.GetString("MAIL_FILE_DIR")
+		if dir == "" {
+			dir = "maildir"
+		}
+		return FileMailer{Dir: dir}, nil
+	}
+	return nil, fmt.Errorf("unknown mail transport %q", transport)
+}
+
+// SMTPMailer relays messages to an SMTP server such as Haraka.
+type SMTPMailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+}
+
+// newSMTPMailer reads <prefix>_HOST, _PORT, _USERNAME and _PASSWORD, falling
+// back to the SMTP_ settings.
+func newSMTPMailer(prefix string) SMTPMailer {
+	setting := func(name string) string {
+		if value := viper.GetString(prefix + "_" + name); value != "" {
+			return value
+		}
+		return viper.GetString("SMTP_" + name)
+	}
+	port := viper.GetInt(prefix + "_PORT")
+	if port == 0 {
+		port = viper.GetInt("SMTP_PORT")
+	}
+
+	return SMTPMailer{
+		Host:     setting("HOST"),
+		Port:     port,
+		Username: setting("USERNAME"),
+		Password: setting("PASSWORD"),
+	}
+}
+
+func (m SMTPMailer) Send(msg Message) (string, error) {
+	raw, err := msg.Build()
+	if err != nil {
+		return "", fmt.Errorf("failed to build email: %v", err)
+	}
+
+	sender, err := envelopeSender(msg.From)
+	if err != nil {
+		return "", err
+	}
+
+	conn, err := gomail.NewDialer(m.Host, m.Port, m.Username, m.Password).Dial()
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to %s: %v", m.Host, err)
+	}
+	defer conn.Close()
+
+	// The envelope holds every recipient, Bcc ones are not in the headers
+	if err := conn.Send(sender, msg.Recipients.All(), rawMessage(raw)); err != nil {
+		// 5xx replies are final, 4xx ones are worth another try
+		var reply *textproto.Error
+		if errors.As(err, &reply) && reply.Code >= 500 {
+			return "", PermanentError{Err: fmt.Errorf("failed to send email: %v", err)}
+		}
+		return "", fmt.Errorf("failed to send email: %v", err)
+	}
+	return msg.MessageID, nil
+}
+
+// FileMailer writes messages into a maildir instead of sending them, for
+// local development and tests.
+type FileMailer struct {
+	Dir string
+}
+
+func (m FileMailer) Send(msg Message) (string, error) {
+	raw, err := msg.Build()
+	if err != nil {
+		return "", fmt.Errorf("failed to build email: %v", err)
+	}
+
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(m.Dir, sub), 0o755); err != nil {
+			return "", fmt.Errorf("failed to create maildir: %v", err)
+		}
+	}
+
+	// Written under tmp first so readers never see a partial message
+	name := fmt.Sprintf("%d.%s.eml", time.Now().UnixNano(), uuid.New().String())
+	tmpPath := filepath.Join(m.Dir, "tmp", name)
+	if err := os.WriteFile(tmpPath, raw, 0o644); err != nil {
+		return "", fmt.Errorf("failed to write email: %v", err)
+	}
+	if err := os.Rename(tmpPath, filepath.Join(m.Dir, "new", name)); err != nil {
+		return "", fmt.Errorf("failed to deliver email: %v", err)
+	}
+
+	fmt.Println("Wrote email", msg.MessageID, "to", filepath.Join(m.Dir, "new", name))
+	return msg.MessageID, nil
+}
+
+// envelopeSender returns the bare address of a From header.
+func envelopeSender(from string) (string, error) {
+	addr, err := mail.ParseAddress(from)
+	if err != nil {
+		return "", fmt.Errorf("invalid sender %q: %v", from, err)
+	}
+	return addr.Address, nil
+}
+
+// rawMessage lets gomail send a message built by Message.Build.
+type rawMessage []byte
+
+func (r rawMessage) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(r)
+	return int64(n), err
+}
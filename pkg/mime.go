@@ -0,0 +1,272 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jaytaylor/html2text"
+)
+
+// maxBase64Line is the longest encoded line RFC 2045 allows.
+const maxBase64Line = 76
+
+// maxHeaderLine is the line length RFC 5322 asks headers to be folded at.
+const maxHeaderLine = 78
+
+// Message is an outbound email. Build turns it into the raw MIME message:
+// multipart/mixed holding a multipart/alternative text and HTML body followed
+// by the attachments.
+type Message struct {
+	From        string
+	Recipients  Recipients
+	Subject     string
+	HTMLBody    string
+	TextBody    string // Generated from HTMLBody when empty
+	Headers     map[string]string
+	Attachments []Attachment
+	MessageID   string // Without angle brackets, generated by Build when empty
+}
+
+// Build returns the raw MIME form of the message.
+func (m *Message) Build() ([]byte, error) {
+	if m.MessageID == "" {
+		m.MessageID = GenerateMessageID(m.From)
+	}
+
+	var raw bytes.Buffer
+	writeHeader(&raw, "From", encodeAddressList([]string{m.From}))
+	to := encodeAddressList(m.Recipients.To)
+	if to == "" {
+		to = "undisclosed-recipients:;"
+	}
+	writeHeader(&raw, "To", to)
+	if len(m.Recipients.Cc) > 0 {
+		writeHeader(&raw, "Cc", encodeAddressList(m.Recipients.Cc))
+	}
+	writeHeader(&raw, "Subject", mime.QEncoding.Encode("UTF-8", m.Subject))
+	writeHeader(&raw, "Date", time.Now().Format(time.RFC1123Z))
+	writeHeader(&raw, "Message-ID", "<"+m.MessageID+">")
+
+	names := make([]string, 0, len(m.Headers))
+	for name := range m.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeHeader(&raw, name, m.Headers[name])
+	}
+	writeHeader(&raw, "MIME-Version", "1.0")
+
+	body, bodyHeader, err := m.buildBody()
+	if err != nil {
+		return nil, err
+	}
+
+	// Without attachments the body is the whole message
+	if len(m.Attachments) == 0 {
+		for _, name := range []string{"Content-Type", "Content-Transfer-Encoding"} {
+			if value := bodyHeader.Get(name); value != "" {
+				writeHeader(&raw, name, value)
+			}
+		}
+		raw.WriteString("\r\n")
+		raw.Write(body)
+		return raw.Bytes(), nil
+	}
+
+	writer := multipart.NewWriter(&raw)
+	writeHeader(&raw, "Content-Type", mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": writer.Boundary()}))
+	raw.WriteString("\r\n")
+
+	bodyPart, err := writer.CreatePart(bodyHeader)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := bodyPart.Write(body); err != nil {
+		return nil, err
+	}
+
+	for _, att := range m.Attachments {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", attachmentContentType(att))
+		header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": att.Filename}))
+		header.Set("Content-Transfer-Encoding", "base64")
+
+		part, err := writer.CreatePart(header)
+		if err != nil {
+			return nil, err
+		}
+		encoder := base64.NewEncoder(base64.StdEncoding, &lineWriter{w: part})
+		if _, err := encoder.Write(att.Content); err != nil {
+			return nil, err
+		}
+		if err := encoder.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return raw.Bytes(), nil
+}
+
+// attachmentContentType returns the Content-Type of an attachment part with
+// its name added. Types come from upload headers and S3 objects, so they may
+// carry parameters already or not parse at all.
+func attachmentContentType(att Attachment) string {
+	mediaType, params, err := mime.ParseMediaType(att.ContentType)
+	if err != nil {
+		mediaType, params = "application/octet-stream", map[string]string{}
+	}
+	params["name"] = att.Filename
+	if contentType := mime.FormatMediaType(mediaType, params); contentType != "" {
+		return contentType
+	}
+	return mime.FormatMediaType("application/octet-stream", map[string]string{"name": att.Filename})
+}
+
+// buildBody returns the multipart/alternative body and its headers, or a
+// single text/plain part when there is no HTML.
+func (m *Message) buildBody() ([]byte, textproto.MIMEHeader, error) {
+	text := m.TextBody
+	if text == "" && m.HTMLBody != "" {
+		text = HTMLToText(m.HTMLBody)
+	}
+
+	var body bytes.Buffer
+	if m.HTMLBody == "" {
+		if err := writeQuotedPrintable(&body, text); err != nil {
+			return nil, nil, err
+		}
+		return body.Bytes(), textPartHeader("text/plain; charset=UTF-8"), nil
+	}
+
+	writer := multipart.NewWriter(&body)
+	// Clients show the last alternative they support, so HTML comes last
+	for _, alternative := range []struct{ contentType, content string }{
+		{"text/plain; charset=UTF-8", text},
+		{"text/html; charset=UTF-8", m.HTMLBody},
+	} {
+		part, err := writer.CreatePart(textPartHeader(alternative.contentType))
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := writeQuotedPrintable(part, alternative.content); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, nil, err
+	}
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", mime.FormatMediaType("multipart/alternative", map[string]string{"boundary": writer.Boundary()}))
+	return body.Bytes(), header, nil
+}
+
+func textPartHeader(contentType string) textproto.MIMEHeader {
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Transfer-Encoding", "quoted-printable")
+	return header
+}
+
+// HTMLToText renders an HTML body as plain text for the text alternative.
+func HTMLToText(htmlBody string) string {
+	text, err := html2text.FromString(htmlBody, html2text.Options{})
+	if err != nil {
+		return ""
+	}
+	return text
+}
+
+func writeQuotedPrintable(w io.Writer, content string) error {
+	encoder := quotedprintable.NewWriter(w)
+	if _, err := encoder.Write([]byte(content)); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// writeHeader writes one header, folded at spaces so that long values such
+// as References stay within maxHeaderLine where they can. Line breaks are
+// dropped from the value so user input cannot add headers.
+func writeHeader(buf *bytes.Buffer, name, value string) {
+	value = strings.NewReplacer("\r", "", "\n", "").Replace(value)
+
+	line := name + ":"
+	for i, word := range strings.Split(value, " ") {
+		if i > 0 && word != "" && len(line)+1+len(word) > maxHeaderLine {
+			buf.WriteString(line + "\r\n")
+			line = ""
+		}
+		line += " " + word
+	}
+	buf.WriteString(line + "\r\n")
+}
+
+// encodeAddressList formats addresses for a header, RFC 2047 encoding the
+// display names. Values that are not addresses, such as groups, are kept.
+func encodeAddressList(addresses []string) string {
+	encoded := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		if parsed, err := mail.ParseAddress(address); err == nil {
+			encoded = append(encoded, parsed.String())
+		} else {
+			encoded = append(encoded, address)
+		}
+	}
+	return strings.Join(encoded, ", ")
+}
+
+// GenerateMessageID returns a unique Message-ID on the domain of the sender.
+func GenerateMessageID(from string) string {
+	domain := "localhost"
+	if parsed, err := mail.ParseAddress(from); err == nil {
+		if at := strings.LastIndex(parsed.Address, "@"); at >= 0 {
+			domain = parsed.Address[at+1:]
+		}
+	}
+	return uuid.New().String() + "@" + domain
+}
+
+// lineWriter breaks a base64 stream into lines of at most maxBase64Line
+// characters.
+type lineWriter struct {
+	w io.Writer
+	n int
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := maxBase64Line - l.n
+		if chunk > len(p) {
+			chunk = len(p)
+		}
+		if _, err := l.w.Write(p[:chunk]); err != nil {
+			return written, err
+		}
+		l.n += chunk
+		written += chunk
+		p = p[chunk:]
+
+		if l.n == maxBase64Line {
+			if _, err := l.w.Write([]byte("\r\n")); err != nil {
+				return written, err
+			}
+			l.n = 0
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,340 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+// part is a leaf of a parsed message, with its raw (still encoded) lines.
+type part struct {
+	contentType string
+	encoding    string
+	filename    string
+	raw         []byte
+}
+
+// parseParts walks a message depth first, returning the multipart layout as
+// content types (e.g. "multipart/mixed[multipart/alternative[text/plain
+// text/html] image/png]") and the leaves.
+func parseParts(t *testing.T, contentType, encoding string, body []byte) (string, []part) {
+	t.Helper()
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		t.Fatalf("invalid Content-Type %q: %v", contentType, err)
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		leaf := part{contentType: mediaType, encoding: encoding, raw: body}
+		return mediaType, []part{leaf}
+	}
+
+	var layout []string
+	var leaves []part
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		p, err := reader.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		childLayout, childLeaves := parseParts(t, p.Header.Get("Content-Type"), p.Header.Get("Content-Transfer-Encoding"), content)
+		if _, dispositionParams, err := mime.ParseMediaType(p.Header.Get("Content-Disposition")); err == nil && len(childLeaves) == 1 {
+			childLeaves[0].filename = dispositionParams["filename"]
+		}
+		layout = append(layout, childLayout)
+		leaves = append(leaves, childLeaves...)
+	}
+	return mediaType + "[" + strings.Join(layout, " ") + "]", leaves
+}
+
+func buildTestMessage(t *testing.T, m Message) (*mail.Message, []byte) {
+	t.Helper()
+
+	raw, err := m.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Build() returned an unparsable message: %v\n%s", err, raw)
+	}
+	body, err := io.ReadAll(msg.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg, body
+}
+
+func TestMessageBuildLayout(t *testing.T) {
+	png := bytes.Repeat([]byte{0x89, 'P', 'N', 'G', 0x00, 0xff}, 100)
+
+	tests := []struct {
+		name       string
+		message    Message
+		wantLayout string
+		wantFiles  []string
+	}{
+		{
+			name:       "plain text",
+			message:    Message{From: "alice@example.com", TextBody: "Hello"},
+			wantLayout: "text/plain",
+		},
+		{
+			name:       "html",
+			message:    Message{From: "alice@example.com", HTMLBody: "<p>Hello</p>"},
+			wantLayout: "multipart/alternative[text/plain text/html]",
+		},
+		{
+			name: "html with attachments",
+			message: Message{
+				From:     "alice@example.com",
+				HTMLBody: "<p>Hello</p>",
+				Attachments: []Attachment{
+					{Filename: "logo.png", ContentType: "image/png", Content: png},
+					{Filename: "notes.bin", Content: []byte("raw")},
+				},
+			},
+			wantLayout: "multipart/mixed[multipart/alternative[text/plain text/html] image/png application/octet-stream]",
+			wantFiles:  []string{"logo.png", "notes.bin"},
+		},
+		{
+			name: "text with attachment",
+			message: Message{
+				From:        "alice@example.com",
+				TextBody:    "Hello",
+				Attachments: []Attachment{{Filename: "résumé.pdf", ContentType: "application/pdf", Content: []byte("%PDF")}},
+			},
+			wantLayout: "multipart/mixed[text/plain application/pdf]",
+			wantFiles:  []string{"résumé.pdf"},
+		},
+		{
+			name: "attachment types with parameters",
+			message: Message{
+				From:     "alice@example.com",
+				TextBody: "Hello",
+				Attachments: []Attachment{
+					{Filename: "a.txt", ContentType: "text/plain; charset=utf-8", Content: []byte("a")},
+					{Filename: "b.csv", ContentType: "text/csv; name=old.csv", Content: []byte("b")},
+					{Filename: "c.bin", ContentType: "not a type;;", Content: []byte("c")},
+				},
+			},
+			wantLayout: "multipart/mixed[text/plain text/plain text/csv application/octet-stream]",
+			wantFiles:  []string{"a.txt", "b.csv", "c.bin"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, body := buildTestMessage(t, tt.message)
+			if got := msg.Header.Get("MIME-Version"); got != "1.0" {
+				t.Errorf("MIME-Version = %q, want 1.0", got)
+			}
+
+			layout, leaves := parseParts(t, msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), body)
+			if layout != tt.wantLayout {
+				t.Errorf("layout = %s, want %s", layout, tt.wantLayout)
+			}
+
+			var files []string
+			for _, leaf := range leaves {
+				if leaf.filename != "" {
+					files = append(files, leaf.filename)
+				}
+			}
+			if strings.Join(files, ",") != strings.Join(tt.wantFiles, ",") {
+				t.Errorf("attachments = %q, want %q", files, tt.wantFiles)
+			}
+		})
+	}
+}
+
+func TestMessageBuildLineLengths(t *testing.T) {
+	longLine := strings.Repeat("The quick brown fox jumps over the lazy dog. ", 40)
+	binary := make([]byte, 10000)
+	for i := range binary {
+		binary[i] = byte(i * 7)
+	}
+
+	tests := []struct {
+		name    string
+		content []byte
+	}{
+		{name: "empty", content: []byte{}},
+		{name: "shorter than a line", content: []byte("abc")},
+		{name: "exactly one line", content: bytes.Repeat([]byte("a"), 57)},
+		{name: "binary", content: binary},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, body := buildTestMessage(t, Message{
+				From:        "alice@example.com",
+				HTMLBody:    "<p>" + longLine + "</p>",
+				TextBody:    longLine + "\nnon-ASCII: żółć\n",
+				Attachments: []Attachment{{Filename: "data.bin", Content: tt.content}},
+			})
+
+			_, leaves := parseParts(t, msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), body)
+			for _, leaf := range leaves {
+				for _, line := range strings.Split(strings.TrimRight(string(leaf.raw), "\r\n"), "\r\n") {
+					if len(line) > maxBase64Line {
+						t.Errorf("%s line of %d characters: %q", leaf.contentType, len(line), line)
+					}
+				}
+
+				switch leaf.encoding {
+				case "quoted-printable", "base64":
+				default:
+					t.Errorf("%s encoded as %q", leaf.contentType, leaf.encoding)
+				}
+			}
+
+			attachment := leaves[len(leaves)-1]
+			encoded := strings.NewReplacer("\r", "", "\n", "").Replace(string(attachment.raw))
+			if got, want := encoded, base64.StdEncoding.EncodeToString(tt.content); got != want {
+				t.Errorf("attachment = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestMessageBuildSubject(t *testing.T) {
+	tests := []struct {
+		name    string
+		subject string
+		encoded bool
+	}{
+		{name: "ascii", subject: "Quarterly report", encoded: false},
+		{name: "latin", subject: "Café menu", encoded: true},
+		{name: "cjk", subject: "会议记录", encoded: true},
+		{name: "emoji", subject: "Party 🎉", encoded: true},
+		{name: "long non-ascii", subject: strings.Repeat("Zażółć gęślą jaźń ", 10), encoded: true},
+	}
+
+	decoder := new(mime.WordDecoder)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := (&Message{From: "alice@example.com", Subject: tt.subject, TextBody: "Hello"}).Build()
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg, err := mail.ReadMessage(bytes.NewReader(raw))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			header := msg.Header.Get("Subject")
+			if got := strings.Contains(header, "=?UTF-8?"); got != tt.encoded {
+				t.Errorf("Subject header %q encoded = %v, want %v", header, got, tt.encoded)
+			}
+			for _, c := range header {
+				if c > 127 {
+					t.Fatalf("Subject header %q is not ASCII", header)
+				}
+			}
+
+			decoded, err := decoder.DecodeHeader(header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decoded != tt.subject {
+				t.Errorf("decoded Subject = %q, want %q", decoded, tt.subject)
+			}
+		})
+	}
+}
+
+func TestMessageBuildHeaders(t *testing.T) {
+	var references []string
+	for i := 0; i < 20; i++ {
+		references = append(references, "<"+strings.Repeat("x", 30)+string(rune('a'+i))+"@example.com>")
+	}
+
+	raw, err := (&Message{
+		From:       "Alice <alice@example.com>",
+		Recipients: Recipients{To: []string{"bob@example.com"}, Bcc: []string{"carol@example.com"}},
+		Subject:    "Hello\r\nBcc: mallory@example.com",
+		TextBody:   "Hello",
+		Headers: map[string]string{
+			"In-Reply-To": references[len(references)-1],
+			"References":  strings.Join(references, " "),
+		},
+	}).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, _, _ := strings.Cut(string(raw), "\r\n\r\n")
+	for _, line := range strings.Split(header, "\r\n") {
+		if len(line) > maxHeaderLine {
+			t.Errorf("header line of %d characters: %q", len(line), line)
+		}
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := msg.Header.Get("References"), strings.Join(references, " "); got != want {
+		t.Errorf("References = %q, want %q", got, want)
+	}
+	if got := msg.Header.Get("Bcc"); got != "" {
+		t.Errorf("Bcc = %q, want no Bcc header", got)
+	}
+	if got := msg.Header.Get("To"); got != "<bob@example.com>" {
+		t.Errorf("To = %q", got)
+	}
+	if got := msg.Header.Get("Message-ID"); !strings.HasSuffix(got, "@example.com>") {
+		t.Errorf("Message-ID = %q, want one on the sender domain", got)
+	}
+}
+
+func TestWriteHeader(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{name: "short", value: "a b c", want: "X-Test: a b c\r\n"},
+		{name: "empty", value: "", want: "X-Test: \r\n"},
+		{name: "line breaks dropped", value: "a\r\nBcc: b", want: "X-Test: aBcc: b\r\n"},
+		{
+			name:  "folded at spaces",
+			value: strings.Repeat("abcdefghij ", 10),
+			want: "X-Test: abcdefghij abcdefghij abcdefghij abcdefghij abcdefghij abcdefghij\r\n" +
+				" abcdefghij abcdefghij abcdefghij abcdefghij \r\n",
+		},
+		{
+			name:  "word longer than a line",
+			value: strings.Repeat("x", 100),
+			want:  "X-Test: " + strings.Repeat("x", 100) + "\r\n",
+		},
+		{
+			name:  "repeated spaces kept on one line",
+			value: strings.Repeat("y", 66) + "  z",
+			want:  "X-Test: " + strings.Repeat("y", 66) + "  z\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			writeHeader(&buf, "X-Test", tt.value)
+			if got := buf.String(); got != tt.want {
+				t.Errorf("writeHeader() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
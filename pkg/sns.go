@@ -3,10 +3,15 @@ package pkg
 import (
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"regexp"
 	"strings"
+	"sync"
+	"time"
 )
 
 type SNSMessage struct {
@@ -26,43 +31,112 @@ type SNSMessage struct {
 
 type S3Event struct {
 	Records []struct {
-		S3 struct {
+		EventName string `json:"eventName"`
+		S3        struct {
 			Bucket struct {
 				Name string `json:"name"`
 			} `json:"bucket"`
 			Object struct {
-				Key string `json:"key"`
+				Key  string `json:"key"`
+				Size int64  `json:"size"`
 			} `json:"object"`
 		} `json:"s3"`
 	} `json:"Records"`
 }
 
-func ConfirmSubscription(subscribeURL string) error {
-	resp, err := http.Get(subscribeURL)
+// SESNotification is the SNS message SES publishes for received mail. With
+// an S3 receipt action, Receipt.Action names the stored object and
+// Receipt.Recipients holds the envelope recipients (including Bcc).
+//
+// SES also publishes Bounce, Complaint and Delivery notifications for sent
+// mail; Mail.MessageID is then the ID SendRawEmail returned. Configuration
+// set event publishing names the type in EventType instead.
+type SESNotification struct {
+	NotificationType string `json:"notificationType"`
+	EventType        string `json:"eventType"`
+	Mail             struct {
+		MessageID   string   `json:"messageId"`
+		Source      string   `json:"source"`
+		Destination []string `json:"destination"`
+	} `json:"mail"`
+	Receipt struct {
+		Recipients []string `json:"recipients"`
+		Action     struct {
+			Type       string `json:"type"`
+			BucketName string `json:"bucketName"`
+			ObjectKey  string `json:"objectKey"`
+		} `json:"action"`
+	} `json:"receipt"`
+	Bounce struct {
+		BounceType        string `json:"bounceType"`
+		BounceSubType     string `json:"bounceSubType"`
+		BouncedRecipients []struct {
+			EmailAddress   string `json:"emailAddress"`
+			Action         string `json:"action"`
+			Status         string `json:"status"`
+			DiagnosticCode string `json:"diagnosticCode"`
+		} `json:"bouncedRecipients"`
+	} `json:"bounce"`
+	Complaint struct {
+		ComplaintFeedbackType string `json:"complaintFeedbackType"`
+		ComplainedRecipients  []struct {
+			EmailAddress string `json:"emailAddress"`
+		} `json:"complainedRecipients"`
+	} `json:"complaint"`
+	Delivery struct {
+		Recipients   []string `json:"recipients"`
+		SMTPResponse string   `json:"smtpResponse"`
+	} `json:"delivery"`
+}
+
+// Type returns the notification type whichever way SES published it.
+func (n SESNotification) Type() string {
+	if n.NotificationType != "" {
+		return n.NotificationType
+	}
+	return n.EventType
+}
+
+// snsHostPattern matches the SNS endpoints allowed to serve signing
+// certificates and subscription URLs.
+var snsHostPattern = regexp.MustCompile(`^sns\.[a-z0-9-]+\.amazonaws\.com(\.cn)?$`)
+
+var (
+	snsCertCache   = map[string]*x509.Certificate{}
+	snsCertCacheMu sync.RWMutex
+)
+
+// validateSNSURL rejects URLs that are not HTTPS URLs on an SNS host, so a
+// forged message cannot make us fetch arbitrary URLs.
+func validateSNSURL(rawURL string) error {
+	parsedURL, err := url.Parse(rawURL)
 	if err != nil {
-		return err
+		return fmt.Errorf("invalid SNS URL: %v", err)
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("Failed to confirm subscription, status code: %d", resp.StatusCode)
+	if parsedURL.Scheme != "https" || !snsHostPattern.MatchString(parsedURL.Hostname()) {
+		return fmt.Errorf("untrusted SNS URL host: %s", parsedURL.Host)
 	}
 	return nil
 }
 
-func VerifySNSMessage(message SNSMessage) error {
-	// Download the certificate
-	resp, err := http.Get(message.SigningCertURL)
-	if err != nil {
+func ConfirmSubscription(subscribeURL string) error {
+	if err := validateSNSURL(subscribeURL); err != nil {
 		return err
 	}
-	defer resp.Body.Close()
 
-	certData, err := io.ReadAll(resp.Body)
+	resp, err := http.Get(subscribeURL)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Failed to confirm subscription, status code: %d", resp.StatusCode)
+	}
+	return nil
+}
 
-	cert, err := x509.ParseCertificate(certData)
+func VerifySNSMessage(message SNSMessage) error {
+	cert, err := getSNSCertificate(message.SigningCertURL)
 	if err != nil {
 		return err
 	}
@@ -76,8 +150,13 @@ func VerifySNSMessage(message SNSMessage) error {
 		return err
 	}
 
+	algorithm := x509.SHA1WithRSA
+	if message.SignatureVersion == "2" {
+		algorithm = x509.SHA256WithRSA
+	}
+
 	// Verify the signature
-	err = cert.CheckSignature(x509.SHA1WithRSA, []byte(stringToSign), signature)
+	err = cert.CheckSignature(algorithm, []byte(stringToSign), signature)
 	if err != nil {
 		return err
 	}
@@ -85,37 +164,80 @@ func VerifySNSMessage(message SNSMessage) error {
 	return nil
 }
 
-func BuildStringToSign(message SNSMessage) string {
-	var signLines []string
+// getSNSCertificate downloads the PEM signing certificate once per URL.
+func getSNSCertificate(certURL string) (*x509.Certificate, error) {
+	if err := validateSNSURL(certURL); err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(certURL, ".pem") {
+		return nil, fmt.Errorf("invalid SNS certificate URL: %s", certURL)
+	}
 
-	if message.Type != "" {
-		signLines = append(signLines, "Message")
-		signLines = append(signLines, message.Message)
+	snsCertCacheMu.RLock()
+	cert, ok := snsCertCache[certURL]
+	snsCertCacheMu.RUnlock()
+	if ok && time.Now().Before(cert.NotAfter) {
+		return cert, nil
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(certURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download SNS certificate, status code: %d", resp.StatusCode)
 	}
 
-	if message.MessageId != "" {
-		signLines = append(signLines, "MessageId")
-		signLines = append(signLines, message.MessageId)
+	certData, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
 	}
 
-	if message.Subject != "" {
-		signLines = append(signLines, "Subject")
-		signLines = append(signLines, message.Subject)
+	block, _ := pem.Decode(certData)
+	if block == nil {
+		return nil, fmt.Errorf("SNS certificate is not PEM encoded")
 	}
 
-	if message.Timestamp != "" {
-		signLines = append(signLines, "Timestamp")
-		signLines = append(signLines, message.Timestamp)
+	cert, err = x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
 	}
 
-	if message.TopicArn != "" {
-		signLines = append(signLines, "TopicArn")
-		signLines = append(signLines, message.TopicArn)
+	snsCertCacheMu.Lock()
+	snsCertCache[certURL] = cert
+	snsCertCacheMu.Unlock()
+
+	return cert, nil
+}
+
+// BuildStringToSign returns the canonical string SNS signs. Notifications
+// sign Subject when present; subscription messages sign SubscribeURL and
+// Token instead.
+func BuildStringToSign(message SNSMessage) string {
+	var signLines []string
+
+	add := func(key, value string) {
+		signLines = append(signLines, key, value)
 	}
 
-	if message.Type != "" {
-		signLines = append(signLines, "Type")
-		signLines = append(signLines, message.Type)
+	add("Message", message.Message)
+	add("MessageId", message.MessageId)
+
+	if message.Type == "Notification" {
+		if message.Subject != "" {
+			add("Subject", message.Subject)
+		}
+		add("Timestamp", message.Timestamp)
+		add("TopicArn", message.TopicArn)
+		add("Type", message.Type)
+	} else {
+		add("SubscribeURL", message.SubscribeURL)
+		add("Timestamp", message.Timestamp)
+		add("Token", message.Token)
+		add("TopicArn", message.TopicArn)
+		add("Type", message.Type)
 	}
 
 	return strings.Join(signLines, "\n") + "\n"
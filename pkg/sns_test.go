@@ -0,0 +1,238 @@
+package pkg
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"testing"
+	"time"
+)
+
+const testSNSCertURL = "https://sns.us-east-1.amazonaws.com/SimpleNotificationService-test.pem"
+
+// cacheTestSNSCertificate puts a self-signed certificate in the cache under
+// testSNSCertURL, so verification never downloads anything.
+func cacheTestSNSCertificate(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sns.amazonaws.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snsCertCacheMu.Lock()
+	snsCertCache[testSNSCertURL] = cert
+	snsCertCacheMu.Unlock()
+	t.Cleanup(func() {
+		snsCertCacheMu.Lock()
+		delete(snsCertCache, testSNSCertURL)
+		snsCertCacheMu.Unlock()
+	})
+	return key
+}
+
+func signTestSNSMessage(t *testing.T, key *rsa.PrivateKey, message *SNSMessage) {
+	t.Helper()
+
+	stringToSign := []byte(BuildStringToSign(*message))
+	var signature []byte
+	var err error
+	if message.SignatureVersion == "2" {
+		digest := sha256.Sum256(stringToSign)
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	} else {
+		digest := sha1.Sum(stringToSign)
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA1, digest[:])
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	message.Signature = base64.StdEncoding.EncodeToString(signature)
+}
+
+func TestVerifySNSMessage(t *testing.T) {
+	key := cacheTestSNSCertificate(t)
+
+	notification := func(version string) SNSMessage {
+		return SNSMessage{
+			Type:             "Notification",
+			MessageId:        "22b80b92-fdea-4c2c-8f9d-bdfb0c7bf324",
+			TopicArn:         "arn:aws:sns:us-east-1:123456789012:inbound",
+			Subject:          "Amazon SES Email Receipt Notification",
+			Message:          `{"notificationType":"Received"}`,
+			Timestamp:        "2024-12-01T12:00:00.000Z",
+			SignatureVersion: version,
+			SigningCertURL:   testSNSCertURL,
+		}
+	}
+
+	tests := []struct {
+		name    string
+		message func() SNSMessage
+		wantErr bool
+	}{
+		{
+			name: "signature version 1",
+			message: func() SNSMessage {
+				m := notification("1")
+				signTestSNSMessage(t, key, &m)
+				return m
+			},
+		},
+		{
+			name: "signature version 2",
+			message: func() SNSMessage {
+				m := notification("2")
+				signTestSNSMessage(t, key, &m)
+				return m
+			},
+		},
+		{
+			name: "subscription confirmation",
+			message: func() SNSMessage {
+				m := notification("1")
+				m.Type = "SubscriptionConfirmation"
+				m.Subject = ""
+				m.SubscribeURL = "https://sns.us-east-1.amazonaws.com/?Action=ConfirmSubscription"
+				m.Token = "token"
+				signTestSNSMessage(t, key, &m)
+				return m
+			},
+		},
+		{
+			name: "tampered message",
+			message: func() SNSMessage {
+				m := notification("1")
+				signTestSNSMessage(t, key, &m)
+				m.Message = `{"notificationType":"Bounce"}`
+				return m
+			},
+			wantErr: true,
+		},
+		{
+			name: "tampered topic",
+			message: func() SNSMessage {
+				m := notification("2")
+				signTestSNSMessage(t, key, &m)
+				m.TopicArn = "arn:aws:sns:us-east-1:999999999999:inbound"
+				return m
+			},
+			wantErr: true,
+		},
+		{
+			name: "signature version mismatch",
+			message: func() SNSMessage {
+				m := notification("1")
+				signTestSNSMessage(t, key, &m)
+				m.SignatureVersion = "2"
+				return m
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid signature encoding",
+			message: func() SNSMessage {
+				m := notification("1")
+				m.Signature = "not base64!"
+				return m
+			},
+			wantErr: true,
+		},
+		{
+			name: "certificate on untrusted host",
+			message: func() SNSMessage {
+				m := notification("1")
+				m.SigningCertURL = "https://attacker.example.com/cert.pem"
+				return m
+			},
+			wantErr: true,
+		},
+		{
+			name: "certificate over plain http",
+			message: func() SNSMessage {
+				m := notification("1")
+				m.SigningCertURL = "http://sns.us-east-1.amazonaws.com/cert.pem"
+				return m
+			},
+			wantErr: true,
+		},
+		{
+			name: "certificate URL that is not a pem file",
+			message: func() SNSMessage {
+				m := notification("1")
+				m.SigningCertURL = "https://sns.us-east-1.amazonaws.com/cert"
+				return m
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifySNSMessage(tt.message())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("VerifySNSMessage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBuildStringToSign(t *testing.T) {
+	tests := []struct {
+		name    string
+		message SNSMessage
+		want    string
+	}{
+		{
+			name: "notification with subject",
+			message: SNSMessage{
+				Type: "Notification", MessageId: "id", TopicArn: "arn", Subject: "subject",
+				Message: "body", Timestamp: "ts",
+			},
+			want: "Message\nbody\nMessageId\nid\nSubject\nsubject\nTimestamp\nts\nTopicArn\narn\nType\nNotification\n",
+		},
+		{
+			name: "notification without subject",
+			message: SNSMessage{
+				Type: "Notification", MessageId: "id", TopicArn: "arn", Message: "body", Timestamp: "ts",
+			},
+			want: "Message\nbody\nMessageId\nid\nTimestamp\nts\nTopicArn\narn\nType\nNotification\n",
+		},
+		{
+			name: "subscription confirmation",
+			message: SNSMessage{
+				Type: "SubscriptionConfirmation", MessageId: "id", TopicArn: "arn", Message: "body",
+				Timestamp: "ts", SubscribeURL: "url", Token: "token",
+			},
+			want: "Message\nbody\nMessageId\nid\nSubscribeURL\nurl\nTimestamp\nts\nToken\ntoken\nTopicArn\narn\nType\nSubscriptionConfirmation\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := BuildStringToSign(tt.message); got != tt.want {
+				t.Errorf("BuildStringToSign() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
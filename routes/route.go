@@ -19,7 +19,7 @@ func RegisterRoutes(e *echo.Echo) {
 	// User routes
 	e.POST("/login", user.LoginHandler)
 	e.POST("/logout", user.LogoutHandler, middleware.JWTMiddleware)
-	// e.POST("/sns/notifications", email.CallbackNotifEmailHandler)
+	e.POST("/sns/notifications", email.SNSNotificationHandler)
 
 	superAdminOnly := []int{0}
 	admin := []int{0, 2}
@@ -28,6 +28,16 @@ func RegisterRoutes(e *echo.Echo) {
 	domainGroup.GET("/dropdown", domain.GetDropdownDomainHandler, middleware.RoleMiddleware(admin)) // Admin-only
 	e.POST("/", domain.CreateDomainHandler, middleware.RoleMiddleware(superAdminOnly))
 	e.DELETE("/:id", domain.DeleteDomainHandler, middleware.RoleMiddleware(superAdminOnly))
+	domainGroup.GET("/:id/aliases", domain.ListDomainAliasesHandler, middleware.RoleMiddleware(admin))
+	domainGroup.POST("/:id/aliases", domain.CreateDomainAliasHandler, middleware.RoleMiddleware(superAdminOnly))
+	domainGroup.PUT("/:id/aliases/:alias_id", domain.UpdateDomainAliasHandler, middleware.RoleMiddleware(superAdminOnly))
+	domainGroup.DELETE("/:id/aliases/:alias_id", domain.DeleteDomainAliasHandler, middleware.RoleMiddleware(superAdminOnly))
+	domainGroup.GET("/:id/catch-all", domain.GetDomainCatchAllHandler, middleware.RoleMiddleware(admin))
+	domainGroup.PUT("/:id/catch-all", domain.UpdateDomainCatchAllHandler, middleware.RoleMiddleware(superAdminOnly))
+	domainGroup.DELETE("/:id/catch-all", domain.DeleteDomainCatchAllHandler, middleware.RoleMiddleware(superAdminOnly))
+	domainGroup.GET("/:id/transport", domain.GetDomainTransportHandler, middleware.RoleMiddleware(admin))
+	domainGroup.PUT("/:id/transport", domain.UpdateDomainTransportHandler, middleware.RoleMiddleware(superAdminOnly))
+	domainGroup.DELETE("/:id/transport", domain.DeleteDomainTransportHandler, middleware.RoleMiddleware(superAdminOnly))
 
 	userGroup := e.Group("/user")
 	userGroup.Use(middleware.JWTMiddleware)
@@ -41,6 +51,21 @@ func RegisterRoutes(e *echo.Echo) {
 	userGroup.GET("/get_user_me", user.GetUserMeHandler)
 	userGroup.GET("/", user.ListUsersHandler, middleware.RoleMiddleware(admin))
 	userGroup.GET("/admin", user.ListAdminUsersHandler, middleware.RoleMiddleware(superAdminOnly))
+	userGroup.GET("/:id/retention", user.GetUserRetentionHandler, middleware.RoleMiddleware(admin))
+	userGroup.PUT("/:id/retention", user.UpdateUserRetentionHandler, middleware.RoleMiddleware(admin))
+	userGroup.DELETE("/:id/retention", user.DeleteUserRetentionHandler, middleware.RoleMiddleware(admin))
+	userGroup.GET("/:id/plan", user.GetUserPlanHandler, middleware.RoleMiddleware(admin))
+	userGroup.PUT("/:id/plan", user.AssignUserPlanHandler, middleware.RoleMiddleware(admin))
+	userGroup.DELETE("/:id/plan", user.DeleteUserPlanHandler, middleware.RoleMiddleware(admin))
+	userGroup.GET("/plans", user.ListPlansHandler, middleware.RoleMiddleware(admin))
+	userGroup.POST("/plans", user.CreatePlanHandler, middleware.RoleMiddleware(superAdminOnly))
+	userGroup.PUT("/plans/:id", user.UpdatePlanHandler, middleware.RoleMiddleware(superAdminOnly))
+	userGroup.DELETE("/plans/:id", user.DeletePlanHandler, middleware.RoleMiddleware(superAdminOnly))
+	userGroup.PUT("/plan/domain/:domain", user.AssignDomainPlanHandler, middleware.RoleMiddleware(superAdminOnly))
+	userGroup.DELETE("/plan/domain/:domain", user.DeleteDomainPlanHandler, middleware.RoleMiddleware(superAdminOnly))
+	userGroup.GET("/retention/domain/:domain", user.GetDomainRetentionHandler, middleware.RoleMiddleware(superAdminOnly))
+	userGroup.PUT("/retention/domain/:domain", user.UpdateDomainRetentionHandler, middleware.RoleMiddleware(superAdminOnly))
+	userGroup.DELETE("/retention/domain/:domain", user.DeleteDomainRetentionHandler, middleware.RoleMiddleware(superAdminOnly))
 	userGroup.DELETE("/:id", user.DeleteUserHandler, middleware.RoleMiddleware(admin))
 	userGroup.DELETE("/admin/:id", user.DeleteUserAdminHandler, middleware.RoleMiddleware(superAdminOnly)) // Admin-only
 
@@ -50,17 +75,40 @@ func RegisterRoutes(e *echo.Echo) {
 	emailGroup.GET("/:id", email.GetEmailHandler, middleware.RoleMiddleware(admin))
 	emailGroup.GET("/by_user", email.ListEmailByTokenHandler)                                    // - sync mailbox
 	emailGroup.GET("/by_user/detail/:id", email.GetEmailHandler)                                 // email id
+	emailGroup.GET("/by_user/raw/:id", email.GetRawEmailHandler)                                 // email id
+	emailGroup.GET("/by_user/search", email.SearchEmailHandler)                                  // - search mailbox
+	emailGroup.GET("/stream", email.StreamEmailHandler)                                          // - mailbox events (SSE)
+	emailGroup.GET("/threads", email.ListThreadsHandler)                                         // - conversations
+	emailGroup.GET("/threads/:id", email.GetThreadHandler)                                       // thread id
 	emailGroup.POST("/by_user/download/file", email.GetFileEmailToDownloadHandler)               // email id
 	emailGroup.GET("/by_user/:id", email.ListEmailByIDHandler, middleware.RoleMiddleware(admin)) // user id - sync mailbox
 	emailGroup.GET("/sent/by_user", email.SentEmailByIDHandler)
+	emailGroup.GET("/sent", email.ListSentEmailsHandler)                    // - delivery status
+	emailGroup.GET("/sent/:id/failures", email.ListDeliveryFailuresHandler) // email id
+	emailGroup.GET("/scheduled", email.ListScheduledEmailsHandler)          // - pending scheduled sends
+	emailGroup.PUT("/scheduled/:id", email.UpdateScheduledEmailHandler)     // email id
+	emailGroup.DELETE("/scheduled/:id", email.DeleteScheduledEmailHandler)  // email id
 	emailGroup.POST("/send", email.SendEmailHandler)
-	emailGroup.POST("/send/smtp", email.SendEmailSMTPHandler)
-	emailGroup.POST("/send/test/haraka", email.SendEmailSMTPHHandler)
-	emailGroup.POST("/send/url_attachment", email.SendEmailUrlAttachmentHandler)
+	emailGroup.POST("/:id/reply", email.ReplyEmailHandler)        // email id
+	emailGroup.POST("/:id/reply_all", email.ReplyAllEmailHandler) // email id
+	emailGroup.POST("/:id/forward", email.ForwardEmailHandler)    // email id
+	emailGroup.GET("/drafts", email.ListDraftsHandler)            // - autosaved drafts
+	emailGroup.POST("/drafts", email.CreateDraftHandler)
+	emailGroup.PUT("/drafts/:id", email.UpdateDraftHandler)     // email id
+	emailGroup.DELETE("/drafts/:id", email.DeleteDraftHandler)  // email id
+	emailGroup.POST("/drafts/:id/send", email.SendDraftHandler) // email id
 	emailGroup.POST("/delete-attachment", email.DeleteUrlAttachmentHandler)
 	emailGroup.GET("/", email.ListEmailsHandler, middleware.RoleMiddleware(admin))
 	emailGroup.DELETE("/:id", email.DeleteEmailHandler, middleware.RoleMiddleware(admin)) // Admin-only
 
 	emailGroup.GET("/bucket/sync", email.SyncBucketInboxHandler, middleware.RoleMiddleware(admin)) // Admin-only
+	emailGroup.GET("/incoming", email.ListIncomingEmailsHandler, middleware.RoleMiddleware(superAdminOnly))
+	emailGroup.POST("/incoming/:id/retry", email.RetryIncomingEmailHandler, middleware.RoleMiddleware(superAdminOnly))
+	emailGroup.GET("/suppressions", email.ListSuppressedRecipientsHandler, middleware.RoleMiddleware(admin))
+	emailGroup.DELETE("/suppressions/:id", email.DeleteSuppressedRecipientHandler, middleware.RoleMiddleware(superAdminOnly))
+	emailGroup.GET("/quarantine", email.ListQuarantinedEmailsHandler, middleware.RoleMiddleware(superAdminOnly))
+	emailGroup.GET("/quarantine/:id", email.GetQuarantinedEmailHandler, middleware.RoleMiddleware(superAdminOnly))
+	emailGroup.POST("/quarantine/:id/assign", email.AssignQuarantinedEmailHandler, middleware.RoleMiddleware(superAdminOnly))
+	emailGroup.DELETE("/quarantine/:id", email.DeleteQuarantinedEmailHandler, middleware.RoleMiddleware(superAdminOnly))
 	// emailGroup.GET("/bucket/inbox", email.GetInboxHandler, middleware.RoleMiddleware(0))       // Admin-only
 }